@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ==================== Admin ====================
+
+// MaintenanceState is reported by /api/status. While enabled, new model
+// runs are refused; runs already in flight finish normally.
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	By      string     `json:"by,omitempty"`
+}
+
+type MaintenanceRequest struct {
+	Enabled *bool  `json:"enabled"`
+	Message string `json:"message"`
+}
+
+const defaultMaintenanceMessage = "Server is under maintenance, please try again later"
+
+func (s *Server) currentMaintenance() MaintenanceState {
+	s.maintenanceMu.RLock()
+	defer s.maintenanceMu.RUnlock()
+	return s.maintenance
+}
+
+// rejectIfMaintenance answers 503 and returns true while maintenance mode
+// is on.
+func (s *Server) rejectIfMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	m := s.currentMaintenance()
+	if !m.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", "300")
+	s.sendErrorCode(w, r, m.Message, "maintenance", http.StatusServiceUnavailable)
+	return true
+}
+
+// handleMaintenance sets maintenance mode from {"enabled": bool}, or flips
+// it when the body leaves enabled out.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MaintenanceRequest
+	if err := s.decodeJSON(r, &req); err != nil && !errors.Is(err, errEmptyBody) {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+
+	s.maintenanceMu.Lock()
+	enabled := !s.maintenance.Enabled
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	if enabled {
+		now := time.Now()
+		msg := req.Message
+		if msg == "" {
+			msg = defaultMaintenanceMessage
+		}
+		s.maintenance = MaintenanceState{Enabled: true, Message: msg, Since: &now, By: username}
+	} else {
+		s.maintenance = MaintenanceState{}
+	}
+	state := s.maintenance
+	s.maintenanceMu.Unlock()
+
+	log.Printf("[%s] Maintenance mode set to %v", username, state.Enabled)
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    state,
+	})
+}
+
+func (s *Server) handleRunning(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    s.listRunning(),
+	})
+}
+
+// handleUserActive is POST /api/admin/users/{name}/disable or /enable.
+func (s *Server) handleUserActive(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		admin := r.Header.Get("X-Username")
+		name := r.PathValue("name")
+		if !active && name == admin {
+			s.sendError(w, r, "You cannot disable your own account", http.StatusBadRequest)
+			return
+		}
+
+		err := s.setUserActive(name, active)
+		if errors.Is(err, errUserNotFound) {
+			s.sendError(w, r, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.sendError(w, r, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		action := "disabled"
+		if active {
+			action = "enabled"
+		}
+		log.Printf("[%s] User '%s' %s", admin, name, action)
+
+		s.writeJSON(w, r, http.StatusOK, APIResponse{
+			Success: true,
+			Message: "User " + action,
+			Data:    map[string]interface{}{"username": name, "active": active},
+		})
+	}
+}
+
+// secretConfigFields are withheld from /api/admin/config outright.
+// Connection strings are shown with their passwords masked instead.
+var secretConfigFields = map[string]bool{
+	"AdminPassword": true,
+	"UsernameSalt":  true,
+	"ShareSecret":   true,
+}
+
+var connectionConfigFields = map[string]bool{
+	"DatabaseURL":        true,
+	"DatabaseReplicaURL": true,
+}
+
+// describeConfig renders cfg field by field for display: durations as
+// strings and nested settings as objects, with secrets redacted.
+func describeConfig(v reflect.Value) map[string]interface{} {
+	out := make(map[string]interface{}, v.NumField())
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, f := t.Field(i).Name, v.Field(i)
+		switch {
+		case secretConfigFields[name]:
+			if f.String() != "" {
+				out[name] = "[redacted]"
+			} else {
+				out[name] = ""
+			}
+		case connectionConfigFields[name]:
+			out[name] = string(redactLogLine([]byte(f.String())))
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			out[name] = time.Duration(f.Int()).String()
+		case f.Kind() == reflect.Struct:
+			out[name] = describeConfig(f)
+		default:
+			out[name] = f.Interface()
+		}
+	}
+	return out
+}
+
+// handleAdminConfig is GET /api/admin/config: the active configuration
+// and which of its fields a SIGHUP can change.
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reloadable := make([]string, 0, len(reloadableFields))
+	for name := range reloadableFields {
+		reloadable = append(reloadable, name)
+	}
+	sort.Strings(reloadable)
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"config":     describeConfig(reflect.ValueOf(s.config())),
+			"reloadable": reloadable,
+		},
+	})
+}
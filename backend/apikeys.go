@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==================== API keys ====================
+
+// API keys let pipelines authenticate without a password. Each maps to a
+// service account, serviceAccountPrefix plus the name it was created
+// with, and runs are logged under that identity. Keys are random, so the
+// store keeps only their SHA-256; like users they live in memory and, when
+// the database is up, in the api_keys table.
+
+const (
+	apiKeyPrefix         = "mk_"
+	serviceAccountPrefix = "svc:"
+)
+
+// API key scopes. read covers GET requests, run the rest of the
+// authenticated API; admin covers everything, admin endpoints included.
+const (
+	scopeRead  = "read"
+	scopeRun   = "run"
+	scopeAdmin = "admin"
+)
+
+var (
+	apiKeyScopes        = []string{scopeRead, scopeRun, scopeAdmin}
+	defaultAPIKeyScopes = []string{scopeRead, scopeRun}
+	serviceAccountName  = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,63}$`)
+	errAPIKeyNotFound   = errors.New("api key not found")
+)
+
+// APIKey is a key as listed to admins; the key itself is only returned
+// when it is created, Hint is enough to tell keys apart.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Account   string    `json:"account"`
+	Scopes    []string  `json:"scopes"`
+	Hint      string    `json:"key"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	hash string
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyContextKey struct{}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// allows reports whether k grants scope; admin grants every scope.
+func (k *APIKey) allows(scope string) bool {
+	return containsString(k.Scopes, scope) || containsString(k.Scopes, scopeAdmin)
+}
+
+// requestAPIKey is the key authMiddleware accepted for r, or nil when the
+// request came with a session token.
+func requestAPIKey(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// createAPIKey issues a key for service account name and returns it with
+// the plain key, which is not kept.
+func (s *Server) createAPIKey(name string, scopes []string, createdBy string) (*APIKey, string, error) {
+	plain := apiKeyPrefix + generateToken()
+	k := &APIKey{
+		ID:        generateToken()[:16],
+		Account:   serviceAccountPrefix + name,
+		Scopes:    scopes,
+		Hint:      plain[:len(apiKeyPrefix)+6] + "…",
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		hash:      hashAPIKey(plain),
+	}
+	if s.database() != nil {
+		_, err := s.database().Exec(`INSERT INTO api_keys (id, key_hash, hint, account, scopes, created_by, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			k.ID, k.hash, k.Hint, k.Account, strings.Join(k.Scopes, ","), k.CreatedBy, k.CreatedAt)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	s.mu.Lock()
+	s.apiKeys[k.hash] = k
+	s.mu.Unlock()
+	return k, plain, nil
+}
+
+// lookupAPIKey finds a key in memory, then in the database.
+func (s *Server) lookupAPIKey(plain string) (*APIKey, bool) {
+	hash := hashAPIKey(plain)
+	s.mu.RLock()
+	k, ok := s.apiKeys[hash]
+	s.mu.RUnlock()
+	if ok || s.database() == nil {
+		return k, ok
+	}
+
+	k = &APIKey{hash: hash}
+	var scopes string
+	err := s.database().QueryRow(`SELECT id, hint, account, scopes, created_by, created_at FROM api_keys WHERE key_hash = $1`, hash).
+		Scan(&k.ID, &k.Hint, &k.Account, &scopes, &k.CreatedBy, &k.CreatedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.errorLog.Printf("Failed to look up API key: %v", err)
+		}
+		return nil, false
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	s.mu.Lock()
+	s.apiKeys[hash] = k
+	s.mu.Unlock()
+	return k, true
+}
+
+// listAPIKeys returns every key, oldest first.
+func (s *Server) listAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	if s.database() == nil {
+		s.mu.RLock()
+		for _, k := range s.apiKeys {
+			keys = append(keys, *k)
+		}
+		s.mu.RUnlock()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+		return keys, nil
+	}
+
+	rows, err := s.queryRead(`SELECT id, hint, account, scopes, created_by, created_at FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		if err := rows.Scan(&k.ID, &k.Hint, &k.Account, &scopes, &k.CreatedBy, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes = strings.Split(scopes, ",")
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// revokeAPIKey deletes the key with id; requests using it fail from then
+// on.
+func (s *Server) revokeAPIKey(id string) (*APIKey, error) {
+	var found *APIKey
+	s.mu.Lock()
+	for hash, k := range s.apiKeys {
+		if k.ID == id {
+			found = k
+			delete(s.apiKeys, hash)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.database() != nil {
+		var account string
+		err := s.database().QueryRow(`DELETE FROM api_keys WHERE id = $1 RETURNING account`, id).Scan(&account)
+		if errors.Is(err, sql.ErrNoRows) && found == nil {
+			return nil, errAPIKeyNotFound
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if found == nil {
+			found = &APIKey{ID: id, Account: account}
+		}
+	}
+	if found == nil {
+		return nil, errAPIKeyNotFound
+	}
+	return found, nil
+}
+
+// authenticateAPIKey is authMiddleware for a request with X-API-Key. GET
+// requests need the read scope, the others run. It answers the error
+// itself and returns nil when the key doesn't pass.
+func (s *Server) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plain string) *http.Request {
+	k, ok := s.lookupAPIKey(plain)
+	if !ok {
+		s.sendError(w, r, "Invalid API key", http.StatusUnauthorized)
+		return nil
+	}
+	scope := scopeRun
+	if r.Method == "GET" || r.Method == "HEAD" {
+		scope = scopeRead
+	}
+	if !k.allows(scope) {
+		s.sendErrorCode(w, r, fmt.Sprintf("API key lacks the %s scope", scope), "insufficient_scope", http.StatusForbidden)
+		return nil
+	}
+	r.Header.Set("X-Username", k.Account)
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k))
+}
+
+// handleAPIKeys is GET and POST /api/admin/apikeys.
+func (s *Server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	admin := r.Header.Get("X-Username")
+
+	switch r.Method {
+	case "GET":
+		keys, err := s.listAPIKeys()
+		if err != nil {
+			s.sendError(w, r, "Failed to list API keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: keys})
+	case "POST":
+		var req CreateAPIKeyRequest
+		if err := s.decodeJSON(r, &req); err != nil {
+			s.sendDecodeError(w, r, err)
+			return
+		}
+		if !serviceAccountName.MatchString(req.Name) {
+			s.sendError(w, r, "name must be 3-64 lowercase letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = defaultAPIKeyScopes
+		}
+		for _, scope := range req.Scopes {
+			if !containsString(apiKeyScopes, scope) {
+				s.sendError(w, r, fmt.Sprintf("Unknown scope %q (use %s)", scope, strings.Join(apiKeyScopes, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		k, plain, err := s.createAPIKey(req.Name, req.Scopes, admin)
+		if err != nil {
+			s.sendError(w, r, "Failed to create API key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[%s] API key %s created for %s (%s)", admin, k.ID, k.Account, strings.Join(k.Scopes, ","))
+		s.writeJSON(w, r, http.StatusCreated, APIResponse{
+			Success: true,
+			Message: "API key created; it is not shown again",
+			Data: map[string]interface{}{
+				"apiKey": k,
+				"key":    plain,
+			},
+		})
+	default:
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAPIKey is DELETE /api/admin/apikeys/{id}.
+func (s *Server) handleAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	k, err := s.revokeAPIKey(r.PathValue("id"))
+	if errors.Is(err, errAPIKeyNotFound) {
+		s.sendError(w, r, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to revoke API key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] API key %s for %s revoked", r.Header.Get("X-Username"), k.ID, k.Account)
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "API key revoked",
+		Data:    map[string]interface{}{"id": k.ID, "account": k.Account},
+	})
+}
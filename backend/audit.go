@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== Admin audit ====================
+
+// Every admin request that can change something (anything but GET, HEAD
+// and OPTIONS) is recorded in admin_audit once it has been answered,
+// whatever the outcome, and also as an AUDIT line in the server log, so
+// the trail survives a database outage.
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+	// auditErrorBytes is how much of a failed response is kept to pull
+	// its error message from.
+	auditErrorBytes = 4 << 10
+)
+
+// AuditEntry is one admin action. Action is the method and route pattern,
+// Target the path values it named (a username, a key id), Status the HTTP
+// status it was answered with.
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Admin     string    `json:"admin"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Status    int       `json:"status"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// auditRecorder notes the status a handler answers with and the start of
+// an error body.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 400 && rec.body.Len() < auditErrorBytes {
+		rec.body.Write(b[:min(len(b), auditErrorBytes-rec.body.Len())])
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (rec *auditRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// errorMessage is the "error" field of a failed JSON response, or the raw
+// start of any other failed body.
+func (rec *auditRecorder) errorMessage() string {
+	if rec.status < 400 {
+		return ""
+	}
+	var resp APIResponse
+	if json.Unmarshal(rec.body.Bytes(), &resp) == nil && resp.Error != "" {
+		return resp.Error
+	}
+	return strings.TrimSpace(rec.body.String())
+}
+
+// audited records the admin request r once next has answered it. A
+// handler that panics is recorded as a 500 before the panic goes on.
+func (s *Server) audited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next(w, r)
+			return
+		}
+		rec := &auditRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			e := AuditEntry{
+				Timestamp: time.Now().UTC(),
+				Admin:     r.Header.Get("X-Username"),
+				Action:    r.Method + " " + r.Pattern,
+				Target:    auditTarget(r),
+				Status:    rec.status,
+				Error:     rec.errorMessage(),
+				RequestID: requestID(r),
+			}
+			if p != nil {
+				e.Status, e.Error = http.StatusInternalServerError, fmt.Sprint("panic: ", p)
+			}
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			e.Success = e.Status < 400
+			s.recordAudit(e)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next(rec, r)
+	}
+}
+
+// auditTarget joins the path values of r's route, e.g. "name=alice".
+func auditTarget(r *http.Request) string {
+	var parts []string
+	for _, name := range []string{"name", "id", "token"} {
+		if v := r.PathValue(name); v != "" {
+			parts = append(parts, name+"="+v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// recordAudit logs e and writes it to admin_audit.
+func (s *Server) recordAudit(e AuditEntry) {
+	action := e.Action
+	if e.Target != "" {
+		action += " " + e.Target
+	}
+	outcome := "ok"
+	if !e.Success {
+		outcome = "failed: " + e.Error
+	}
+	log.Printf("AUDIT [%s] %s -> %d %s", e.Admin, action, e.Status, outcome)
+
+	if s.database() == nil {
+		return
+	}
+	query := `INSERT INTO admin_audit (timestamp, admin, action, target, status, success, error_msg, request_id)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := s.database().Exec(query, e.Timestamp, e.Admin, e.Action, e.Target, e.Status, e.Success, e.Error, e.RequestID)
+	if err != nil {
+		s.errorLog.Printf("Failed to write admin audit entry: %v", err)
+	}
+}
+
+// getAuditLog returns up to limit entries, newest first, skipping offset;
+// admin, when set, keeps only that admin's.
+func (s *Server) getAuditLog(admin string, limit, offset int) ([]AuditEntry, error) {
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	query := `SELECT id, timestamp, admin, action, COALESCE(target, ''), status, success, COALESCE(error_msg, ''), COALESCE(request_id, '')
+			  FROM admin_audit WHERE ($1 = '' OR admin = $1) ORDER BY id DESC LIMIT $2 OFFSET $3`
+	rows, err := s.database().Query(query, admin, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Admin, &e.Action, &e.Target, &e.Status, &e.Success, &e.Error, &e.RequestID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// handleAudit is GET /api/admin/audit: the admin audit trail, newest
+// first, ?limit= entries at a time from ?offset=, optionally for one
+// ?admin=.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, offset := defaultAuditLimit, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			s.sendError(w, r, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.sendError(w, r, "offset must be a whole number, 0 or more", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	entries, err := s.getAuditLog(q.Get("admin"), limit, offset)
+	if err != nil {
+		s.sendError(w, r, "Failed to fetch audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"entries": entries,
+		"limit":   limit,
+		"offset":  offset,
+	}
+	if len(entries) == limit {
+		data["nextOffset"] = offset + limit
+	}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: data})
+}
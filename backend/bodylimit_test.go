@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// paddedJSON is doc followed by spaces up to size bytes.
+func paddedJSON(doc string, size int) string {
+	return doc + strings.Repeat(" ", size-len(doc))
+}
+
+func TestBodyLimitPerRoute(t *testing.T) {
+	const login = `{"username":"user","password":"user123"}`
+	tests := []struct {
+		name          string
+		maxBody       int
+		maxImport     int
+		path, body    string
+		unknownLength bool
+		status        int
+	}{
+		{"login at the limit", 100, 1000, "/api/login", paddedJSON(login, 100), false, http.StatusOK},
+		{"login over the limit", 100, 1000, "/api/login", paddedJSON(login, 101), false, http.StatusRequestEntityTooLarge},
+		{"login at the limit, no length", 100, 1000, "/api/login", paddedJSON(login, 100), true, http.StatusOK},
+		{"login over the limit, no length", 100, 1000, "/api/login", paddedJSON(login, 101), true, http.StatusRequestEntityTooLarge},
+		{"login with no limit", 0, 1000, "/api/login", paddedJSON(login, 1<<20), false, http.StatusOK},
+		// The import route allows more than login and nothing else.
+		{"import over the login limit", 100, 1000, "/api/history/import", paddedJSON("[]", 1000), false, http.StatusOK},
+		{"import over its own limit", 100, 1000, "/api/history/import", paddedJSON("[]", 1001), false, http.StatusRequestEntityTooLarge},
+		{"import over its own limit, no length", 100, 1000, "/api/history/import", paddedJSON("[]", 1001), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, func(cfg *Config) {
+				cfg.MaxBodyBytes, cfg.MaxImportBodyBytes = tt.maxBody, tt.maxImport
+			})
+			s.db.Store(openFakeDB(func(string, []driver.Value) ([]string, [][]driver.Value, error) { return nil, nil, nil }))
+
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+s.login("admin"))
+			if tt.unknownLength {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			s.routes(t.TempDir()).ServeHTTP(rec, req)
+
+			resp := decodeResponse(t, rec, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusRequestEntityTooLarge {
+				return
+			}
+			limit := tt.maxBody
+			if tt.path == "/api/history/import" {
+				limit = tt.maxImport
+			}
+			want := fmt.Sprintf("Request body is larger than the %d byte limit for %s", limit, tt.path)
+			if resp.Error != want || resp.Code != "body_too_large" {
+				t.Errorf("error %q, code %q; want %q, body_too_large", resp.Error, resp.Code, want)
+			}
+		})
+	}
+}
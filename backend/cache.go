@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ==================== Result cache ====================
+
+type cachedResult struct {
+	req     ModelRequest
+	out     ModelOutput
+	expires time.Time
+}
+
+// resultCacheKey identifies a run by its parameters and the model jar it
+// ran against.
+func resultCacheKey(jarSHA256 string, req ModelRequest) string {
+	seed := "-"
+	if req.Seed != nil {
+		seed = strconv.FormatInt(*req.Seed, 10)
+	}
+	// The project reaches the model, so it may change the output.
+	return fmt.Sprintf("%s|%d|%d|%g|%g|%s|%s", jarSHA256, req.Scenario, req.DrillingRate, req.OilPrice, req.ExchangeRate, seed, req.Project)
+}
+
+func (s *Server) cachedOutput(key string) (ModelOutput, bool) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	c, ok := s.resultCache[key]
+	if !ok {
+		return ModelOutput{}, false
+	}
+	if time.Now().After(c.expires) {
+		delete(s.resultCache, key)
+		return ModelOutput{}, false
+	}
+	return c.out, true
+}
+
+func (s *Server) storeOutput(key string, req ModelRequest, out ModelOutput) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	now := time.Now()
+	for k, c := range s.resultCache {
+		if now.After(c.expires) {
+			delete(s.resultCache, k)
+		}
+	}
+	s.resultCache[key] = cachedResult{req: req, out: out, expires: now.Add(s.config().ResultCacheTTL)}
+}
+
+// How a caller got results that weren't from a run of its own, as
+// request_logs.result_source records it.
+const (
+	logSourceCached = "cached" // the memory or disk result cache
+	logSourceShared = "shared" // a run another caller started
+)
+
+// sharedOutput is what a shared run hands every caller; cached is set when
+// it came from the disk cache rather than the model.
+type sharedOutput struct {
+	out    ModelOutput
+	cached bool
+}
+
+// runModelShared answers from the cache when it can and otherwise joins
+// (or starts) the in-flight run for the same parameters. Only complete,
+// successful runs are cached; failures are returned to everyone waiting at
+// the time and retried by the next request.
+//
+// The shared run doesn't stop when one caller goes away, since others may
+// still be waiting on it; MODEL_TIMEOUT still bounds it. Every caller gets
+// its own history row: executeModel logs the one that started the run,
+// and the rest are marked cached or shared. A ctx made withoutRequestLog
+// gets none.
+func (s *Server) runModelShared(ctx context.Context, id, username string, req ModelRequest) (ModelOutput, error) {
+	start := time.Now()
+	logged := requestLogged(ctx)
+	key := resultCacheKey(s.refreshModelJar().SHA256, req)
+	if s.config().ResultCacheTTL > 0 {
+		if out, ok := s.cachedOutput(key); ok {
+			if logged {
+				s.logSharedRun(username, req, out, nil, logSourceCached, start)
+			}
+			return out, nil
+		}
+	}
+
+	// Only the caller whose function runs sets started, and it reads it
+	// back after the result has come through ch.
+	started := false
+	ch := s.modelFlight.DoChan(key, func() (interface{}, error) {
+		started = true
+		cfg := s.config()
+		if cfg.DiskCacheDir != "" {
+			if out, ok := s.diskCachedOutput(key); ok {
+				if cfg.ResultCacheTTL > 0 {
+					s.storeOutput(key, req, out)
+				}
+				return sharedOutput{out: out, cached: true}, nil
+			}
+		}
+		out, err := s.executeModel(context.WithoutCancel(ctx), id, username, req)
+		if err == nil && !out.Partial {
+			if cfg.ResultCacheTTL > 0 {
+				s.storeOutput(key, req, out)
+			}
+			if cfg.DiskCacheDir != "" {
+				s.storeDiskOutput(key, req, out)
+			}
+		}
+		return sharedOutput{out: out}, err
+	})
+
+	select {
+	case res := <-ch:
+		run := res.Val.(sharedOutput)
+		switch {
+		case !logged:
+		case run.cached:
+			s.logSharedRun(username, req, run.out, res.Err, logSourceCached, start)
+		case !started:
+			s.logSharedRun(username, req, run.out, res.Err, logSourceShared, start)
+		}
+		return run.out, res.Err
+	case <-ctx.Done():
+		return ModelOutput{}, ctx.Err()
+	}
+}
+
+// logSharedRun records a caller's outcome from the cache or someone
+// else's run. The duration is how long the caller waited for it.
+func (s *Server) logSharedRun(username string, req ModelRequest, out ModelOutput, err error, source string, start time.Time) {
+	waited := time.Since(start)
+	if req.Seed == nil {
+		req.Seed = out.Seed
+	}
+	switch {
+	case err != nil:
+		s.logRequest(username, req, false, nil, nil, err.Error(), waited, source)
+	case out.Partial:
+		s.logRequest(username, req, true, out.Results, out.Raw, "Partial result of a shared run", waited, source)
+	default:
+		s.logRequest(username, req, true, out.Results, out.Raw, "", waited, source)
+	}
+}
+
+// maxScenarioBaselines bounds the scenario baseline cache; there is one
+// entry per scenario and seed asked about.
+const maxScenarioBaselines = 100
+
+type scenarioBaseline struct {
+	jarSHA256 string
+	req       ModelRequest
+	results   []SimulationResult
+}
+
+// scenarioBaselineRequest is req with the scenario's default parameters.
+// The seed is kept so a stochastic model compares like with like.
+func (s *Server) scenarioBaselineRequest(req ModelRequest) ModelRequest {
+	sc, _ := s.findScenario(req.Scenario)
+	return ModelRequest{
+		Scenario:     sc.ID,
+		DrillingRate: sc.DrillingRate,
+		OilPrice:     sc.OilPrice,
+		ExchangeRate: sc.ExchangeRate,
+		Seed:         req.Seed,
+	}
+}
+
+// scenarioBaselineResults returns the results of base, the scenario's
+// default-parameter run, running it the first time it is asked for. Entries
+// are keyed by model.jar, so a new jar runs the baselines afresh; entries
+// for an old jar are dropped when the next one is stored. The baseline run
+// isn't the caller's request, so it stays out of request_logs.
+func (s *Server) scenarioBaselineResults(ctx context.Context, id, username string, base ModelRequest) ([]SimulationResult, error) {
+	jar := s.refreshModelJar().SHA256
+	key := resultCacheKey(jar, base)
+	s.cacheMu.Lock()
+	b, ok := s.scenarioBaselines[key]
+	s.cacheMu.Unlock()
+	if ok {
+		return b.results, nil
+	}
+
+	out, err := s.runModelShared(withoutRequestLog(ctx), id, username, base)
+	if err != nil {
+		return nil, err
+	}
+	if out.Partial {
+		return nil, newModelError(ErrModelTimeout, "scenario baseline run was cut short")
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	for k, b := range s.scenarioBaselines {
+		if b.jarSHA256 != jar || len(s.scenarioBaselines) >= maxScenarioBaselines {
+			delete(s.scenarioBaselines, k)
+		}
+	}
+	s.scenarioBaselines[key] = scenarioBaseline{jarSHA256: jar, req: base, results: out.Results}
+	return out.Results, nil
+}
+
+// CacheFilter selects cached runs by their parameters; an omitted field
+// matches any value, so an empty filter matches every entry.
+type CacheFilter struct {
+	Scenario     *int     `json:"scenario"`
+	DrillingRate *int     `json:"drillingRate"`
+	OilPrice     *float64 `json:"oilPrice"`
+	ExchangeRate *float64 `json:"exchangeRate"`
+	Seed         *int64   `json:"seed"`
+	Project      *string  `json:"project"`
+}
+
+func (f CacheFilter) matches(req ModelRequest) bool {
+	return (f.Scenario == nil || *f.Scenario == req.Scenario) &&
+		(f.DrillingRate == nil || *f.DrillingRate == req.DrillingRate) &&
+		(f.OilPrice == nil || *f.OilPrice == req.OilPrice) &&
+		(f.ExchangeRate == nil || *f.ExchangeRate == req.ExchangeRate) &&
+		(f.Seed == nil || req.Seed != nil && *f.Seed == *req.Seed) &&
+		(f.Project == nil || *f.Project == req.Project)
+}
+
+// invalidateCache drops the cached results, on disk too, and scenario
+// baselines that match f, whichever model.jar they came from, and returns
+// how many of each went. Runs in flight are not affected.
+func (s *Server) invalidateCache(f CacheFilter) (results, disk, baselines int) {
+	if s.config().DiskCacheDir != "" {
+		disk = s.invalidateDiskCache(f)
+	}
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	for k, c := range s.resultCache {
+		if f.matches(c.req) {
+			delete(s.resultCache, k)
+			results++
+		}
+	}
+	for k, b := range s.scenarioBaselines {
+		if f.matches(b.req) {
+			delete(s.scenarioBaselines, k)
+			baselines++
+		}
+	}
+	return results, disk, baselines
+}
+
+// handleCacheInvalidate is POST /api/admin/cache/invalidate. A body-less
+// request, like an empty filter, clears the whole cache.
+func (s *Server) handleCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var f CacheFilter
+	if r.ContentLength != 0 {
+		// A misspelled field would otherwise widen the filter to everything.
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&f); err != nil {
+			s.sendError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, disk, baselines := s.invalidateCache(f)
+	log.Printf("[%s] Cache invalidated: %d results, %d on disk, %d scenario baselines", r.Header.Get("X-Username"), results, disk, baselines)
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Cache entries removed",
+		Data: map[string]interface{}{
+			"removed":           results + disk + baselines,
+			"results":           results,
+			"diskResults":       disk,
+			"scenarioBaselines": baselines,
+		},
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// ==================== Output charset ====================
+
+// hexSampleBytes is how much of an undecodable line is logged.
+const hexSampleBytes = 32
+
+// outputEncoding resolves MODEL_OUTPUT_CHARSET. An empty name means the
+// output must already be UTF-8 and returns a nil encoding.
+func outputEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported MODEL_OUTPUT_CHARSET %q", name)
+	}
+	return enc, nil
+}
+
+// outputDecoder turns model output into UTF-8 line by line. Lines that are
+// valid UTF-8 pass through untouched; others are decoded from the
+// configured charset, if any.
+type outputDecoder struct {
+	enc encoding.Encoding
+}
+
+// decodeLine returns line as UTF-8. lineNo is 1-based and only used in
+// the error, which is meant for the client; the offending bytes go to the
+// log as hex.
+func (d outputDecoder) decodeLine(line []byte, lineNo int) ([]byte, error) {
+	if utf8.Valid(line) {
+		if i := binaryOffset(line); i >= 0 {
+			logHexSample(line, i, lineNo)
+			return nil, fmt.Errorf("Model output contains binary data (line %d)", lineNo)
+		}
+		return line, nil
+	}
+
+	if d.enc == nil {
+		logHexSample(line, invalidUTF8Offset(line), lineNo)
+		return nil, fmt.Errorf("Model output is not valid UTF-8 (line %d); set MODEL_OUTPUT_CHARSET if ModelRunner writes another encoding", lineNo)
+	}
+
+	decoded, err := d.enc.NewDecoder().Bytes(line)
+	if err == nil && utf8.Valid(decoded) && binaryOffset(decoded) < 0 {
+		return decoded, nil
+	}
+	logHexSample(line, invalidUTF8Offset(line), lineNo)
+	return nil, fmt.Errorf("Model output could not be decoded (line %d)", lineNo)
+}
+
+// decodeAll applies decodeLine to every line of out.
+func (d outputDecoder) decodeAll(out []byte) ([]byte, error) {
+	if utf8.Valid(out) && binaryOffset(out) < 0 {
+		return out, nil
+	}
+	lines := bytes.SplitAfter(out, []byte("\n"))
+	var buf bytes.Buffer
+	buf.Grow(len(out))
+	for i, line := range lines {
+		content := bytes.TrimSuffix(line, []byte("\n"))
+		decoded, err := d.decodeLine(content, i+1)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(decoded)
+		if len(content) < len(line) {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// binaryOffset returns the index of the first control character other
+// than tab and CR, or -1. CSV text never contains them.
+func binaryOffset(b []byte) int {
+	for i, c := range b {
+		if (c < 0x20 && c != '\t' && c != '\r' && c != '\n') || c == 0x7f {
+			return i
+		}
+	}
+	return -1
+}
+
+func invalidUTF8Offset(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return i
+		}
+		i += size
+	}
+	return 0
+}
+
+func logHexSample(line []byte, offset, lineNo int) {
+	end := offset + hexSampleBytes
+	if end > len(line) {
+		end = len(line)
+	}
+	log.Printf("Undecodable model output at line %d, byte %d: %s",
+		lineNo, offset, hex.EncodeToString(line[offset:end]))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// latin1Output is ModelRunner output with a Latin-1 "é" (0xe9) in a
+// diagnostic line.
+var latin1Output = []byte("#LOG r\xe9sultat\n0,1,100,10,2,40\n")
+
+func TestDecodeLatin1Output(t *testing.T) {
+	enc, err := outputEncoding("ISO-8859-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := outputDecoder{enc: enc}.decodeAll(latin1Output)
+	if err != nil {
+		t.Fatalf("decodeAll: %v", err)
+	}
+	if want := "#LOG résultat\n0,1,100,10,2,40\n"; string(out) != want {
+		t.Errorf("decodeAll = %q, want %q", out, want)
+	}
+}
+
+func TestDecodeUndecodableOutput(t *testing.T) {
+	logged := captureLog(t)
+	tests := []struct {
+		name   string
+		enc    string
+		output string
+		err    string
+	}{
+		{"latin-1 without a charset", "", string(latin1Output), "not valid UTF-8 (line 1)"},
+		{"binary data", "", "0,1,100,10,2,40\n\x00\x01\x02\n", "binary data (line 2)"},
+		{"binary after decoding", "ISO-8859-1", "\xe9\x00\n", "could not be decoded (line 1)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := outputEncoding(tt.enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = outputDecoder{enc: enc}.decodeAll([]byte(tt.output))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("decodeAll error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+	if !strings.Contains(logged.String(), "e9") {
+		t.Errorf("log %q has no hex sample of the bad byte", logged)
+	}
+}
+
+func TestUTF8OutputPassesThrough(t *testing.T) {
+	in := []byte("#LOG нефть\n0,1,100,10,2,40\n")
+	out, err := outputDecoder{}.decodeAll(in)
+	if err != nil || string(out) != string(in) {
+		t.Errorf("decodeAll = %q, %v; want the input unchanged", out, err)
+	}
+}
+
+func TestOutputEncodingUnknown(t *testing.T) {
+	if _, err := outputEncoding("klingon-8"); err == nil {
+		t.Error("outputEncoding accepted an unknown charset")
+	}
+}
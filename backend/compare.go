@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ==================== Compare ====================
+
+// CompareRequest runs the same parameters under several scenarios. An empty
+// Scenarios list means every known scenario.
+type CompareRequest struct {
+	Scenarios    []int   `json:"scenarios"`
+	DrillingRate int     `json:"drillingRate"`
+	OilPrice     float64 `json:"oilPrice"`
+	ExchangeRate float64 `json:"exchangeRate"`
+	// OilPriceCurrency applies to every scenario, as on ModelRequest.
+	OilPriceCurrency string `json:"oilPriceCurrency,omitempty"`
+}
+
+// UnmarshalJSON reads the parameters as leniently as ModelRequest does.
+func (req *CompareRequest) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Scenarios    []int           `json:"scenarios"`
+		DrillingRate json.RawMessage `json:"drillingRate"`
+		OilPrice     json.RawMessage `json:"oilPrice"`
+		ExchangeRate json.RawMessage `json:"exchangeRate"`
+		Currency     string          `json:"oilPriceCurrency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return objectError(err)
+	}
+	out := CompareRequest{Scenarios: raw.Scenarios, OilPriceCurrency: raw.Currency}
+	for _, err := range []error{
+		lenientInt("drillingRate", raw.DrillingRate, &out.DrillingRate),
+		lenientFloat("oilPrice", raw.OilPrice, &out.OilPrice),
+		lenientFloat("exchangeRate", raw.ExchangeRate, &out.ExchangeRate),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	*req = out
+	return nil
+}
+
+// pivotByYear reshapes per-scenario results into year -> scenario -> row,
+// the layout charting libraries want. A scenario with no row for a year
+// that another scenario has gets a nil (JSON null) entry.
+func pivotByYear(byScenario map[int][]SimulationResult) map[string]map[string]*SimulationResult {
+	years := make(map[float64]bool)
+	for _, results := range byScenario {
+		for _, r := range results {
+			years[r.Year] = true
+		}
+	}
+
+	pivot := make(map[string]map[string]*SimulationResult, len(years))
+	for year := range years {
+		row := make(map[string]*SimulationResult, len(byScenario))
+		for id := range byScenario {
+			row[strconv.Itoa(id)] = nil
+		}
+		pivot[formatFloat(year)] = row
+	}
+	for id, results := range byScenario {
+		for i := range results {
+			r := &results[i]
+			pivot[formatFloat(r.Year)][strconv.Itoa(id)] = r
+		}
+	}
+	return pivot
+}
+
+// compareSortKeys are the ?sortBy= orders of a compare response.
+var compareSortKeys = map[string]bool{"scenario": true, "revenue": true}
+
+// compareOrder lists the scenarios of byScenario in response order: by id,
+// or with sortBy "revenue" by total revenue, highest first, ties by id.
+func compareOrder(byScenario map[int][]SimulationResult, sortBy string) []int {
+	order := make([]int, 0, len(byScenario))
+	totals := make(map[int]float64, len(byScenario))
+	for id, results := range byScenario {
+		order = append(order, id)
+		for _, r := range results {
+			totals[id] += r.Revenue
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if sortBy == "revenue" && totals[a] != totals[b] {
+			return totals[a] > totals[b]
+		}
+		return a < b
+	})
+	return order
+}
+
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w, r) {
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	project, err := s.requestProject(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sortBy")
+	if sortBy == "" {
+		sortBy = "scenario"
+	}
+	if !compareSortKeys[sortBy] {
+		s.sendError(w, r, fmt.Sprintf("Unsupported sortBy %q (use scenario or revenue)", sortBy), http.StatusBadRequest)
+		return
+	}
+
+	var req CompareRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if len(req.Scenarios) == 0 {
+		for _, sc := range s.currentScenarios() {
+			req.Scenarios = append(req.Scenarios, sc.ID)
+		}
+	}
+
+	runs := make([]ModelRequest, 0, len(req.Scenarios))
+	seen := make(map[int]bool, len(req.Scenarios))
+	for _, id := range req.Scenarios {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		mr := ModelRequest{Scenario: id, DrillingRate: req.DrillingRate, OilPrice: req.OilPrice, ExchangeRate: req.ExchangeRate,
+			OilPriceCurrency: req.OilPriceCurrency, Project: project}
+		if err := s.validateModelRequest(&mr); err != nil {
+			s.sendError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		runs = append(runs, mr)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Scenario < runs[j].Scenario })
+
+	// Scenarios run side by side; each one goes through the same cache and
+	// coalescing as /api/run-model.
+	outs := make([]ModelOutput, len(runs))
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, mr := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fmt.Sprintf("%s/%d", requestID(r), mr.Scenario)
+			outs[i], errs[i] = s.runModelShared(r.Context(), id, username, mr)
+		}()
+	}
+	wg.Wait()
+
+	if r.Context().Err() != nil {
+		return
+	}
+	for i, err := range errs {
+		if err != nil {
+			status, code := modelErrorStatus(err)
+			s.sendErrorCode(w, r, fmt.Sprintf("Scenario %d: %v", runs[i].Scenario, err), code, status)
+			return
+		}
+	}
+
+	byScenario := make(map[int][]SimulationResult, len(runs))
+	modelLogs := make(map[int][]string)
+	partial := false
+	for i, mr := range runs {
+		byScenario[mr.Scenario] = outs[i].Results
+		if len(outs[i].Logs) > 0 {
+			modelLogs[mr.Scenario] = outs[i].Logs
+		}
+		partial = partial || outs[i].Partial
+	}
+
+	// JSON objects have no order, so "order" carries it; "parameters"
+	// follows it too.
+	order := compareOrder(byScenario, sortBy)
+	rank := make(map[int]int, len(order))
+	for i, id := range order {
+		rank[id] = i
+	}
+	sort.Slice(runs, func(i, j int) bool { return rank[runs[i].Scenario] < rank[runs[j].Scenario] })
+
+	data := map[string]interface{}{
+		"parameters": runs,
+		"scenarios":  byScenario,
+		"order":      order,
+		"sortBy":     sortBy,
+		"timestamp":  time.Now().Unix(),
+	}
+	if len(modelLogs) > 0 {
+		data["modelLogs"] = modelLogs
+	}
+	if r.URL.Query().Get("cumulative") == "true" {
+		cumulative := make(map[int][]CumulativeResult, len(byScenario))
+		for id, results := range byScenario {
+			cumulative[id] = cumulativeResults(results)
+		}
+		data["scenarios"] = cumulative
+	}
+	if r.URL.Query().Get("pivot") == "true" {
+		data["byYear"] = pivotByYear(byScenario)
+	}
+
+	status := http.StatusOK
+	message := "Comparison completed"
+	if partial {
+		data["partial"] = true
+		status = http.StatusPartialContent
+		message = "Comparison cut short, returning partial results"
+	}
+
+	s.writeJSON(w, r, status, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPivotByYearFillsGaps(t *testing.T) {
+	byScenario := map[int][]SimulationResult{
+		1: {{Year: 2025, Scenario: 1, Revenue: 10}, {Year: 2026, Scenario: 1, Revenue: 11}},
+		2: {{Year: 2026, Scenario: 2, Revenue: 20}, {Year: 2027, Scenario: 2, Revenue: 21}},
+	}
+	pivot := pivotByYear(byScenario)
+
+	if len(pivot) != 3 {
+		t.Fatalf("got years %v, want 2025, 2026 and 2027", reflect.ValueOf(pivot).MapKeys())
+	}
+	tests := []struct {
+		year, scenario string
+		revenue        float64 // 0 means a gap
+	}{
+		{"2025", "1", 10},
+		{"2025", "2", 0},
+		{"2026", "1", 11},
+		{"2026", "2", 20},
+		{"2027", "1", 0},
+		{"2027", "2", 21},
+	}
+	for _, tt := range tests {
+		row, ok := pivot[tt.year][tt.scenario]
+		switch {
+		case !ok:
+			t.Errorf("%s/%s: missing, want an entry", tt.year, tt.scenario)
+		case tt.revenue == 0 && row != nil:
+			t.Errorf("%s/%s = %+v, want null", tt.year, tt.scenario, row)
+		case tt.revenue != 0 && (row == nil || row.Revenue != tt.revenue):
+			t.Errorf("%s/%s = %+v, want revenue %v", tt.year, tt.scenario, row, tt.revenue)
+		}
+	}
+}
+
+func TestCompareOrder(t *testing.T) {
+	byScenario := map[int][]SimulationResult{
+		2:  {{Revenue: 50}, {Revenue: 50}},
+		10: {{Revenue: 300}},
+		3:  {{Revenue: 100}},
+		1:  {{Revenue: 10}},
+	}
+	tests := []struct {
+		sortBy string
+		want   []int
+	}{
+		{"scenario", []int{1, 2, 3, 10}},
+		{"revenue", []int{10, 2, 3, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sortBy, func(t *testing.T) {
+			if got := compareOrder(byScenario, tt.sortBy); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compareOrder(%s) = %v, want %v", tt.sortBy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareResponseOrder(t *testing.T) {
+	revenue := map[int]float64{1: 5, 2: 30, 3: 10, 10: 20}
+	runner := &fakeRunner{run: func(_ context.Context, req ModelRequest) (ModelOutput, error) {
+		return ModelOutput{Results: []SimulationResult{{Year: 0, Scenario: req.Scenario, Revenue: revenue[req.Scenario]}}}, nil
+	}}
+	s := newTestServer(t, runner, nil)
+	// Scenario 10 sorts before 2 as a JSON object key, so the map can't
+	// be what orders the response.
+	s.scenariosMu.Lock()
+	s.scenarios = append(append([]Scenario(nil), builtinScenarios...), Scenario{ID: 10, Name: "Ten", DrillingRate: 50, OilPrice: 80, ExchangeRate: 75})
+	s.scenariosMu.Unlock()
+	h := s.routes(t.TempDir())
+	token := s.login("user")
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 2, 3, 10}},
+		{"?sortBy=scenario", []int{1, 2, 3, 10}},
+		{"?sortBy=revenue", []int{2, 10, 3, 1}},
+	}
+	for _, tt := range tests {
+		rec := serve(t, h, "POST", "/api/compare"+tt.query, token, CompareRequest{Scenarios: []int{10, 3, 2, 1, 2}})
+		var data struct {
+			Order      []int          `json:"order"`
+			Parameters []ModelRequest `json:"parameters"`
+		}
+		decodeResponse(t, rec, &data)
+		if rec.Code != http.StatusOK || !reflect.DeepEqual(data.Order, tt.want) {
+			t.Errorf("compare%s: status %d, order %v, want %v", tt.query, rec.Code, data.Order, tt.want)
+			continue
+		}
+		var params []int
+		for _, p := range data.Parameters {
+			params = append(params, p.Scenario)
+		}
+		if !reflect.DeepEqual(params, tt.want) {
+			t.Errorf("compare%s: parameters in order %v, want %v", tt.query, params, tt.want)
+		}
+	}
+
+	if rec := serve(t, h, "POST", "/api/compare?sortBy=npv", token, CompareRequest{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unsupported sortBy: status %d, want 400", rec.Code)
+	}
+}
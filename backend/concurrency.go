@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ==================== Endpoint concurrency ====================
+
+// defaultEndpointLimit caps the requests in flight on each endpoint that
+// ENDPOINT_CONCURRENCY doesn't name. It is there to stop a runaway client,
+// not to shape normal traffic.
+const defaultEndpointLimit = 256
+
+// defaultEndpointLimits are the database-heavy endpoints, which get far
+// less room than the rest. ENDPOINT_CONCURRENCY overrides them one by one.
+var defaultEndpointLimits = map[string]int{
+	"/api/stats/result-sizes": 4,
+	"/api/report":             4,
+	"/api/history/curves":     8,
+	"/api/export":             8,
+}
+
+// parseEndpointLimits reads ENDPOINT_CONCURRENCY entries of the form
+// pattern=N, the pattern as registered in routes. 0 lifts the limit.
+func parseEndpointLimits(items []string) (map[string]int, error) {
+	limits := make(map[string]int, len(defaultEndpointLimits)+len(items))
+	for pattern, n := range defaultEndpointLimits {
+		limits[pattern] = n
+	}
+	for _, item := range items {
+		pattern, value, ok := strings.Cut(item, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("ENDPOINT_CONCURRENCY: want pattern=N, got %q", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ENDPOINT_CONCURRENCY: limit for %s must be a whole number, 0 or more, got %q", pattern, value)
+		}
+		limits[pattern] = n
+	}
+	return limits, nil
+}
+
+// endpointLimit is how many requests may be in flight on pattern; 0 is no
+// limit.
+func (c Config) endpointLimit(pattern string) int {
+	if n, ok := c.EndpointLimits[pattern]; ok {
+		return n
+	}
+	return c.EndpointLimitDefault
+}
+
+// endpointGate counts the requests in flight per route pattern.
+type endpointGate struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newEndpointGate() *endpointGate {
+	return &endpointGate{inFlight: make(map[string]int)}
+}
+
+// enter admits a request on pattern unless limit are already in flight.
+func (g *endpointGate) enter(pattern string, limit int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if limit > 0 && g.inFlight[pattern] >= limit {
+		return false
+	}
+	g.inFlight[pattern]++
+	return true
+}
+
+func (g *endpointGate) leave(pattern string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight[pattern]--
+}
+
+// snapshot is the in-flight count of every pattern seen so far.
+func (g *endpointGate) snapshot() map[string]float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[string]float64, len(g.inFlight))
+	for pattern, n := range g.inFlight {
+		out[pattern] = float64(n)
+	}
+	return out
+}
+
+// limitConcurrency answers 429 once pattern has its ENDPOINT_CONCURRENCY
+// limit of requests in flight. The limit is read per request, so a reload
+// applies to the next one.
+func (s *Server) limitConcurrency(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.config().endpointLimit(pattern)
+		if !s.endpoints.enter(pattern, limit) {
+			s.metrics.inc(s.metrics.endpointRejects, pattern)
+			w.Header().Set("Retry-After", "1")
+			s.sendErrorCode(w, r, fmt.Sprintf("Too many concurrent requests to %s (at most %d), try again shortly", pattern, limit),
+				"endpoint_busy", http.StatusTooManyRequests)
+			return
+		}
+		defer s.endpoints.leave(pattern)
+		h(w, r)
+	}
+}
+
+// checkEndpointLimits logs ENDPOINT_CONCURRENCY patterns that match no
+// route, which would otherwise limit nothing without a word.
+func (s *Server) checkEndpointLimits(patterns []string) {
+	registered := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		registered[p] = true
+	}
+	var unknown []string
+	for p := range s.config().EndpointLimits {
+		if !registered[p] {
+			unknown = append(unknown, p)
+		}
+	}
+	sort.Strings(unknown)
+	for _, p := range unknown {
+		log.Printf("WARNING: ENDPOINT_CONCURRENCY names %s, which is not a route", p)
+	}
+}
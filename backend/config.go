@@ -0,0 +1,767 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== Config ====================
+
+const (
+	outputModeStdout = "stdout"
+	outputModeFile   = "file"
+
+	envDev  = "dev"
+	envProd = "prod"
+
+	csvHeaderAuto = "auto"
+	csvHeaderOn   = "on"
+	csvHeaderOff  = "off"
+
+	csvMappingAuto     = "auto"
+	csvMappingPosition = "position"
+)
+
+// liveConfig holds the active Config. A reload swaps it as a whole, so
+// readers never see a half-updated one.
+type liveConfig struct {
+	v atomic.Value
+}
+
+func newLiveConfig(cfg Config) *liveConfig {
+	c := &liveConfig{}
+	c.v.Store(cfg)
+	return c
+}
+
+func (c *liveConfig) Load() Config {
+	return c.v.Load().(Config)
+}
+
+func (c *liveConfig) Store(cfg Config) {
+	c.v.Store(cfg)
+}
+
+// Config holds server settings resolved from environment variables.
+type Config struct {
+	// AppEnv is "dev" or "prod". Prod never seeds the demo accounts.
+	AppEnv string
+
+	// VerboseErrors sends internal error details to clients; on by
+	// default in dev only.
+	VerboseErrors bool
+
+	// CORSOrigins are the browser origins allowed to call the API, "*"
+	// for any. Defaults to "*" in dev and none in prod.
+	CORSOrigins []string
+
+	// StaticExtensions are the file extensions handleStatic serves,
+	// lowercase and without the dot. Anything else is a 404.
+	StaticExtensions []string
+
+	// AdminUser/AdminPassword seed the initial admin account.
+	AdminUser     string
+	AdminPassword string
+
+	DatabaseURL string
+
+	// ProjectHeader names the request header that tags a run with a
+	// project or tenant ID.
+	ProjectHeader string
+
+	// LogFile, when set, receives a copy of the server log, which admins
+	// can then read through /api/admin/logs.
+	LogFile string
+
+	// LogThrottleWindow is how long a repeated error message is counted
+	// instead of logged; 0 logs every occurrence.
+	LogThrottleWindow time.Duration
+
+	// LogQueueSize is how many request_logs rows may wait for the
+	// background writer, which inserts up to LogBatchSize at a time. 0
+	// writes each row inline.
+	LogQueueSize int
+	LogBatchSize int
+	// RequestLogSpool is a file request_logs rows go to while the database
+	// is down, to be replayed once it is back; "" drops them.
+	RequestLogSpool string
+
+	// ShutdownTimeout is how long SIGINT/SIGTERM waits for requests in
+	// flight, and then again for queued request logs.
+	ShutdownTimeout time.Duration
+
+	// DBHealthInterval is how often the database is pinged, and the
+	// handle reopened if the ping fails. 0 turns the check off.
+	DBHealthInterval time.Duration
+	// DatabaseReplicaURL, when set, serves history and stats reads.
+	DatabaseReplicaURL string
+
+	// ModelDir holds model.jar, its lib/ folder and ModelRunner.class.
+	ModelDir string
+
+	// ModelCmd is the executable that runs the model, looked up on PATH
+	// or, for a relative path, under ModelDir. ModelCmdArgs come before
+	// ModelArgs and may use {classpath} and {modelDir}.
+	ModelCmd     string
+	ModelCmdArgs []string
+	// ModelFallbacks are tried in order when ModelCmd fails; each is a
+	// command and its arguments, with the same placeholders.
+	ModelFallbacks []ModelBackend
+
+	// ModelArgs is the ModelRunner argument template, one entry per
+	// argument, with {field} placeholders filled from the request.
+	ModelArgs []string
+
+	// ModelOutputMode selects how ModelRunner hands back its CSV:
+	// "stdout" reads the process output, "file" passes a temp file path
+	// as an extra argument and reads that file once the run completes.
+	ModelOutputMode string
+
+	// ModelOutputCharset is the encoding ModelRunner writes when it is not
+	// UTF-8, e.g. "ISO-8859-1" or "windows-1251". Only lines that are not
+	// valid UTF-8 are decoded with it. Empty means UTF-8 only.
+	ModelOutputCharset string
+
+	// ModelMaxLineBytes is the longest stdout line ModelRunner may write;
+	// a longer one fails the run.
+	ModelMaxLineBytes int
+
+	// ModelTimeout bounds a single model run; 0 disables it. In stdout
+	// mode rows read before the deadline are returned as a partial result.
+	ModelTimeout time.Duration
+
+	// MaxConcurrentRuns caps how many model runs execute at once; 0 is no
+	// limit. Runs beyond it wait up to QueueWaitTimeout for a slot.
+	MaxConcurrentRuns int
+	QueueWaitTimeout  time.Duration
+
+	// ModelWarmup runs warmModel in the background at startup.
+	ModelWarmup bool
+
+	// SlowRunThreshold logs a warning and counts a slow run whenever a
+	// model run takes longer; 0 disables it.
+	SlowRunThreshold time.Duration
+
+	// CSVHeader says whether the first CSV row is a header: "auto" skips it
+	// only when its first field isn't numeric, "on"/"off" force the choice.
+	CSVHeader string
+
+	// CSVMapping says how columns map to result fields: "auto" goes by
+	// header name when the header names every field, and by position
+	// otherwise; "position" always uses ModelRunner's column order.
+	CSVMapping string
+
+	// DedupeResults drops result rows repeating an earlier row's year and
+	// scenario. Duplicates are logged either way.
+	DedupeResults bool
+
+	// ModelLogPrefix marks output lines that are model diagnostics rather
+	// than CSV; "" (MODEL_LOG_PREFIX=off) treats every line as CSV.
+	ModelLogPrefix string
+
+	// RawOutputMaxBytes caps the rawCsv field returned with include=raw.
+	RawOutputMaxBytes int
+	// StoreRawOutput keeps each successful run's output, up to
+	// RawOutputMaxBytes, in request_logs for /api/history/{id}/reparse.
+	StoreRawOutput bool
+
+	SecurityHeaders SecurityHeaders
+
+	// AnonymizeUsernames stores an HMAC of the username, keyed with
+	// UsernameSalt, in request_logs instead of the name itself.
+	AnonymizeUsernames bool
+	UsernameSalt       string
+
+	// SessionTTL is how long a login token stays valid. Logins with
+	// ?refresh=true instead get an AccessTokenTTL access token and a
+	// RefreshTokenTTL refresh token.
+	SessionTTL      time.Duration
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// AdminUsers may call the admin-only endpoints.
+	AdminUsers []string
+
+	PasswordPolicy PasswordPolicy
+
+	// ResultCacheTTL keeps successful /api/run-model results for reuse by
+	// identical requests; 0 disables the cache.
+	ResultCacheTTL time.Duration
+
+	// DiskCacheDir, when set, also keeps complete results on disk so they
+	// survive a restart: for DiskCacheTTL, and at most DiskCacheMaxBytes
+	// in all (0 for no limit), oldest dropped first.
+	DiskCacheDir      string
+	DiskCacheTTL      time.Duration
+	DiskCacheMaxBytes int
+
+	// ResponseEnvelope wraps successful responses in {success, message,
+	// data}; when off only data is sent.
+	ResponseEnvelope bool
+
+	// StrictJSON rejects request bodies with fields the endpoint doesn't
+	// know, so a typo doesn't go unnoticed.
+	StrictJSON bool
+
+	// MaxResponseBytes caps a serialized JSON response; larger ones get
+	// 413 instead. 0 disables the cap.
+	MaxResponseBytes int
+
+	// MaxBodyBytes caps a JSON request body; MaxImportBodyBytes replaces
+	// it for /api/history/import. 0 disables a cap.
+	MaxBodyBytes       int
+	MaxImportBodyBytes int
+
+	// CallbackAllowedHosts are the hosts a job's callbackUrl may point
+	// at. Empty rejects every callback.
+	CallbackAllowedHosts []string
+
+	// JobRetention is how long a finished job stays readable through
+	// /api/jobs/{id} before it is dropped.
+	JobRetention time.Duration
+
+	// DiscountRate is the default annual rate for ?npv=true, as a
+	// fraction (0.1 = 10%).
+	DiscountRate float64
+
+	// SensitivityDelta is the default fractional step /api/sensitivity
+	// raises each parameter by.
+	SensitivityDelta float64
+
+	// ResultUnits is the unit of each result metric, reported with
+	// ?withUnits=true and in the OpenAPI spec.
+	ResultUnits map[string]string
+
+	// ParamRules bound run parameters for every scenario; ScenarioRules
+	// replace them, parameter by parameter, for one scenario.
+	ParamRules    ParamRules
+	ScenarioRules map[int]ParamRules
+
+	// ShareSecret signs /api/history/{id}/share links; when empty a random
+	// key is used and links stop working on restart. ShareTTL is the
+	// longest a link may live.
+	ShareSecret string
+	ShareTTL    time.Duration
+
+	// TimelineTTL is how long a /api/history/timeline.ics link works;
+	// TimelineMaxEvents caps the runs in the feed.
+	TimelineTTL       time.Duration
+	TimelineMaxEvents int
+
+	// ResultSizeBuckets are the histogram upper bounds for
+	// /api/stats/result-sizes.
+	ResultSizeBuckets []float64
+
+	// ReadTimeout bounds reading a whole request, headers and body;
+	// IdleTimeout closes keep-alive connections left unused. WriteTimeout
+	// runs from the end of the request read until the response is
+	// written, so it must outlast a model run; it defaults to
+	// ModelTimeout plus a minute, and to none when runs are unbounded.
+	// 0 disables any of them.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// EndpointLimits caps the requests in flight per route pattern;
+	// EndpointLimitDefault covers the patterns not listed. 0 is no limit.
+	EndpointLimits       map[string]int
+	EndpointLimitDefault int
+
+	// TLS, when it has a certificate, serves HTTPS instead of HTTP.
+	TLS TLSSettings
+}
+
+// PasswordPolicy is enforced on registration and password changes.
+// MaxLength of 0 means no upper bound.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// SecurityHeaders controls the hardening headers sent with the static
+// frontend. They are off by default since API-only deployments don't
+// serve any HTML.
+type SecurityHeaders struct {
+	Enabled               bool
+	FrameOptions          string
+	ContentSecurityPolicy string
+}
+
+var defaultStaticExtensions = []string{"html", "css", "js", "png", "svg", "woff"}
+
+const defaultDatabaseURL = "host=localhost port=5432 user=postgres password=postgres dbname=AnyLogicDB sslmode=disable"
+
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; " +
+	"img-src 'self' data:"
+
+func loadConfig(projectRoot string) (Config, error) {
+	env, err := readConfigFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		AppEnv:             env.String("APP_ENV", envDev),
+		AdminUser:          env.String("ADMIN_USER", ""),
+		AdminPassword:      env.raw("ADMIN_PASSWORD"),
+		ModelDir:           env.String("MODEL_DIR", filepath.Join(projectRoot, "model")),
+		DatabaseURL:        env.String("DATABASE_URL", defaultDatabaseURL),
+		DBHealthInterval:   env.Duration("DB_HEALTH_INTERVAL", 30*time.Second),
+		LogFile:            env.String("LOG_FILE", ""),
+		LogThrottleWindow:  env.Duration("LOG_THROTTLE_WINDOW", time.Minute),
+		LogQueueSize:       env.Int("LOG_QUEUE_SIZE", 1000),
+		LogBatchSize:       env.Int("LOG_BATCH_SIZE", 100),
+		RequestLogSpool:    env.String("REQUEST_LOG_SPOOL", ""),
+		ShutdownTimeout:    env.Duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		ProjectHeader:      env.String("PROJECT_HEADER", "X-Project-ID"),
+		DatabaseReplicaURL: env.String("DATABASE_REPLICA_URL", ""),
+		ModelCmd:           env.String("MODEL_CMD", "java"),
+		ModelCmdArgs:       strings.Fields(env.String("MODEL_CMD_ARGS", defaultModelCmdArgs)),
+		ModelFallbacks:     parseModelFallbacks(env.List("MODEL_FALLBACK_CMDS", nil)),
+		ModelArgs:          strings.Fields(env.String("MODEL_ARGS", defaultModelArgs)),
+		ModelOutputMode:    env.String("MODEL_OUTPUT_MODE", outputModeStdout),
+		ModelOutputCharset: env.String("MODEL_OUTPUT_CHARSET", ""),
+		ModelMaxLineBytes:  env.Int("MODEL_MAX_LINE_BYTES", 1<<20),
+		ModelTimeout:       env.Duration("MODEL_TIMEOUT", 5*time.Minute),
+		MaxConcurrentRuns:  env.Int("MAX_CONCURRENT_RUNS", 0),
+		QueueWaitTimeout:   env.Duration("QUEUE_WAIT_TIMEOUT", 30*time.Second),
+		ModelWarmup:        env.Bool("MODEL_WARMUP", false),
+		SlowRunThreshold:   time.Duration(env.Int("SLOW_RUN_MS", 0)) * time.Millisecond,
+		CSVHeader:          env.String("CSV_HEADER", csvHeaderAuto),
+		CSVMapping:         env.String("CSV_MAPPING", csvMappingAuto),
+		DedupeResults:      env.Bool("DEDUPE_RESULTS", false),
+		ModelLogPrefix:     env.String("MODEL_LOG_PREFIX", defaultModelLogPrefix),
+		RawOutputMaxBytes:  env.Int("RAW_OUTPUT_MAX_BYTES", 1<<20),
+		StoreRawOutput:     env.Bool("STORE_RAW_OUTPUT", false),
+		SecurityHeaders: SecurityHeaders{
+			Enabled:               env.Bool("SECURITY_HEADERS", false),
+			FrameOptions:          env.String("FRAME_OPTIONS", "DENY"),
+			ContentSecurityPolicy: env.String("CONTENT_SECURITY_POLICY", defaultCSP),
+		},
+		AnonymizeUsernames: env.Bool("ANONYMIZE_USERNAMES", false),
+		UsernameSalt:       env.String("USERNAME_SALT", ""),
+		SessionTTL:         env.Duration("SESSION_TTL", 24*time.Hour),
+		AccessTokenTTL:     env.Duration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:    env.Duration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		PasswordPolicy: PasswordPolicy{
+			MinLength:     env.Int("PASSWORD_MIN_LENGTH", 4),
+			MaxLength:     env.Int("PASSWORD_MAX_LENGTH", 72),
+			RequireDigit:  env.Bool("PASSWORD_REQUIRE_DIGIT", false),
+			RequireSymbol: env.Bool("PASSWORD_REQUIRE_SYMBOL", false),
+		},
+		ResultCacheTTL:       env.Duration("RESULT_CACHE_TTL", 0),
+		DiskCacheDir:         env.String("RESULT_CACHE_DIR", ""),
+		DiskCacheTTL:         env.Duration("RESULT_CACHE_DIR_TTL", 168*time.Hour),
+		DiskCacheMaxBytes:    env.Int("RESULT_CACHE_DIR_MAX_BYTES", 256<<20),
+		ResponseEnvelope:     env.Bool("RESPONSE_ENVELOPE", true),
+		StrictJSON:           env.Bool("STRICT_JSON", true),
+		MaxResponseBytes:     env.Int("MAX_RESPONSE_BYTES", 64<<20),
+		MaxBodyBytes:         env.Int("MAX_BODY_BYTES", 64<<10),
+		MaxImportBodyBytes:   env.Int("MAX_IMPORT_BODY_BYTES", 32<<20),
+		CallbackAllowedHosts: env.List("CALLBACK_ALLOWED_HOSTS", nil),
+		JobRetention:         env.Duration("JOB_RETENTION", time.Hour),
+		DiscountRate:         env.Float("DISCOUNT_RATE", 0.1),
+		SensitivityDelta:     env.Float("SENSITIVITY_DELTA", 0.1),
+		ShareSecret:          env.raw("SHARE_SECRET"),
+		ShareTTL:             env.Duration("SHARE_TTL", 7*24*time.Hour),
+		TimelineTTL:          env.Duration("TIMELINE_TTL", 90*24*time.Hour),
+		TimelineMaxEvents:    env.Int("TIMELINE_MAX_EVENTS", 200),
+		ReadTimeout:          env.Duration("HTTP_READ_TIMEOUT", 30*time.Second),
+		IdleTimeout:          env.Duration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		EndpointLimitDefault: env.Int("ENDPOINT_CONCURRENCY_DEFAULT", defaultEndpointLimit),
+	}
+
+	switch cfg.AppEnv {
+	case envDev, envProd:
+	default:
+		return cfg, fmt.Errorf("APP_ENV must be %q or %q, got %q", envDev, envProd, cfg.AppEnv)
+	}
+	cfg.VerboseErrors = env.Bool("VERBOSE_ERRORS", !cfg.isProd())
+	defaultOrigins := []string{"*"}
+	if cfg.isProd() {
+		defaultOrigins = nil
+	}
+	cfg.CORSOrigins = env.List("CORS_ORIGINS", defaultOrigins)
+	for _, ext := range env.List("STATIC_EXTENSIONS", defaultStaticExtensions) {
+		cfg.StaticExtensions = append(cfg.StaticExtensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+
+	// Only an admin that seedUsers actually creates is an admin by default,
+	// so no admin name is left without an account for someone to register.
+	var seededAdmins []string
+	if name, _ := cfg.seedAdmin(); name != "" {
+		seededAdmins = []string{name}
+	}
+	cfg.AdminUsers = env.List("ADMIN_USERS", seededAdmins)
+	for _, name := range seededAdmins {
+		if !containsString(cfg.AdminUsers, name) {
+			cfg.AdminUsers = append(cfg.AdminUsers, name)
+		}
+	}
+
+	switch cfg.ModelOutputMode {
+	case outputModeStdout, outputModeFile:
+	default:
+		return cfg, fmt.Errorf("MODEL_OUTPUT_MODE must be %q or %q, got %q",
+			outputModeStdout, outputModeFile, cfg.ModelOutputMode)
+	}
+
+	if _, err := outputEncoding(cfg.ModelOutputCharset); err != nil {
+		return cfg, err
+	}
+	if cfg.ModelMaxLineBytes < 1 {
+		return cfg, fmt.Errorf("MODEL_MAX_LINE_BYTES must be at least 1, got %d", cfg.ModelMaxLineBytes)
+	}
+
+	if cfg.AnonymizeUsernames && cfg.UsernameSalt == "" {
+		return cfg, fmt.Errorf("USERNAME_SALT is required when ANONYMIZE_USERNAMES is on")
+	}
+
+	if err := validateModelArgs("MODEL_ARGS", cfg.ModelArgs); err != nil {
+		return cfg, err
+	}
+	if len(cfg.ModelCmdArgs) == 1 && cfg.ModelCmdArgs[0] == "none" {
+		cfg.ModelCmdArgs = nil
+	}
+	if err := validateModelArgs("MODEL_CMD_ARGS", cfg.ModelCmdArgs); err != nil {
+		return cfg, err
+	}
+	if strings.ContainsRune(cfg.ModelCmd, filepath.Separator) && !filepath.IsAbs(cfg.ModelCmd) {
+		cfg.ModelCmd = filepath.Join(cfg.ModelDir, cfg.ModelCmd)
+	}
+	for i, b := range cfg.ModelFallbacks {
+		if err := validateModelArgs("MODEL_FALLBACK_CMDS", b.CmdArgs); err != nil {
+			return cfg, err
+		}
+		if strings.ContainsRune(b.Cmd, filepath.Separator) && !filepath.IsAbs(b.Cmd) {
+			cfg.ModelFallbacks[i].Cmd = filepath.Join(cfg.ModelDir, b.Cmd)
+		}
+	}
+	if cfg.ModelOutputMode == outputModeFile && !strings.Contains(strings.Join(cfg.ModelArgs, " "), "{output}") {
+		return cfg, fmt.Errorf("MODEL_ARGS must include {output} when MODEL_OUTPUT_MODE is %q", outputModeFile)
+	}
+
+	switch cfg.CSVHeader {
+	case csvHeaderAuto, csvHeaderOn, csvHeaderOff:
+	default:
+		return cfg, fmt.Errorf("CSV_HEADER must be %q, %q or %q, got %q",
+			csvHeaderAuto, csvHeaderOn, csvHeaderOff, cfg.CSVHeader)
+	}
+
+	switch cfg.CSVMapping {
+	case csvMappingAuto, csvMappingPosition:
+	default:
+		return cfg, fmt.Errorf("CSV_MAPPING must be %q or %q, got %q", csvMappingAuto, csvMappingPosition, cfg.CSVMapping)
+	}
+
+	if p := cfg.PasswordPolicy; p.MaxLength > bcryptMaxBytes {
+		return cfg, fmt.Errorf("PASSWORD_MAX_LENGTH must be at most %d, the bcrypt limit, got %d", bcryptMaxBytes, p.MaxLength)
+	}
+	if p := cfg.PasswordPolicy; p.MaxLength > 0 && p.MaxLength < p.MinLength {
+		return cfg, fmt.Errorf("PASSWORD_MAX_LENGTH (%d) is below PASSWORD_MIN_LENGTH (%d)", p.MaxLength, p.MinLength)
+	}
+
+	for i, h := range cfg.CallbackAllowedHosts {
+		cfg.CallbackAllowedHosts[i] = strings.ToLower(h)
+	}
+
+	var defaultWriteTimeout time.Duration
+	if cfg.ModelTimeout > 0 {
+		defaultWriteTimeout = cfg.longestRun() + time.Minute
+	}
+	cfg.WriteTimeout = env.Duration("HTTP_WRITE_TIMEOUT", defaultWriteTimeout)
+	if cfg.WriteTimeout > 0 && (cfg.ModelTimeout <= 0 || cfg.WriteTimeout <= cfg.longestRun()) {
+		return cfg, fmt.Errorf("HTTP_WRITE_TIMEOUT (%s) must be longer than MODEL_TIMEOUT plus any QUEUE_WAIT_TIMEOUT (%s), or 0", cfg.WriteTimeout, cfg.longestRun())
+	}
+
+	cfg.ResultSizeBuckets = defaultResultSizeBuckets
+	if items := env.List("RESULT_SIZE_BUCKETS", nil); items != nil {
+		if cfg.ResultSizeBuckets, err = parseBuckets(items); err != nil {
+			return cfg, fmt.Errorf("RESULT_SIZE_BUCKETS: %v", err)
+		}
+	}
+
+	if cfg.JobRetention <= 0 {
+		return cfg, fmt.Errorf("JOB_RETENTION must be positive, got %s", cfg.JobRetention)
+	}
+	if cfg.ShareTTL <= 0 {
+		return cfg, fmt.Errorf("SHARE_TTL must be positive, got %s", cfg.ShareTTL)
+	}
+	if cfg.TimelineTTL <= 0 {
+		return cfg, fmt.Errorf("TIMELINE_TTL must be positive, got %s", cfg.TimelineTTL)
+	}
+	if cfg.TimelineMaxEvents < 1 {
+		return cfg, fmt.Errorf("TIMELINE_MAX_EVENTS must be at least 1, got %d", cfg.TimelineMaxEvents)
+	}
+
+	if cfg.MaxConcurrentRuns < 0 {
+		return cfg, fmt.Errorf("MAX_CONCURRENT_RUNS must not be negative, got %d", cfg.MaxConcurrentRuns)
+	}
+	if cfg.QueueWaitTimeout < 0 {
+		return cfg, fmt.Errorf("QUEUE_WAIT_TIMEOUT must not be negative, got %s", cfg.QueueWaitTimeout)
+	}
+
+	if cfg.LogThrottleWindow < 0 {
+		return cfg, fmt.Errorf("LOG_THROTTLE_WINDOW must not be negative, got %s", cfg.LogThrottleWindow)
+	}
+
+	if cfg.LogQueueSize < 0 {
+		return cfg, fmt.Errorf("LOG_QUEUE_SIZE must not be negative, got %d", cfg.LogQueueSize)
+	}
+	if cfg.LogBatchSize < 1 || cfg.LogBatchSize > maxLogBatch {
+		return cfg, fmt.Errorf("LOG_BATCH_SIZE must be between 1 and %d, got %d", maxLogBatch, cfg.LogBatchSize)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return cfg, fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", cfg.ShutdownTimeout)
+	}
+
+	if cfg.DBHealthInterval < 0 {
+		return cfg, fmt.Errorf("DB_HEALTH_INTERVAL must not be negative, got %s", cfg.DBHealthInterval)
+	}
+
+	if cfg.ModelLogPrefix == "off" {
+		cfg.ModelLogPrefix = ""
+	}
+
+	if cfg.MaxResponseBytes < 0 {
+		return cfg, fmt.Errorf("MAX_RESPONSE_BYTES must not be negative, got %d", cfg.MaxResponseBytes)
+	}
+	if cfg.DiskCacheDir != "" && cfg.DiskCacheTTL <= 0 {
+		return cfg, fmt.Errorf("RESULT_CACHE_DIR_TTL must be positive, got %s", cfg.DiskCacheTTL)
+	}
+	if cfg.DiskCacheMaxBytes < 0 {
+		return cfg, fmt.Errorf("RESULT_CACHE_DIR_MAX_BYTES must not be negative, got %d", cfg.DiskCacheMaxBytes)
+	}
+	if cfg.MaxBodyBytes < 0 {
+		return cfg, fmt.Errorf("MAX_BODY_BYTES must not be negative, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.MaxImportBodyBytes < 0 {
+		return cfg, fmt.Errorf("MAX_IMPORT_BODY_BYTES must not be negative, got %d", cfg.MaxImportBodyBytes)
+	}
+
+	if cfg.DiscountRate <= -1 {
+		return cfg, fmt.Errorf("DISCOUNT_RATE must be greater than -1, got %v", cfg.DiscountRate)
+	}
+	if cfg.SensitivityDelta <= 0 || cfg.SensitivityDelta > 1 {
+		return cfg, fmt.Errorf("SENSITIVITY_DELTA must be greater than 0 and at most 1, got %v", cfg.SensitivityDelta)
+	}
+	units, err := parseResultUnits(env.List("RESULT_UNITS", nil))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ResultUnits = units
+	if cfg.ParamRules, cfg.ScenarioRules, err = parseParamRules(env.List("PARAM_RULES", nil)); err != nil {
+		return cfg, err
+	}
+	if cfg.EndpointLimits, err = parseEndpointLimits(env.List("ENDPOINT_CONCURRENCY", nil)); err != nil {
+		return cfg, err
+	}
+	if cfg.EndpointLimitDefault < 0 {
+		return cfg, fmt.Errorf("ENDPOINT_CONCURRENCY_DEFAULT must not be negative, got %d", cfg.EndpointLimitDefault)
+	}
+	if cfg.TLS, err = loadTLSSettings(env); err != nil {
+		return cfg, err
+	}
+	if env.err != nil {
+		return cfg, env.err
+	}
+
+	return cfg, nil
+}
+
+// longestRun is how long a request may spend on one model run: waiting
+// for a slot, when runs are limited, and then running.
+func (c Config) longestRun() time.Duration {
+	if c.MaxConcurrentRuns > 0 {
+		return c.QueueWaitTimeout + c.ModelTimeout
+	}
+	return c.ModelTimeout
+}
+
+// parseModelFallbacks reads MODEL_FALLBACK_CMDS entries: a command, then
+// its arguments separated by spaces.
+func parseModelFallbacks(entries []string) []ModelBackend {
+	var backends []ModelBackend
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		backends = append(backends, ModelBackend{Name: filepath.Base(fields[0]), Cmd: fields[0], CmdArgs: fields[1:]})
+	}
+	return backends
+}
+
+// usesModelJar reports whether the model command runs model.jar, as the
+// default java command does. Other commands don't need it.
+func (c Config) usesModelJar() bool {
+	return hasPlaceholder(c.ModelCmdArgs, "classpath")
+}
+
+func (c Config) isProd() bool {
+	return c.AppEnv == envProd
+}
+
+// seedAdmin is the admin account seedUsers creates: ADMIN_USER when it
+// comes with ADMIN_PASSWORD, else the demo admin outside prod, else none.
+func (c Config) seedAdmin() (username, password string) {
+	switch {
+	case c.AdminUser != "" && c.AdminPassword != "":
+		return c.AdminUser, c.AdminPassword
+	case !c.isProd():
+		return "admin", "admin123"
+	}
+	return "", ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// envSource resolves settings from the process environment, falling back
+// to the KEY=VALUE lines of CONFIG_FILE. Only the file can change while the
+// server runs, so it is what a SIGHUP reload picks up.
+type envSource struct {
+	file map[string]string
+	// err is the first value that didn't parse; the getters return their
+	// default for it, and loadConfig fails with it.
+	err error
+}
+
+// readConfigFile parses path, if set. Blank lines and lines starting with
+// # are skipped; values may be wrapped in double quotes.
+func readConfigFile(path string) (*envSource, error) {
+	env := &envSource{file: map[string]string{}}
+	if path == "" {
+		return env, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %v", err)
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("CONFIG_FILE %s line %d: expected KEY=VALUE", path, n+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = value[1 : len(value)-1]
+		}
+		env.file[strings.TrimSpace(key)] = value
+	}
+	return env, nil
+}
+
+// raw returns the value untrimmed, for secrets where spaces may matter.
+func (e *envSource) raw(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return e.file[key]
+}
+
+func (e *envSource) lookup(key string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return strings.TrimSpace(e.file[key])
+}
+
+// invalid records that key's value v isn't what, unless an earlier value
+// already failed.
+func (e *envSource) invalid(key, v, what string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("%s must be %s, got %q", key, what, v)
+	}
+}
+
+func (e *envSource) String(key, def string) string {
+	if v := e.lookup(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (e *envSource) Int(key string, def int) int {
+	v := e.lookup(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.invalid(key, v, "an integer")
+		return def
+	}
+	return n
+}
+
+func (e *envSource) Float(key string, def float64) float64 {
+	v := e.lookup(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.invalid(key, v, "a number")
+		return def
+	}
+	return f
+}
+
+func (e *envSource) Duration(key string, def time.Duration) time.Duration {
+	v := e.lookup(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.invalid(key, v, "a duration such as 30s or 2m")
+		return def
+	}
+	return d
+}
+
+func (e *envSource) Bool(key string, def bool) bool {
+	v := e.lookup(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.invalid(key, v, "true or false")
+		return def
+	}
+	return b
+}
+
+// List reads a comma-separated list, dropping empty entries.
+func (e *envSource) List(key string, def []string) []string {
+	v := e.lookup(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
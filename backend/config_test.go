@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWriteTimeoutMustOutlastModelRuns(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		wantErr bool
+	}{
+		{map[string]string{"MODEL_TIMEOUT": "5m"}, false},
+		{map[string]string{"MODEL_TIMEOUT": "5m", "HTTP_WRITE_TIMEOUT": "1m"}, true},
+		{map[string]string{"MODEL_TIMEOUT": "0"}, false},
+		{map[string]string{"MODEL_TIMEOUT": "0", "HTTP_WRITE_TIMEOUT": "10m"}, true},
+		{map[string]string{"MODEL_TIMEOUT": "5m", "HTTP_WRITE_TIMEOUT": "0"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.env), func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig(t.TempDir())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.WriteTimeout > 0 && cfg.WriteTimeout <= cfg.ModelTimeout {
+				t.Errorf("WriteTimeout %s doesn't outlast MODEL_TIMEOUT %s", cfg.WriteTimeout, cfg.ModelTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsMalformedValues(t *testing.T) {
+	tests := []struct{ key, value, err string }{
+		{"MODEL_TIMEOUT", "10 minutes", `MODEL_TIMEOUT must be a duration such as 30s or 2m, got "10 minutes"`},
+		{"DEDUPE_RESULTS", "yes", `DEDUPE_RESULTS must be true or false, got "yes"`},
+		{"MAX_CONCURRENT_RUNS", "four", `MAX_CONCURRENT_RUNS must be an integer, got "four"`},
+		{"DISCOUNT_RATE", "10%", `DISCOUNT_RATE must be a number, got "10%"`},
+		// Read after the rest of the config.
+		{"HTTP_WRITE_TIMEOUT", "soon", `HTTP_WRITE_TIMEOUT must be a duration such as 30s or 2m, got "soon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			if _, err := loadConfig(t.TempDir()); err == nil || err.Error() != tt.err {
+				t.Errorf("loadConfig error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
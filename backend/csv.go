@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ==================== CSV ====================
+
+// defaultModelLogPrefix marks a diagnostic line in ModelRunner's output.
+const defaultModelLogPrefix = "#LOG"
+
+// progressMarker starts a line on which ModelRunner reports how far along
+// it is, as a percentage: "#PROGRESS 42".
+const progressMarker = "#PROGRESS"
+
+// csvColumns holds the column index of each SimulationResult field, in
+// struct order: year, scenario, revenue, production volume, new wells
+// fund, old wells fund.
+type csvColumns [6]int
+
+// positionalColumns is ModelRunner's own column order.
+var positionalColumns = csvColumns{0, 1, 2, 3, 4, 5}
+
+// csvFieldNames maps normalized header names, including a few common
+// renamings, to their csvColumns slot.
+var csvFieldNames = map[string]int{
+	"year":             0,
+	"scenario":         1,
+	"revenue":          2,
+	"productionvolume": 3,
+	"production":       3,
+	"newwellsfund":     4,
+	"newwells":         4,
+	"oldwellsfund":     5,
+	"oldwells":         5,
+}
+
+// normalizeColumnName lowercases name and drops spaces, underscores and
+// dashes, so "New_Wells Fund" matches "newwellsfund".
+func normalizeColumnName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '_', '-':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(name)))
+}
+
+// headerColumns maps a header row by name. It only succeeds when every
+// field is found exactly once.
+func headerColumns(parts []string) (csvColumns, bool) {
+	var cols csvColumns
+	found := 0
+	seen := [len(cols)]bool{}
+	for i, name := range parts {
+		slot, ok := csvFieldNames[normalizeColumnName(name)]
+		if !ok {
+			continue
+		}
+		if seen[slot] {
+			return cols, false
+		}
+		seen[slot] = true
+		cols[slot] = i
+		found++
+	}
+	return cols, found == len(cols)
+}
+
+// csvParser turns ModelRunner CSV into results one line at a time, so rows
+// can be collected while the model is still running.
+type csvParser struct {
+	header    string // CSV_HEADER mode
+	mapping   string // CSV_MAPPING mode
+	logPrefix string // MODEL_LOG_PREFIX; "" when off
+	seenFirst bool
+	cols      *csvColumns // nil until a header maps by name
+	results   []SimulationResult
+	logs      []string // diagnostic lines, prefix removed
+	progress  *float64 // last progress marker, 0-100
+	// onProgress, if set, is called with each progress marker, and onRow
+	// with each result row and its index.
+	onProgress func(float64)
+	onRow      func(int, SimulationResult)
+}
+
+// newCSVParser reads CSV the way cfg describes.
+func newCSVParser(cfg Config) *csvParser {
+	return &csvParser{header: cfg.CSVHeader, mapping: cfg.CSVMapping, logPrefix: cfg.ModelLogPrefix}
+}
+
+func (p *csvParser) parseLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	// Diagnostics and progress may come before the header, so they don't
+	// count as the first row. A malformed progress line is dropped too.
+	if rest, ok := strings.CutPrefix(line, progressMarker); ok {
+		if pct, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(rest, "%")), 64); err == nil {
+			pct = math.Max(0, math.Min(100, pct))
+			p.progress = &pct
+			if p.onProgress != nil {
+				p.onProgress(pct)
+			}
+		}
+		return
+	}
+	if p.logPrefix != "" && strings.HasPrefix(line, p.logPrefix) {
+		p.logs = append(p.logs, strings.TrimSpace(strings.TrimPrefix(line, p.logPrefix)))
+		return
+	}
+
+	parts := strings.Split(line, ",")
+	if !p.seenFirst {
+		p.seenFirst = true
+		if isCSVHeader(parts, p.header) {
+			if p.mapping == csvMappingAuto {
+				if cols, ok := headerColumns(parts); ok {
+					p.cols = &cols
+				}
+			}
+			return
+		}
+	}
+
+	cols := positionalColumns
+	if p.cols != nil {
+		cols = *p.cols
+	}
+	for _, i := range cols {
+		if i >= len(parts) {
+			return
+		}
+	}
+
+	field := func(slot int) string { return strings.TrimSpace(parts[cols[slot]]) }
+	year, _ := strconv.ParseFloat(field(0), 64)
+	scenario, _ := strconv.Atoi(field(1))
+	revenue, _ := strconv.ParseFloat(field(2), 64)
+	production, _ := strconv.ParseFloat(field(3), 64)
+	newWells, _ := strconv.ParseFloat(field(4), 64)
+	oldWells, _ := strconv.ParseFloat(field(5), 64)
+
+	row := SimulationResult{
+		Year:             year,
+		Scenario:         scenario,
+		Revenue:          revenue,
+		ProductionVolume: production,
+		NewWellsFund:     newWells,
+		OldWellsFund:     oldWells,
+	}
+	if p.onRow != nil {
+		p.onRow(len(p.results), row)
+	}
+	p.results = append(p.results, row)
+}
+
+// dedupeResults counts the rows repeating an earlier row's year and
+// scenario and, with drop, removes them; the first of each is kept.
+func dedupeResults(results []SimulationResult, drop bool) ([]SimulationResult, int) {
+	type key struct {
+		year     float64
+		scenario int
+	}
+	seen := make(map[key]bool, len(results))
+	kept := results[:0:0]
+	dups := 0
+	for _, r := range results {
+		k := key{r.Year, r.Scenario}
+		if seen[k] {
+			dups++
+			if drop {
+				continue
+			}
+		}
+		seen[k] = true
+		kept = append(kept, r)
+	}
+	if !drop || dups == 0 {
+		return results, dups
+	}
+	return kept, dups
+}
+
+// parseCSVOutput parses a complete output; the parser holds its results,
+// diagnostic lines and last progress.
+func parseCSVOutput(output string, cfg Config) (*csvParser, error) {
+	p := newCSVParser(cfg)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		p.parseLine(scanner.Text())
+	}
+	return p, scanner.Err()
+}
+
+// isCSVHeader decides whether the first CSV row is a header. In auto mode a
+// row whose first field isn't a number is treated as one.
+func isCSVHeader(parts []string, mode string) bool {
+	switch mode {
+	case csvHeaderOn:
+		return true
+	case csvHeaderOff:
+		return false
+	}
+	_, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	return err != nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const csvRows = "0,1,100.5,10,2,40\n1,1,120,12,3,39\n"
+
+func parseTestCSV(t *testing.T, output string, set func(*Config)) *csvParser {
+	t.Helper()
+	cfg := Config{CSVHeader: csvHeaderAuto, CSVMapping: csvMappingAuto, ModelLogPrefix: defaultModelLogPrefix}
+	if set != nil {
+		set(&cfg)
+	}
+	p, err := parseCSVOutput(output, cfg)
+	if err != nil {
+		t.Fatalf("parseCSVOutput: %v", err)
+	}
+	return p
+}
+
+func TestParseCSVHeaderDetection(t *testing.T) {
+	header := "year,scenario,revenue,productionVolume,newWellsFund,oldWellsFund\n"
+	tests := []struct {
+		name   string
+		mode   string
+		output string
+		rows   int
+	}{
+		{"auto with header", csvHeaderAuto, header + csvRows, 2},
+		{"auto without header", csvHeaderAuto, csvRows, 2},
+		{"on skips the first row", csvHeaderOn, csvRows, 1},
+		{"off keeps a header row", csvHeaderOff, header + csvRows, 3},
+		{"empty", csvHeaderAuto, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseTestCSV(t, tt.output, func(cfg *Config) { cfg.CSVHeader = tt.mode })
+			if len(p.results) != tt.rows {
+				t.Fatalf("got %d rows, want %d: %+v", len(p.results), tt.rows, p.results)
+			}
+		})
+	}
+}
+
+func TestParseCSVWithoutHeaderKeepsFirstRow(t *testing.T) {
+	p := parseTestCSV(t, csvRows, nil)
+	want := SimulationResult{Year: 0, Scenario: 1, Revenue: 100.5, ProductionVolume: 10, NewWellsFund: 2, OldWellsFund: 40}
+	if len(p.results) == 0 || !reflect.DeepEqual(p.results[0], want) {
+		t.Errorf("first row = %+v, want %+v", p.results, want)
+	}
+}
+
+func TestParseCSVMapsColumnsByName(t *testing.T) {
+	want := []SimulationResult{{Year: 2025, Scenario: 2, Revenue: 100, ProductionVolume: 10, NewWellsFund: 3, OldWellsFund: 40}}
+	tests := []struct {
+		name    string
+		mapping string
+		output  string
+		want    []SimulationResult
+	}{
+		{"reordered", csvMappingAuto,
+			"revenue,year,oldWellsFund,scenario,newWellsFund,productionVolume\n100,2025,40,2,3,10\n", want},
+		{"renamed and cased", csvMappingAuto,
+			"Year,SCENARIO,Revenue,Production,New_Wells,old wells fund\n2025,2,100,10,3,40\n", want},
+		{"extra columns", csvMappingAuto,
+			"note,year,scenario,revenue,productionVolume,newWellsFund,oldWellsFund\nx,2025,2,100,10,3,40\n", want},
+		{"unknown header falls back to positions", csvMappingAuto,
+			"a,b,c,d,e,f\n2025,2,100,10,3,40\n", want},
+		{"duplicate name falls back to positions", csvMappingAuto,
+			"year,year,revenue,productionVolume,newWellsFund,oldWellsFund\n2025,2,100,10,3,40\n", want},
+		{"position ignores the header", csvMappingPosition,
+			"revenue,year,oldWellsFund,scenario,newWellsFund,productionVolume\n2025,2,100,10,3,40\n", want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseTestCSV(t, tt.output, func(cfg *Config) { cfg.CSVMapping = tt.mapping })
+			if !reflect.DeepEqual(p.results, tt.want) {
+				t.Errorf("results %+v, want %+v", p.results, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCSVRowMissingMappedColumn(t *testing.T) {
+	p := parseTestCSV(t, "note,year,scenario,revenue,productionVolume,newWellsFund,oldWellsFund\nx,2025,2,100\n", nil)
+	if len(p.results) != 0 {
+		t.Errorf("a short row gave %+v, want it skipped", p.results)
+	}
+}
+
+func TestParseCSVCollectsLogLines(t *testing.T) {
+	output := "#LOG starting\n" +
+		"year,scenario,revenue,productionVolume,newWellsFund,oldWellsFund\n" +
+		"0,1,100,10,2,40\n" +
+		"#LOG   well 7 shut in  \n" +
+		"#PROGRESS 50\n" +
+		"1,1,120,12,3,39\n"
+	p := parseTestCSV(t, output, nil)
+	if len(p.results) != 2 {
+		t.Errorf("got %d rows, want 2: %+v", len(p.results), p.results)
+	}
+	if want := []string{"starting", "well 7 shut in"}; !reflect.DeepEqual(p.logs, want) {
+		t.Errorf("logs %q, want %q", p.logs, want)
+	}
+	if p.progress == nil || *p.progress != 50 {
+		t.Errorf("progress %v, want 50", p.progress)
+	}
+}
+
+func TestParseCSVLogPrefix(t *testing.T) {
+	output := "%% note\n0,1,100,10,2,40\n"
+	tests := []struct {
+		name   string
+		prefix string
+		logs   []string
+	}{
+		{"custom prefix", "%%", []string{"note"}},
+		{"off", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseTestCSV(t, output, func(cfg *Config) { cfg.ModelLogPrefix = tt.prefix })
+			if !reflect.DeepEqual(p.logs, tt.logs) {
+				t.Errorf("logs %q, want %q", p.logs, tt.logs)
+			}
+			// With the prefix off the line is the header.
+			if len(p.results) != 1 {
+				t.Errorf("got %d rows, want 1", len(p.results))
+			}
+		})
+	}
+}
+
+func TestRunModelReturnsModelLogs(t *testing.T) {
+	runner := &fakeRunner{run: func(_ context.Context, req ModelRequest) (ModelOutput, error) {
+		return ModelOutput{Results: fakeResults(req, 2), Logs: []string{"well 7 shut in"}}, nil
+	}}
+	s := newTestServer(t, runner, nil)
+	rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model", s.login("user"), ModelRequest{})
+	var data struct {
+		Results   []SimulationResult `json:"results"`
+		ModelLogs []string           `json:"modelLogs"`
+	}
+	decodeResponse(t, rec, &data)
+	if len(data.Results) != 2 || !reflect.DeepEqual(data.ModelLogs, []string{"well 7 shut in"}) {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDedupeResults(t *testing.T) {
+	rows := []SimulationResult{
+		{Year: 0, Scenario: 1, Revenue: 1},
+		{Year: 1, Scenario: 1, Revenue: 2},
+		{Year: 0, Scenario: 1, Revenue: 3},
+		{Year: 0, Scenario: 2, Revenue: 4},
+		{Year: 1, Scenario: 1, Revenue: 5},
+	}
+	kept, dups := dedupeResults(rows, false)
+	if dups != 2 || !reflect.DeepEqual(kept, rows) {
+		t.Errorf("drop=false: %d dups, %v; want 2 and every row", dups, kept)
+	}
+
+	kept, dups = dedupeResults(rows, true)
+	var revenues []float64
+	for _, r := range kept {
+		revenues = append(revenues, r.Revenue)
+	}
+	if dups != 2 || !reflect.DeepEqual(revenues, []float64{1, 2, 4}) {
+		t.Errorf("drop=true: %d dups, revenues %v; want 2 and the first of each", dups, revenues)
+	}
+	if rows[2].Revenue != 3 {
+		t.Error("dropping changed the caller's slice")
+	}
+}
+
+func TestRunModelReportsDuplicates(t *testing.T) {
+	runner := &fakeRunner{run: func(_ context.Context, req ModelRequest) (ModelOutput, error) {
+		results := fakeResults(req, 2)
+		return ModelOutput{Results: append(results, results[0])}, nil
+	}}
+	for _, drop := range []bool{false, true} {
+		s := newTestServer(t, runner, func(cfg *Config) { cfg.DedupeResults = drop })
+		rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model", s.login("user"), ModelRequest{})
+		var data struct {
+			Results    []SimulationResult `json:"results"`
+			Duplicates int                `json:"duplicates"`
+		}
+		decodeResponse(t, rec, &data)
+		want := 3
+		if drop {
+			want = 2
+		}
+		if data.Duplicates != 1 || len(data.Results) != want {
+			t.Errorf("DEDUPE_RESULTS=%v: %d results, %d duplicates; want %d and 1", drop, len(data.Results), data.Duplicates, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ==================== Oil price currency ====================
+
+// ModelRunner takes the oil price in USD. A client may send it in another
+// currency with oilPriceCurrency instead; the only rate a request carries
+// is exchangeRate, RUB per USD, so RUB is the one other currency that can
+// be converted.
+const (
+	currencyUSD = "USD"
+	currencyRUB = "RUB"
+)
+
+// convertOilPrice turns req's oil price into USD and clears its currency,
+// so the model, the cache and the stored run all see USD. The price and
+// currency as sent stay in req.Requested.
+func convertOilPrice(req *ModelRequest) error {
+	currency := strings.ToUpper(strings.TrimSpace(req.OilPriceCurrency))
+	req.OilPriceCurrency = ""
+	switch currency {
+	case "", currencyUSD:
+		return nil
+	case currencyRUB:
+	default:
+		return fmt.Errorf("Unsupported oilPriceCurrency %q (use %s or %s; exchangeRate is RUB per USD)", currency, currencyUSD, currencyRUB)
+	}
+	if req.OilPrice <= 0 {
+		return fmt.Errorf("oilPriceCurrency %s needs an oilPrice to convert", currency)
+	}
+	if req.ExchangeRate <= 0 {
+		return fmt.Errorf("oilPriceCurrency %s needs an exchangeRate to convert with", currency)
+	}
+	req.OilPrice /= req.ExchangeRate
+	if req.Requested != nil {
+		req.Requested.OilPriceCurrency = currency
+	}
+	return nil
+}
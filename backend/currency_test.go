@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConvertOilPrice(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       ModelRequest
+		oilPrice  float64
+		requested string // Requested.OilPriceCurrency
+		err       string
+	}{
+		{"no currency", ModelRequest{OilPrice: 80, ExchangeRate: 75}, 80, "", ""},
+		{"USD", ModelRequest{OilPrice: 80, ExchangeRate: 75, OilPriceCurrency: "USD"}, 80, "", ""},
+		{"RUB", ModelRequest{OilPrice: 6000, ExchangeRate: 75, OilPriceCurrency: "RUB"}, 80, "RUB", ""},
+		{"lowercase with spaces", ModelRequest{OilPrice: 6000, ExchangeRate: 75, OilPriceCurrency: " rub "}, 80, "RUB", ""},
+		{"unknown", ModelRequest{OilPrice: 80, ExchangeRate: 75, OilPriceCurrency: "EUR"}, 0, "", `Unsupported oilPriceCurrency "EUR"`},
+		{"no price", ModelRequest{ExchangeRate: 75, OilPriceCurrency: "RUB"}, 0, "", "needs an oilPrice"},
+		{"no rate", ModelRequest{OilPrice: 6000, OilPriceCurrency: "RUB"}, 0, "", "needs an exchangeRate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Requested = &RequestedParams{OilPrice: req.OilPrice, ExchangeRate: req.ExchangeRate}
+			err := convertOilPrice(&req)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.OilPrice != tt.oilPrice || req.OilPriceCurrency != "" {
+				t.Errorf("oil price %v %q, want %v in USD", req.OilPrice, req.OilPriceCurrency, tt.oilPrice)
+			}
+			if req.Requested.OilPrice != tt.req.OilPrice || req.Requested.OilPriceCurrency != tt.requested {
+				t.Errorf("requested %+v, want oil price %v in %q", *req.Requested, tt.req.OilPrice, tt.requested)
+			}
+		})
+	}
+}
+
+func TestRunModelConvertsOilPrice(t *testing.T) {
+	runner := &fakeRunner{}
+	s := newTestServer(t, runner, nil)
+	h := s.routes(t.TempDir())
+	token := s.login("user")
+
+	rec := serve(t, h, "POST", "/api/run-model", token, ModelRequest{OilPrice: 6000, ExchangeRate: 75, OilPriceCurrency: "RUB"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := runner.calls[0]; got.OilPrice != 80 || got.OilPriceCurrency != "" {
+		t.Errorf("model got oil price %v %q, want 80 USD", got.OilPrice, got.OilPriceCurrency)
+	}
+
+	rec = serve(t, h, "POST", "/api/run-model", token, ModelRequest{OilPrice: 80, OilPriceCurrency: "EUR"})
+	if rec.Code != http.StatusBadRequest || runner.callCount() != 1 {
+		t.Errorf("EUR: status %d after %d runs, want 400 without a run", rec.Code, runner.callCount())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// ==================== Database health ====================
+
+// dbPingTimeout bounds each health-check ping and reconnect attempt.
+const dbPingTimeout = 5 * time.Second
+
+// dbHealth is what the health check has seen of the primary database.
+type dbHealth struct {
+	mu            sync.Mutex
+	healthy       bool
+	initialized   bool // schema applied and scenarios loaded
+	lastCheck     time.Time
+	lastError     string
+	reconnects    int
+	lastReconnect time.Time
+}
+
+// DBHealthStatus is dbHealth as reported by /api/status.
+type DBHealthStatus struct {
+	Healthy       bool       `json:"healthy"`
+	LastCheck     *time.Time `json:"lastCheck,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	Reconnects    int        `json:"reconnects"`
+	LastReconnect *time.Time `json:"lastReconnect,omitempty"`
+}
+
+func (h *dbHealth) snapshot() DBHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := DBHealthStatus{Healthy: h.healthy, LastError: h.lastError, Reconnects: h.reconnects}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck
+		st.LastCheck = &t
+	}
+	if !h.lastReconnect.IsZero() {
+		t := h.lastReconnect
+		st.LastReconnect = &t
+	}
+	return st
+}
+
+// database is the current primary handle, or nil.
+func (s *Server) database() *sql.DB {
+	return s.db.Load()
+}
+
+// prepareDatabase applies the schema and loads scenarios. It runs once,
+// at startup or on the first successful reconnect if the database was
+// down when the server started.
+func (s *Server) prepareDatabase() {
+	if !s.initDatabase() {
+		return
+	}
+	s.loadScenarios()
+	s.dbHealth.mu.Lock()
+	s.dbHealth.healthy = true
+	s.dbHealth.initialized = true
+	s.dbHealth.mu.Unlock()
+}
+
+// watchDatabase runs checkDatabase every interval.
+func (s *Server) watchDatabase(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkDatabase()
+	}
+}
+
+// checkDatabase pings the primary and, if that fails, opens a fresh
+// handle and swaps it in once it answers. The old handle is closed after
+// the swap, which lets queries already running on it finish.
+func (s *Server) checkDatabase() {
+	db := s.database()
+	err := pingDatabase(db)
+	if err == nil {
+		s.databaseUp()
+		return
+	}
+
+	next, openErr := sql.Open("postgres", s.config().DatabaseURL)
+	if openErr == nil {
+		if openErr = pingDatabase(next); openErr != nil {
+			next.Close()
+		}
+	}
+	if openErr != nil {
+		s.recordDBCheck(openErr)
+		return
+	}
+
+	s.db.Store(next)
+	if db != nil {
+		db.Close()
+	}
+	s.dbHealth.mu.Lock()
+	s.dbHealth.reconnects++
+	s.dbHealth.lastReconnect = time.Now()
+	s.dbHealth.mu.Unlock()
+	log.Printf("Database reconnected after failed ping: %v", err)
+	s.databaseUp()
+}
+
+// databaseUp records a healthy check, first finishing the setup startup
+// skipped if the database was down then.
+func (s *Server) databaseUp() {
+	s.dbHealth.mu.Lock()
+	initialized := s.dbHealth.initialized
+	s.dbHealth.mu.Unlock()
+	if !initialized {
+		s.prepareDatabase()
+	}
+	s.recordDBCheck(nil)
+	s.replaySpooledLogs()
+}
+
+func pingDatabase(db *sql.DB) error {
+	if db == nil {
+		return sql.ErrConnDone
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// recordDBCheck stores a check's outcome, logging only when the health
+// changes so an outage doesn't flood the log.
+func (s *Server) recordDBCheck(err error) {
+	s.dbHealth.mu.Lock()
+	defer s.dbHealth.mu.Unlock()
+	wasHealthy := s.dbHealth.healthy
+	s.dbHealth.lastCheck = time.Now()
+	s.dbHealth.healthy = err == nil
+	if err != nil {
+		s.dbHealth.lastError = err.Error()
+		if wasHealthy {
+			log.Printf("WARN Database unhealthy, will keep trying to reconnect: %v", err)
+		}
+		return
+	}
+	s.dbHealth.lastError = ""
+	if !wasHealthy {
+		log.Println("Database healthy")
+	}
+}
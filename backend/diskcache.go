@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==================== Disk result cache ====================
+
+// With RESULT_CACHE_DIR set, complete results are also kept as one JSON
+// file per resultCacheKey, so they outlive a restart. The key carries the
+// model.jar hash, so a new jar never reads an old jar's results. Files
+// are written whole and renamed into place; a half-written one is never
+// read.
+
+const diskCacheExt = ".json"
+
+type diskCacheEntry struct {
+	Key        string             `json:"key"`
+	Request    ModelRequest       `json:"request"`
+	Project    string             `json:"project,omitempty"`
+	StoredAt   time.Time          `json:"storedAt"`
+	Results    []SimulationResult `json:"results"`
+	Logs       []string           `json:"logs,omitempty"`
+	Seed       *int64             `json:"seed,omitempty"`
+	Raw        []byte             `json:"raw,omitempty"`
+	Backend    string             `json:"backend,omitempty"`
+	Duplicates int                `json:"duplicates,omitempty"`
+}
+
+// request is the entry's ModelRequest, project included, which
+// ModelRequest doesn't encode.
+func (e diskCacheEntry) request() ModelRequest {
+	req := e.Request
+	req.Project = e.Project
+	return req
+}
+
+func diskCachePath(dir, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+diskCacheExt)
+}
+
+func readDiskCacheEntry(path string) (diskCacheEntry, error) {
+	var e diskCacheEntry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(data, &e)
+	return e, err
+}
+
+// diskCachedOutput looks key up on disk. Expired and unreadable files are
+// removed on the way.
+func (s *Server) diskCachedOutput(key string) (ModelOutput, bool) {
+	cfg := s.config()
+	path := diskCachePath(cfg.DiskCacheDir, key)
+	e, err := readDiskCacheEntry(path)
+	if os.IsNotExist(err) {
+		return ModelOutput{}, false
+	}
+	if err != nil || e.Key != key || time.Since(e.StoredAt) > cfg.DiskCacheTTL {
+		if err != nil {
+			s.errorLog.Printf("Dropping unreadable disk cache entry %s: %v", path, err)
+		}
+		os.Remove(path)
+		return ModelOutput{}, false
+	}
+	return ModelOutput{Results: e.Results, Logs: e.Logs, Seed: e.Seed, Raw: e.Raw, Backend: e.Backend, Duplicates: e.Duplicates}, true
+}
+
+// storeDiskOutput writes out under key, then trims the directory.
+func (s *Server) storeDiskOutput(key string, req ModelRequest, out ModelOutput) {
+	dir := s.config().DiskCacheDir
+	data, err := json.Marshal(diskCacheEntry{
+		Key:        key,
+		Request:    req,
+		Project:    req.Project,
+		StoredAt:   time.Now().UTC(),
+		Results:    out.Results,
+		Logs:       out.Logs,
+		Seed:       out.Seed,
+		Raw:        out.Raw,
+		Backend:    out.Backend,
+		Duplicates: out.Duplicates,
+	})
+	if err != nil {
+		s.errorLog.Printf("Failed to encode disk cache entry: %v", err)
+		return
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		s.errorLog.Printf("Failed to write disk cache entry: %v", err)
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), diskCachePath(dir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		s.errorLog.Printf("Failed to write disk cache entry: %v", err)
+		return
+	}
+	s.trimDiskCache()
+}
+
+// trimDiskCache drops expired entries, then the oldest ones until the
+// directory fits RESULT_CACHE_DIR_MAX_BYTES.
+func (s *Server) trimDiskCache() {
+	s.diskCacheMu.Lock()
+	defer s.diskCacheMu.Unlock()
+	cfg := s.config()
+
+	entries, err := os.ReadDir(cfg.DiskCacheDir)
+	if err != nil {
+		s.errorLog.Printf("Failed to list disk cache: %v", err)
+		return
+	}
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+	for _, de := range entries {
+		if !strings.HasSuffix(de.Name(), diskCacheExt) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(cfg.DiskCacheDir, de.Name())
+		if time.Since(info.ModTime()) > cfg.DiskCacheTTL {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, file{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	if cfg.DiskCacheMaxBytes == 0 {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= int64(cfg.DiskCacheMaxBytes) {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+}
+
+// invalidateDiskCache removes the entries matching f and returns how many
+// went.
+func (s *Server) invalidateDiskCache(f CacheFilter) int {
+	s.diskCacheMu.Lock()
+	defer s.diskCacheMu.Unlock()
+	dir := s.config().DiskCacheDir
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+diskCacheExt))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, path := range paths {
+		e, err := readDiskCacheEntry(path)
+		if err == nil && !f.matches(e.request()) {
+			continue
+		}
+		if os.Remove(path) == nil && err == nil {
+			n++
+		}
+	}
+	return n
+}
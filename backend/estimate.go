@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// ==================== Estimate ====================
+
+// estimateWindow is how many recent complete runs of a scenario feed its
+// average duration.
+const estimateWindow = 20
+
+// EstimateRequest describes a planned sweep: Runs runs of each scenario.
+// An empty Scenarios list means every known scenario.
+type EstimateRequest struct {
+	Scenarios []int `json:"scenarios"`
+	Runs      int   `json:"runs"`
+}
+
+// ScenarioEstimate is the expected duration of one run of a scenario.
+// AvgMs is nil when no complete run has a recorded duration.
+type ScenarioEstimate struct {
+	Scenario int      `json:"scenario"`
+	AvgMs    *float64 `json:"avgMs"`
+	Samples  int      `json:"samples"`
+}
+
+// recentDurations averages the last estimateWindow complete runs of each
+// scenario. Scenarios without any are left out.
+func (s *Server) recentDurations(scenarios []int) (map[int]ScenarioEstimate, error) {
+	out := make(map[int]ScenarioEstimate, len(scenarios))
+	if s.database() == nil {
+		return out, nil
+	}
+
+	ids := make([]int64, len(scenarios))
+	for i, id := range scenarios {
+		ids[i] = int64(id)
+	}
+	query := `SELECT scenario, AVG(duration_ms), COUNT(*) FROM (
+				SELECT scenario, duration_ms,
+				       ROW_NUMBER() OVER (PARTITION BY scenario ORDER BY timestamp DESC) AS rn
+				FROM request_logs
+				WHERE success AND COALESCE(error_msg, '') = '' AND duration_ms IS NOT NULL AND result_source IS NULL AND scenario = ANY($1)
+			  ) recent
+			  WHERE rn <= $2
+			  GROUP BY scenario`
+	rows, err := s.queryRead(query, pq.Array(ids), estimateWindow)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e ScenarioEstimate
+		var avg float64
+		if err := rows.Scan(&e.Scenario, &avg, &e.Samples); err != nil {
+			return nil, err
+		}
+		e.AvgMs = &avg
+		out[e.Scenario] = e
+	}
+	return out, rows.Err()
+}
+
+// handleEstimate predicts how long a sweep will take from recent run
+// durations. Runs are not queued, so the number already in flight is
+// reported instead of a queue position.
+func (s *Server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EstimateRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if req.Runs < 0 {
+		s.sendError(w, r, "runs must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Runs == 0 {
+		req.Runs = 1
+	}
+	if len(req.Scenarios) == 0 {
+		for _, sc := range s.currentScenarios() {
+			req.Scenarios = append(req.Scenarios, sc.ID)
+		}
+	}
+
+	var scenarios []int
+	seen := make(map[int]bool, len(req.Scenarios))
+	for _, id := range req.Scenarios {
+		if _, ok := s.findScenario(id); !ok {
+			s.sendError(w, r, s.unknownScenarioError(id).Error(), http.StatusBadRequest)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			scenarios = append(scenarios, id)
+		}
+	}
+	sort.Ints(scenarios)
+
+	known, err := s.recentDurations(scenarios)
+	if err != nil {
+		s.sendError(w, r, fmt.Sprintf("Failed to load run durations: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The total is only known when every scenario has history.
+	estimates := make([]ScenarioEstimate, 0, len(scenarios))
+	total := 0.0
+	complete := true
+	for _, id := range scenarios {
+		e, ok := known[id]
+		if !ok {
+			e = ScenarioEstimate{Scenario: id}
+			complete = false
+		} else {
+			total += *e.AvgMs * float64(req.Runs)
+		}
+		estimates = append(estimates, e)
+	}
+
+	data := map[string]interface{}{
+		"scenarios":   estimates,
+		"runs":        req.Runs,
+		"estimatedMs": nil,
+		"running":     s.countRunning(),
+	}
+	if complete {
+		data["estimatedMs"] = total
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
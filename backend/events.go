@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ==================== Run events ====================
+
+const (
+	// runEventBuffer is how many events a subscriber may fall behind by
+	// before further ones are dropped for it.
+	runEventBuffer = 64
+	// maxRunSubscribers bounds the open /api/admin/stream/requests
+	// connections.
+	maxRunSubscribers = 100
+	// streamKeepAlive is how often an idle stream gets a comment line, so
+	// proxies don't close it.
+	streamKeepAlive = 15 * time.Second
+)
+
+// RunEvent is a finished model run as /api/admin/stream/requests sends it.
+// Results are left out; Error is redacted like the admin log viewer.
+type RunEvent struct {
+	ID          string       `json:"id"`
+	Username    string       `json:"username"`
+	Parameters  ModelRequest `json:"parameters"`
+	Project     string       `json:"project,omitempty"`
+	Success     bool         `json:"success"`
+	Partial     bool         `json:"partial,omitempty"`
+	ResultCount int          `json:"resultCount"`
+	Error       string       `json:"error,omitempty"`
+	DurationMs  int64        `json:"durationMs"`
+	FinishedAt  time.Time    `json:"finishedAt"`
+}
+
+// runEvents fans RunEvents out to every subscriber. publish never waits: a
+// subscriber whose buffer is full misses the event and is told how many
+// it missed with the next one it gets.
+type runEvents struct {
+	mu     sync.Mutex
+	subs   map[*runSubscriber]bool
+	closed bool
+}
+
+type runSubscriber struct {
+	ch      chan RunEvent
+	dropped int // under runEvents.mu
+}
+
+func newRunEvents() *runEvents {
+	return &runEvents{subs: make(map[*runSubscriber]bool)}
+}
+
+// subscribe returns nil when there are maxRunSubscribers already or the
+// server is shutting down.
+func (e *runEvents) subscribe() *runSubscriber {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed || len(e.subs) >= maxRunSubscribers {
+		return nil
+	}
+	sub := &runSubscriber{ch: make(chan RunEvent, runEventBuffer)}
+	e.subs[sub] = true
+	return sub
+}
+
+func (e *runEvents) unsubscribe(sub *runSubscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs[sub] {
+		delete(e.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// takeDropped returns and resets how many events sub has missed.
+func (e *runEvents) takeDropped(sub *runSubscriber) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := sub.dropped
+	sub.dropped = 0
+	return n
+}
+
+func (e *runEvents) publish(ev RunEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for sub := range e.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+func (e *runEvents) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.subs)
+}
+
+// close ends every stream; it is registered to run on server shutdown,
+// which would otherwise wait on the open connections.
+func (e *runEvents) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for sub := range e.subs {
+		delete(e.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publishRun announces a finished run. The username is the stored form,
+// so anonymization holds on the stream too.
+func (s *Server) publishRun(id, username string, req ModelRequest, out ModelOutput, err error, elapsed time.Duration) {
+	ev := RunEvent{
+		ID:          id,
+		Username:    s.logUsername(username),
+		Parameters:  req,
+		Project:     req.Project,
+		Success:     err == nil,
+		Partial:     out.Partial,
+		ResultCount: len(out.Results),
+		DurationMs:  elapsed.Milliseconds(),
+		FinishedAt:  time.Now().UTC(),
+	}
+	if err != nil {
+		ev.Error = string(redactLogLine([]byte(err.Error())))
+	}
+	s.runEvents.publish(ev)
+}
+
+// handleRequestStream is GET /api/admin/stream/requests: a server-sent
+// event per finished model run, from any user, until the client goes away.
+func (s *Server) handleRequestStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sub := s.runEvents.subscribe()
+	if sub == nil {
+		s.sendError(w, r, fmt.Sprintf("Too many open streams (at most %d)", maxRunSubscribers), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.runEvents.unsubscribe(sub)
+
+	// The stream outlives HTTP_WRITE_TIMEOUT by design.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		log.Printf("Request stream can't flush: %v", err)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	log.Printf("[%s] Request stream opened", username)
+	defer log.Printf("[%s] Request stream closed", username)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if n := s.runEvents.takeDropped(sub); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", n)
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Failed to encode run event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: run\ndata: %s\n\n", ev.ID, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/xuri/excelize/v2"
+)
+
+// ==================== Export ====================
+
+// exportColumns is the header of every export, in ModelRunner's CSV order.
+var exportColumns = []string{"Year", "Scenario", "Revenue", "ProductionVolume", "NewWellsFund", "OldWellsFund"}
+
+// exportFormat writes results as a downloadable file.
+type exportFormat struct {
+	contentType string
+	ext         string
+	write       func(w io.Writer, results []SimulationResult) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv": {
+		contentType: "text/csv; charset=utf-8",
+		ext:         "csv",
+		write:       writeResultsCSV,
+	},
+	"xlsx": {
+		contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		ext:         "xlsx",
+		write:       writeResultsXLSX,
+	},
+	"parquet": {
+		// Registered with IANA in 2024; older clients may not know it.
+		contentType: "application/vnd.apache.parquet",
+		ext:         "parquet",
+		write:       writeResultsParquet,
+	},
+}
+
+// csvNotation is how a CSV export writes numbers. Comma decimals come
+// with a semicolon delimiter, as spreadsheets in those locales expect.
+type csvNotation struct {
+	decimal   string
+	delimiter rune
+}
+
+var csvNotations = map[string]csvNotation{
+	"dot":   {".", ','},
+	"comma": {",", ';'},
+}
+
+// csvStyle is the full layout of a CSV export: its notation plus the
+// line ending and byte order mark Excel on Windows wants.
+type csvStyle struct {
+	csvNotation
+	crlf bool
+	bom  bool
+}
+
+var defaultCSVStyle = csvStyle{csvNotation: csvNotations["dot"]}
+
+// utf8BOM makes Excel read the file as UTF-8 rather than the ANSI code page.
+const utf8BOM = "\uFEFF"
+
+// parseCSVStyle reads ?decimal=, ?excel=, ?lineEnding= and ?bom=.
+// excel=true defaults to CRLF and a BOM; lineEnding and bom override that
+// either way. set reports whether any of them was given.
+func parseCSVStyle(q url.Values) (style csvStyle, set bool, err error) {
+	style = defaultCSVStyle
+	if d := q.Get("decimal"); d != "" {
+		n, ok := csvNotations[d]
+		if !ok {
+			return style, true, fmt.Errorf("unsupported decimal %q (use dot or comma)", d)
+		}
+		style.csvNotation, set = n, true
+	}
+	if v := q.Get("excel"); v != "" {
+		excel, err := strconv.ParseBool(v)
+		if err != nil {
+			return style, true, fmt.Errorf("excel must be true or false")
+		}
+		style.crlf, style.bom, set = excel, excel, true
+	}
+	switch v := q.Get("lineEnding"); v {
+	case "":
+	case "lf", "crlf":
+		style.crlf, set = v == "crlf", true
+	default:
+		return style, true, fmt.Errorf("unsupported lineEnding %q (use lf or crlf)", v)
+	}
+	if v := q.Get("bom"); v != "" {
+		bom, err := strconv.ParseBool(v)
+		if err != nil {
+			return style, true, fmt.Errorf("bom must be true or false")
+		}
+		style.bom, set = bom, true
+	}
+	return style, set, nil
+}
+
+func writeResultsCSV(w io.Writer, results []SimulationResult) error {
+	return writeResultsCSVStyle(w, results, defaultCSVStyle)
+}
+
+func writeResultsCSVStyle(w io.Writer, results []SimulationResult, style csvStyle) error {
+	num := func(v float64) string {
+		return strings.Replace(formatFloat(v), ".", style.decimal, 1)
+	}
+	if style.bom {
+		if _, err := io.WriteString(w, utf8BOM); err != nil {
+			return err
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = style.delimiter
+	cw.UseCRLF = style.crlf
+	cw.Write(exportColumns)
+	for _, r := range results {
+		cw.Write([]string{
+			num(r.Year),
+			strconv.Itoa(r.Scenario),
+			num(r.Revenue),
+			num(r.ProductionVolume),
+			num(r.NewWellsFund),
+			num(r.OldWellsFund),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+const xlsxSheet = "Results"
+
+// writeResultsXLSX builds a single sheet with a styled header, one row per
+// result and, when there are rows, a revenue-by-year line chart beside them.
+func writeResultsXLSX(w io.Writer, results []SimulationResult) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := f.SetSheetName("Sheet1", xlsxSheet); err != nil {
+		return err
+	}
+	if err := fillResultsSheet(f, xlsxSheet, results); err != nil {
+		return err
+	}
+	_, err := f.WriteTo(w)
+	return err
+}
+
+// fillResultsSheet lays out results on an existing sheet: the table from
+// A1 and the revenue chart at H2.
+func fillResultsSheet(f *excelize.File, sheet string, results []SimulationResult) error {
+	header := make([]interface{}, len(exportColumns))
+	for i, c := range exportColumns {
+		header[i] = c
+	}
+	if err := f.SetSheetRow(sheet, "A1", &header); err != nil {
+		return err
+	}
+	for i, r := range results {
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		row := []interface{}{r.Year, r.Scenario, r.Revenue, r.ProductionVolume, r.NewWellsFund, r.OldWellsFund}
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+
+	headerStyle, err := f.NewStyle(&excelize.Style{
+		Font:   &excelize.Font{Bold: true},
+		Fill:   excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"#D9E1F2"}},
+		Border: []excelize.Border{{Type: "bottom", Color: "#000000", Style: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(sheet, "A1", "F1", headerStyle); err != nil {
+		return err
+	}
+	if err := f.SetColWidth(sheet, "A", "F", 18); err != nil {
+		return err
+	}
+	if err := f.SetPanes(sheet, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+		return err
+	}
+
+	if len(results) > 0 {
+		last := len(results) + 1
+		intStyle, err := f.NewStyle(&excelize.Style{NumFmt: 1}) // 0
+		if err != nil {
+			return err
+		}
+		numStyle, err := f.NewStyle(&excelize.Style{NumFmt: 4}) // #,##0.00
+		if err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(sheet, "A2", fmt.Sprintf("B%d", last), intStyle); err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(sheet, "C2", fmt.Sprintf("F%d", last), numStyle); err != nil {
+			return err
+		}
+
+		err = f.AddChart(sheet, "H2", &excelize.Chart{
+			Type: excelize.Line,
+			Series: []excelize.ChartSeries{{
+				Name:       fmt.Sprintf("'%s'!$C$1", sheet),
+				Categories: fmt.Sprintf("'%s'!$A$2:$A$%d", sheet, last),
+				Values:     fmt.Sprintf("'%s'!$C$2:$C$%d", sheet, last),
+			}},
+			Title:  []excelize.RichTextRun{{Text: "Revenue by year"}},
+			Legend: excelize.ChartLegend{Position: "none"},
+			XAxis:  excelize.ChartAxis{Title: []excelize.RichTextRun{{Text: "Year"}}},
+			YAxis:  excelize.ChartAxis{Title: []excelize.RichTextRun{{Text: "Revenue"}}, MajorGridLines: true},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parquetResult is the Parquet schema of an export, one column per
+// SimulationResult field under its JSON name.
+type parquetResult struct {
+	Year             float64 `parquet:"year"`
+	Scenario         int64   `parquet:"scenario"`
+	Revenue          float64 `parquet:"revenue"`
+	ProductionVolume float64 `parquet:"productionVolume"`
+	NewWellsFund     float64 `parquet:"newWellsFund"`
+	OldWellsFund     float64 `parquet:"oldWellsFund"`
+}
+
+// writeResultsParquet writes a single row group. With no results the file
+// still carries the schema.
+func writeResultsParquet(w io.Writer, results []SimulationResult) error {
+	rows := make([]parquetResult, len(results))
+	for i, r := range results {
+		rows[i] = parquetResult{
+			Year:             r.Year,
+			Scenario:         int64(r.Scenario),
+			Revenue:          r.Revenue,
+			ProductionVolume: r.ProductionVolume,
+			NewWellsFund:     r.NewWellsFund,
+			OldWellsFund:     r.OldWellsFund,
+		}
+	}
+
+	pw := parquet.NewGenericWriter[parquetResult](w)
+	if _, err := pw.Write(rows); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+// selectExportResults resolves the run an export covers: ?id= for one of
+// the caller's stored runs, or ?jobId= for one of their finished jobs. It
+// returns a file name stem for the download. On failure it has already
+// answered the request.
+func (s *Server) selectExportResults(w http.ResponseWriter, r *http.Request, username string) ([]SimulationResult, string, bool) {
+	q := r.URL.Query()
+
+	if jobID := q.Get("jobId"); jobID != "" {
+		job, ok := s.getJob(jobID)
+		if !ok || job.Username != username {
+			s.sendError(w, r, "Job not found", http.StatusNotFound)
+			return nil, "", false
+		}
+		if !job.finished() {
+			s.sendError(w, r, "Job is still "+string(job.Status), http.StatusConflict)
+			return nil, "", false
+		}
+		return job.Results, "job-" + job.ID, true
+	}
+
+	idStr := q.Get("id")
+	if idStr == "" {
+		s.sendError(w, r, "id or jobId is required", http.StatusBadRequest)
+		return nil, "", false
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		s.sendError(w, r, "Invalid run id", http.StatusBadRequest)
+		return nil, "", false
+	}
+	results, err := s.getStoredResults(username, id)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return results, "run-" + idStr, true
+}
+
+// handleExport downloads one run's results as ?format=csv (the default),
+// xlsx or parquet. A run without results exports just the header.
+// ?decimal=comma switches CSV to comma decimals and ?excel=true to CRLF
+// with a BOM (see parseCSVStyle). XLSX needs neither, its cells hold
+// numbers the spreadsheet shows in its own locale, so it accepts and
+// ignores them.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "csv"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		s.sendError(w, r, fmt.Sprintf("Unsupported format %q (use csv, xlsx or parquet)", name), http.StatusBadRequest)
+		return
+	}
+	style, custom, err := parseCSVStyle(r.URL.Query())
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if custom {
+		switch name {
+		case "csv":
+			format.write = func(w io.Writer, results []SimulationResult) error {
+				return writeResultsCSVStyle(w, results, style)
+			}
+		case "parquet":
+			s.sendError(w, r, "decimal, excel, lineEnding and bom apply to csv and xlsx exports", http.StatusBadRequest)
+			return
+		}
+	}
+
+	username := r.Header.Get("X-Username")
+	results, stem, ok := s.selectExportResults(w, r, username)
+	if !ok {
+		return
+	}
+
+	s.serveDownload(w, r, stem+"."+format.ext, format.contentType, "export", func(w io.Writer) error {
+		return format.write(w, results)
+	})
+}
+
+// serveDownload writes a file with write into a temporary file and serves
+// it with http.ServeContent, so a client can fetch it in ranges and resume
+// a broken download. The ETag is the content's SHA-256: a resume whose
+// If-Range no longer matches, because the file came out different this
+// time, gets the whole file instead of a mismatched tail. The temporary
+// file is removed when the request is done.
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, name, contentType, what string, write func(io.Writer) error) {
+	f, err := os.CreateTemp("", "download-*")
+	if err != nil {
+		s.sendError(w, r, fmt.Sprintf("Failed to build %s: %v", what, err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(f, sum))
+	err = write(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.sendError(w, r, fmt.Sprintf("Failed to build %s: %v", what, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
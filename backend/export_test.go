@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var exportRows = []SimulationResult{{Year: 2025, Scenario: 1, Revenue: 1234.5, ProductionVolume: 10, NewWellsFund: 2, OldWellsFund: 40.25}}
+
+func TestWriteResultsCSVLocales(t *testing.T) {
+	header := strings.Join(exportColumns, ",")
+	tests := []struct {
+		decimal string
+		want    string
+	}{
+		{"dot", header + "\n2025,1,1234.5,10,2,40.25\n"},
+		{"comma", strings.Join(exportColumns, ";") + "\n2025;1;1234,5;10;2;40,25\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.decimal, func(t *testing.T) {
+			style, _, err := parseCSVStyle(url.Values{"decimal": {tt.decimal}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := writeResultsCSVStyle(&buf, exportRows, style); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteResultsCSVDefaultIsDot(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeResultsCSV(&buf, exportRows); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "1234.5,") {
+		t.Errorf("default CSV %q doesn't use dot decimals and comma delimiters", buf.String())
+	}
+}
+
+func TestParseCSVStyle(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    csvStyle
+		set     bool
+		wantErr bool
+	}{
+		{"", defaultCSVStyle, false, false},
+		{"decimal=comma", csvStyle{csvNotation: csvNotations["comma"]}, true, false},
+		{"excel=true", csvStyle{csvNotation: csvNotations["dot"], crlf: true, bom: true}, true, false},
+		{"excel=true&bom=false", csvStyle{csvNotation: csvNotations["dot"], crlf: true}, true, false},
+		{"lineEnding=crlf", csvStyle{csvNotation: csvNotations["dot"], crlf: true}, true, false},
+		{"decimal=semicolon", csvStyle{}, true, true},
+		{"lineEnding=cr", csvStyle{}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			style, set, err := parseCSVStyle(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (style != tt.want || set != tt.set) {
+				t.Errorf("parseCSVStyle = %+v, %v; want %+v, %v", style, set, tt.want, tt.set)
+			}
+		})
+	}
+}
+
+func TestRunModelJSONKeepsDotDecimals(t *testing.T) {
+	s := newTestServer(t, &fakeRunner{}, nil)
+	rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model?decimal=comma", s.login("user"),
+		ModelRequest{OilPrice: 80.5, ExchangeRate: 75})
+	if body := rec.Body.String(); !strings.Contains(body, `"revenue":6037.5`) {
+		t.Errorf("JSON answer %s doesn't carry dot-decimal numbers", body)
+	}
+}
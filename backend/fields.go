@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ==================== Result fields ====================
+
+// resultFields are the JSON keys of SimulationResult, in field order.
+var resultFields = func() []string {
+	t := reflect.TypeOf(SimulationResult{})
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}()
+
+// parseResultFields reads ?fields=year,revenue, the result keys to keep.
+// It returns nil, all fields, when the parameter is missing.
+func parseResultFields(r *http.Request) ([]string, error) {
+	v := r.URL.Query().Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool, len(resultFields))
+	for _, f := range resultFields {
+		known[f] = true
+	}
+	var fields []string
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if !known[f] {
+			return nil, fmt.Errorf("Unknown field %q in fields (use %s)", f, strings.Join(resultFields, ", "))
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// projectFields re-encodes rows, a slice of result structs or of maps as
+// withUnits returns them, keeping only fields.
+func projectFields(rows interface{}, fields []string) ([]map[string]interface{}, error) {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	var out []map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	for i, row := range out {
+		kept := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			if v, ok := row[f]; ok {
+				kept[f] = v
+			}
+		}
+		out[i] = kept
+	}
+	return out, nil
+}
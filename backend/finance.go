@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ==================== Finance ====================
+
+// computeNPV discounts each year's revenue back to the first year in the
+// series at the given annual rate (0.1 = 10%). Results need not be sorted;
+// a year of fractional value is discounted by its fractional distance.
+func computeNPV(results []SimulationResult, rate float64) float64 {
+	if len(results) == 0 {
+		return 0
+	}
+	start := results[0].Year
+	for _, r := range results[1:] {
+		start = math.Min(start, r.Year)
+	}
+
+	var npv float64
+	for _, r := range results {
+		npv += r.Revenue / math.Pow(1+rate, r.Year-start)
+	}
+	return npv
+}
+
+var errInvalidDiscountRate = errors.New("discountRate must be a number greater than -1")
+
+// discountRate returns the rate for ?npv=true requests: the discountRate
+// query parameter if given, else the configured default.
+func (s *Server) discountRate(r *http.Request) (float64, error) {
+	v := r.URL.Query().Get("discountRate")
+	if v == "" {
+		return s.config().DiscountRate, nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= -1 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, errInvalidDiscountRate
+	}
+	return rate, nil
+}
+
+// CumulativeResult is a result row plus the running totals of revenue and
+// production up to and including its year.
+type CumulativeResult struct {
+	SimulationResult
+	CumulativeRevenue          float64 `json:"cumulativeRevenue"`
+	CumulativeProductionVolume float64 `json:"cumulativeProductionVolume"`
+}
+
+// cumulativeResults returns results sorted by scenario and year, each with
+// running sums kept separately per scenario. The input is left untouched.
+func cumulativeResults(results []SimulationResult) []CumulativeResult {
+	sorted := make([]SimulationResult, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Scenario != sorted[j].Scenario {
+			return sorted[i].Scenario < sorted[j].Scenario
+		}
+		return sorted[i].Year < sorted[j].Year
+	})
+
+	out := make([]CumulativeResult, len(sorted))
+	var revenue, production float64
+	for i, r := range sorted {
+		if i > 0 && r.Scenario != sorted[i-1].Scenario {
+			revenue, production = 0, 0
+		}
+		revenue += r.Revenue
+		production += r.ProductionVolume
+		out[i] = CumulativeResult{SimulationResult: r, CumulativeRevenue: revenue, CumulativeProductionVolume: production}
+	}
+	return out
+}
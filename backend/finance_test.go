@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestComputeNPV(t *testing.T) {
+	series := []SimulationResult{{Year: 2025, Revenue: 100}, {Year: 2026, Revenue: 110}, {Year: 2027, Revenue: 121}}
+	tests := []struct {
+		name    string
+		results []SimulationResult
+		rate    float64
+		want    float64
+	}{
+		{"empty", nil, 0.1, 0},
+		{"zero rate sums revenue", series, 0, 331},
+		{"ten percent", series, 0.1, 300},
+		{"negative rate", series, -0.5, 100 + 110/0.5 + 121/0.25},
+		{"unsorted years", []SimulationResult{series[2], series[0], series[1]}, 0.1, 300},
+		{"fractional year", []SimulationResult{{Year: 0, Revenue: 100}, {Year: 0.5, Revenue: 100}}, 0.21, 100 + 100/1.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := computeNPV(tt.results, tt.rate); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("computeNPV = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscountRate(t *testing.T) {
+	s := newTestServer(t, nil, func(cfg *Config) { cfg.DiscountRate = 0.07 })
+	tests := []struct {
+		query   string
+		want    float64
+		wantErr bool
+	}{
+		{"", 0.07, false},
+		{"?discountRate=0", 0, false},
+		{"?discountRate=-0.5", -0.5, false},
+		{"?discountRate=-1", 0, true},
+		{"?discountRate=NaN", 0, true},
+		{"?discountRate=ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := s.discountRate(httptest.NewRequest("GET", "/api/run-model"+tt.query, nil))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("discountRate(%q) = %v, %v; want %v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCumulativeResults(t *testing.T) {
+	in := []SimulationResult{
+		{Year: 2027, Scenario: 1, Revenue: 30, ProductionVolume: 3},
+		{Year: 2025, Scenario: 2, Revenue: 5, ProductionVolume: 1},
+		{Year: 2025, Scenario: 1, Revenue: 10, ProductionVolume: 1},
+		{Year: 2026, Scenario: 1, Revenue: 20, ProductionVolume: 2},
+	}
+	want := []struct {
+		year, revenue, production float64
+		scenario                  int
+	}{
+		{2025, 10, 1, 1},
+		{2026, 30, 3, 1},
+		{2027, 60, 6, 1},
+		{2025, 5, 1, 2},
+	}
+	got := cumulativeResults(in)
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Year != w.year || g.Scenario != w.scenario || g.CumulativeRevenue != w.revenue || g.CumulativeProductionVolume != w.production {
+			t.Errorf("row %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if in[0].Year != 2027 {
+		t.Error("cumulativeResults reordered its input")
+	}
+}
+
+func TestCumulativeResultsSingleRow(t *testing.T) {
+	got := cumulativeResults([]SimulationResult{{Year: 2025, Revenue: 7, ProductionVolume: 2}})
+	if len(got) != 1 || got[0].CumulativeRevenue != 7 || got[0].CumulativeProductionVolume != 2 || got[0].Revenue != 7 {
+		t.Errorf("cumulativeResults = %+v", got)
+	}
+	if got := cumulativeResults(nil); len(got) != 0 {
+		t.Errorf("cumulativeResults(nil) = %+v", got)
+	}
+}
+
+func TestRunModelCumulativeOption(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	h, token := s.routes(t.TempDir()), s.login("user")
+	for _, tt := range []struct {
+		path       string
+		cumulative bool
+	}{
+		{"/api/run-model", false},
+		{"/api/run-model?cumulative=true", true},
+	} {
+		var data struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		decodeResponse(t, serve(t, h, "POST", tt.path, token, ModelRequest{}), &data)
+		if len(data.Results) == 0 {
+			t.Fatalf("%s: no results", tt.path)
+		}
+		if _, ok := data.Results[0]["cumulativeRevenue"]; ok != tt.cumulative {
+			t.Errorf("%s: cumulativeRevenue present %v, want %v", tt.path, ok, tt.cumulative)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCapOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"no cap", "нефть", 0, "нефть", false},
+		{"fits", "oil", 3, "oil", false},
+		{"ascii cut", "oil,gas", 3, "oil", true},
+		{"cut on a boundary", "нефть", 4, "не", true},
+		{"cut inside a rune", "нефть", 5, "не", true},
+		{"first rune too long", "нефть", 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := capOutput([]byte(tt.in), tt.max)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("capOutput(%q, %d) = %q, %v; want %q, %v", tt.in, tt.max, got, truncated, tt.want, tt.truncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("capOutput(%q, %d) = %q, not valid UTF-8", tt.in, tt.max, got)
+			}
+		})
+	}
+}
+
+// brokenWriter is a client that hung up: headers go out, writes fail.
+type brokenWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *brokenWriter) Header() http.Header       { return w.header }
+func (w *brokenWriter) WriteHeader(status int)    { w.status = status }
+func (w *brokenWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// captureLog collects what the server logs until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return &buf
+}
+
+func TestWriteJSONLogsFailedWrite(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	logged := captureLog(t)
+
+	r := httptest.NewRequest("GET", "/api/scenarios", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	w := &brokenWriter{header: http.Header{}}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: fakeResults(ModelRequest{}, 50)})
+
+	if w.status != http.StatusOK {
+		t.Errorf("status %d, want 200", w.status)
+	}
+	if out := logged.String(); !strings.Contains(out, "Failed to write response") || !strings.Contains(out, "req-42") {
+		t.Errorf("log %q doesn't report the failed write with its request ID", out)
+	}
+}
+
+func TestRunModelDropsAnswerForGoneClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &fakeRunner{run: func(context.Context, ModelRequest) (ModelOutput, error) {
+		cancel() // the client hangs up while the model runs
+		return ModelOutput{Results: fakeResults(ModelRequest{}, 3)}, nil
+	}}
+	s := newTestServer(t, runner, nil)
+	logged := captureLog(t)
+
+	r := httptest.NewRequest("POST", "/api/run-model", strings.NewReader("{}")).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+s.login("user"))
+	rec := httptest.NewRecorder()
+	s.routes(t.TempDir()).ServeHTTP(rec, r)
+
+	if rec.Body.Len() != 0 {
+		t.Errorf("wrote %q to a client that went away", rec.Body)
+	}
+	if !strings.Contains(logged.String(), "Client went away") {
+		t.Errorf("log %q doesn't mention the client going away", logged)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	h, token := s.routes(t.TempDir()), s.login("user")
+	tests := []struct {
+		name, body string
+		status     int
+		err        string
+	}{
+		{"empty", "", http.StatusBadRequest, "Request body is empty"},
+		{"whitespace", "  \n", http.StatusBadRequest, "Request body is empty"},
+		{"malformed", `{"username":`, http.StatusBadRequest, "Invalid JSON: "},
+		{"wrong type", `{"username":5}`, http.StatusBadRequest, "Invalid JSON: "},
+	}
+	for _, path := range []string{"/api/login", "/api/register", "/api/run-model", "/api/compare"} {
+		for _, tt := range tests {
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				body := tt.body
+				if tt.name == "wrong type" && path != "/api/login" && path != "/api/register" {
+					body = `{"oilPrice":{}}`
+				}
+				r := httptest.NewRequest("POST", path, strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				resp := decodeResponse(t, rec, nil)
+				if rec.Code != tt.status || !strings.HasPrefix(resp.Error, tt.err) {
+					t.Errorf("status %d, error %q; want %d, %q", rec.Code, resp.Error, tt.status, tt.err)
+				}
+			})
+		}
+	}
+
+	rec := serve(t, h, "POST", "/api/login", "", User{Username: "user", Password: "user123"})
+	if rec.Code != http.StatusOK {
+		t.Errorf("valid login body: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== History ====================
+
+// ResultDelta is a run's value minus the baseline's for one year.
+type ResultDelta struct {
+	Year             float64 `json:"year"`
+	Revenue          float64 `json:"revenue"`
+	ProductionVolume float64 `json:"productionVolume"`
+	NewWellsFund     float64 `json:"newWellsFund"`
+	OldWellsFund     float64 `json:"oldWellsFund"`
+}
+
+var errRunNotFound = errors.New("run not found")
+
+// getStoredResults loads the results saved with one of username's runs.
+func (s *Server) getStoredResults(username string, id int) ([]SimulationResult, error) {
+	return s.storedResults(s.logUsername(username), id)
+}
+
+// storedResults is getStoredResults for owner as stored in request_logs.
+func (s *Server) storedResults(owner string, id int) ([]SimulationResult, error) {
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	var raw sql.NullString
+	query := `SELECT results FROM request_logs WHERE id = $1 AND username = $2`
+	err := s.database().QueryRow(query, id, owner).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !raw.Valid {
+		return nil, nil
+	}
+
+	var results []SimulationResult
+	if err := json.Unmarshal([]byte(raw.String), &results); err != nil {
+		return nil, fmt.Errorf("stored results are corrupt: %v", err)
+	}
+	return results, nil
+}
+
+func (s *Server) setBaseline(username string, id int) error {
+	query := `INSERT INTO user_baselines (username, request_id) VALUES ($1, $2)
+			  ON CONFLICT (username) DO UPDATE SET request_id = EXCLUDED.request_id, set_at = CURRENT_TIMESTAMP`
+	_, err := s.database().Exec(query, s.logUsername(username), id)
+	return err
+}
+
+// getBaseline returns the id and results of username's baseline run, or
+// errRunNotFound if none is set.
+func (s *Server) getBaseline(username string) (int, []SimulationResult, error) {
+	if s.database() == nil {
+		return 0, nil, fmt.Errorf("database not connected")
+	}
+
+	var id int
+	query := `SELECT request_id FROM user_baselines WHERE username = $1`
+	err := s.database().QueryRow(query, s.logUsername(username)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, errRunNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	results, err := s.getStoredResults(username, id)
+	return id, results, err
+}
+
+// diffResults subtracts baseline from current year by year. Years missing
+// from either side are left out.
+func diffResults(current, baseline []SimulationResult) []ResultDelta {
+	byYear := make(map[float64]SimulationResult, len(baseline))
+	for _, b := range baseline {
+		byYear[b.Year] = b
+	}
+
+	deltas := make([]ResultDelta, 0, len(current))
+	for _, c := range current {
+		b, ok := byYear[c.Year]
+		if !ok {
+			continue
+		}
+		deltas = append(deltas, ResultDelta{
+			Year:             c.Year,
+			Revenue:          c.Revenue - b.Revenue,
+			ProductionVolume: c.ProductionVolume - b.ProductionVolume,
+			NewWellsFund:     c.NewWellsFund - b.NewWellsFund,
+			OldWellsFund:     c.OldWellsFund - b.OldWellsFund,
+		})
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Year < deltas[j].Year })
+	return deltas
+}
+
+// handleSetBaseline marks one of the caller's successful runs as the
+// baseline that ?vsBaseline=true compares against.
+func (s *Server) handleSetBaseline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.sendError(w, r, "Invalid run id", http.StatusBadRequest)
+		return
+	}
+
+	results, err := s.getStoredResults(username, id)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(results) == 0 {
+		s.sendError(w, r, "Run has no stored results", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.setBaseline(username, id); err != nil {
+		s.sendError(w, r, "Failed to set baseline: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] Baseline set to run %d", username, id)
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Baseline set",
+		Data:    map[string]int{"baselineId": id},
+	})
+}
+
+// HistoryFilter narrows getRequestHistory. Nil fields don't filter.
+type HistoryFilter struct {
+	Success      *bool
+	Adjusted     *bool
+	Project      string // "" matches every project
+	DrillingRate paramRange
+	OilPrice     paramRange
+	ExchangeRate paramRange
+}
+
+// paramRange is an inclusive bound on a run parameter; either end may be
+// open.
+type paramRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+func (pr paramRange) contains(v float64) bool {
+	return (pr.Min == nil || v >= *pr.Min) && (pr.Max == nil || v <= *pr.Max)
+}
+
+// parseParamRange reads <name>Min and <name>Max from q.
+func parseParamRange(q url.Values, name string) (paramRange, error) {
+	var pr paramRange
+	for _, end := range []struct {
+		suffix string
+		dst    **float64
+	}{{"Min", &pr.Min}, {"Max", &pr.Max}} {
+		v := q.Get(name + end.suffix)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return pr, fmt.Errorf("%s%s must be a number", name, end.suffix)
+		}
+		*end.dst = &f
+	}
+	if pr.Min != nil && pr.Max != nil && *pr.Min > *pr.Max {
+		return pr, fmt.Errorf("%sMin must not be greater than %sMax", name, name)
+	}
+	return pr, nil
+}
+
+// parseHistoryFilter reads filters from the query string.
+func parseHistoryFilter(r *http.Request) (HistoryFilter, error) {
+	var f HistoryFilter
+	q := r.URL.Query()
+
+	switch v := q.Get("success"); v {
+	case "", "all":
+	case "true", "false":
+		b := v == "true"
+		f.Success = &b
+	default:
+		return f, fmt.Errorf("success must be true, false or all")
+	}
+
+	switch v := q.Get("adjusted"); v {
+	case "", "all":
+	case "true", "false":
+		b := v == "true"
+		f.Adjusted = &b
+	default:
+		return f, fmt.Errorf("adjusted must be true, false or all")
+	}
+
+	if f.Project = q.Get("project"); f.Project != "" && !projectIDPattern.MatchString(f.Project) {
+		return f, fmt.Errorf("invalid project")
+	}
+
+	var err error
+	if f.DrillingRate, err = parseParamRange(q, "drillingRate"); err != nil {
+		return f, err
+	}
+	if f.OilPrice, err = parseParamRange(q, "oilPrice"); err != nil {
+		return f, err
+	}
+	if f.ExchangeRate, err = parseParamRange(q, "exchangeRate"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// where builds the WHERE clause and its arguments for owner's rows, owner
+// being the name as stored in request_logs.
+func (f HistoryFilter) where(owner string) (string, []interface{}) {
+	conds := []string{"username = $1"}
+	args := []interface{}{owner}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Success != nil {
+		add("success = $%d", *f.Success)
+	}
+	if f.Adjusted != nil {
+		add("COALESCE(params_adjusted, FALSE) = $%d", *f.Adjusted)
+	}
+	if f.Project != "" {
+		add("project = $%d", f.Project)
+	}
+	for _, c := range []struct {
+		column string
+		pr     paramRange
+	}{
+		{"drilling_rate", f.DrillingRate},
+		{"oil_price", f.OilPrice},
+		{"exchange_rate", f.ExchangeRate},
+	} {
+		if c.pr.Min != nil {
+			add(c.column+" >= $%d", *c.pr.Min)
+		}
+		if c.pr.Max != nil {
+			add(c.column+" <= $%d", *c.pr.Max)
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (s *Server) getRequestHistory(username string, filter HistoryFilter) ([]RequestLog, error) {
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	where, args := filter.where(s.logUsername(username))
+	query := `SELECT id, username, timestamp, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, COALESCE(error_msg, ''), seed, COALESCE(project, ''),
+				requested_scenario, requested_drilling_rate, requested_oil_price, requested_exchange_rate, COALESCE(requested_oil_price_currency, ''),
+				COALESCE(params_adjusted, FALSE), COALESCE(result_source, '')
+			  FROM request_logs WHERE ` + where + ` ORDER BY timestamp DESC LIMIT 50`
+	rows, err := s.queryRead(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []RequestLog
+	for rows.Next() {
+		var l RequestLog
+		var scenario, drillingRate sql.NullInt64
+		var oilPrice, exchangeRate sql.NullFloat64
+		var currency string
+		if err := rows.Scan(&l.ID, &l.Username, &l.Timestamp, &l.Scenario, &l.DrillingRate, &l.OilPrice, &l.ExchangeRate, &l.Success, &l.ResultCount, &l.Error, &l.Seed, &l.Project,
+			&scenario, &drillingRate, &oilPrice, &exchangeRate, &currency, &l.Adjusted, &l.Source); err != nil {
+			continue
+		}
+		if scenario.Valid {
+			l.Requested = &RequestedParams{int(scenario.Int64), int(drillingRate.Int64), oilPrice.Float64, exchangeRate.Float64, currency}
+		}
+		// Rows may hold the hashed name; the caller owns them either way.
+		l.Username = username
+		logs = append(logs, l)
+	}
+	return logs, nil
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	logs, err := s.getRequestHistory(username, filter)
+	if err != nil {
+		s.sendError(w, r, "Failed to fetch history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    logs,
+	})
+}
+
+// Imports are written as multi-row INSERTs of importBatchSize rows, which
+// keeps each statement well under PostgreSQL's 65535 bind parameter limit.
+const (
+	importBatchSize = 1000
+	importMaxRows   = 50000
+)
+
+// ImportError points at a rejected row of an import batch.
+type ImportError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func validateImportRow(l RequestLog) error {
+	switch {
+	case l.Username == "":
+		return errors.New("username is required")
+	case l.Timestamp.IsZero():
+		return errors.New("timestamp is required")
+	case l.Scenario <= 0:
+		return errors.New("scenario must be positive")
+	case l.DrillingRate <= 0 || l.OilPrice <= 0 || l.ExchangeRate <= 0:
+		return errors.New("drillingRate, oilPrice and exchangeRate must be positive")
+	case l.ResultCount < 0:
+		return errors.New("resultCount must not be negative")
+	}
+	return nil
+}
+
+// importRequestLogs inserts rows into request_logs in one transaction, so
+// either all of them land or none do.
+func (s *Server) importRequestLogs(rows []RequestLog) error {
+	tx, err := s.database().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(rows); start += importBatchSize {
+		batch := rows[start:min(start+importBatchSize, len(rows))]
+
+		var values []string
+		var args []interface{}
+		for _, l := range batch {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''))",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11))
+			args = append(args, s.logUsername(l.Username), l.Timestamp, l.Scenario, l.DrillingRate,
+				l.OilPrice, l.ExchangeRate, l.Success, l.ResultCount, l.Error, l.Seed, l.Project)
+		}
+		query := `INSERT INTO request_logs (username, timestamp, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, error_msg, seed, project)
+				  VALUES ` + strings.Join(values, ", ")
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleHistoryImport bulk-loads RequestLog records, e.g. when migrating
+// from another system. Any invalid row rejects the batch unless
+// ?skipInvalid=true, in which case only the valid rows are imported.
+func (s *Server) handleHistoryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.database() == nil {
+		s.sendError(w, r, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	var rows []RequestLog
+	if err := s.decodeJSON(r, &rows); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if len(rows) > importMaxRows {
+		s.sendError(w, r, fmt.Sprintf("At most %d rows per import", importMaxRows), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	skipInvalid := r.URL.Query().Get("skipInvalid") == "true"
+	valid := make([]RequestLog, 0, len(rows))
+	rejected := []ImportError{}
+	for i, l := range rows {
+		if err := validateImportRow(l); err != nil {
+			rejected = append(rejected, ImportError{Index: i, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, l)
+	}
+	if len(rejected) > 0 && !skipInvalid {
+		s.writeJSON(w, r, http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("%d invalid rows, nothing imported", len(rejected)),
+			Data:    map[string]interface{}{"rejected": rejected},
+		})
+		return
+	}
+
+	if len(valid) > 0 {
+		if err := s.importRequestLogs(valid); err != nil {
+			s.sendError(w, r, "Failed to import history: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("[%s] Imported %d history rows (%d skipped)", r.Header.Get("X-Username"), len(valid), len(rejected))
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "History imported",
+		Data: map[string]interface{}{
+			"inserted": len(valid),
+			"skipped":  len(rejected),
+			"rejected": rejected,
+		},
+	})
+}
+
+// maxCurveRuns caps ?limit= on /api/history/curves.
+const maxCurveRuns = 50
+
+// curveMetrics are the result fields /api/history/curves can plot.
+var curveMetrics = map[string]func(SimulationResult) float64{
+	"revenue":          func(r SimulationResult) float64 { return r.Revenue },
+	"productionVolume": func(r SimulationResult) float64 { return r.ProductionVolume },
+	"newWellsFund":     func(r SimulationResult) float64 { return r.NewWellsFund },
+	"oldWellsFund":     func(r SimulationResult) float64 { return r.OldWellsFund },
+}
+
+// CurveSeries is one run's metric by year, as parallel x/y arrays that
+// charting libraries take directly.
+type CurveSeries struct {
+	ID         int          `json:"id"`
+	Label      string       `json:"label"`
+	Timestamp  time.Time    `json:"timestamp"`
+	Parameters ModelRequest `json:"parameters"`
+	X          []float64    `json:"x"`
+	Y          []float64    `json:"y"`
+}
+
+// recentStoredRuns loads owner's last limit runs that kept their results,
+// newest first.
+func (s *Server) recentStoredRuns(owner string, limit int) ([]ReportRun, error) {
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+	query := `SELECT ` + storedRunColumns + ` FROM request_logs
+			  WHERE username = $1 AND results IS NOT NULL ORDER BY timestamp DESC LIMIT $2`
+	rows, err := s.queryRead(query, owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []ReportRun
+	for rows.Next() {
+		run, err := scanStoredRun(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// handleHistoryCurves overlays one metric across the caller's recent runs:
+// ?metric= (default revenue) and ?limit= (default 10, at most
+// maxCurveRuns).
+func (s *Server) handleHistoryCurves(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = "revenue"
+	}
+	value, ok := curveMetrics[metric]
+	if !ok {
+		s.sendError(w, r, fmt.Sprintf("Unknown metric %q (use revenue, productionVolume, newWellsFund or oldWellsFund)", metric), http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCurveRuns {
+			s.sendError(w, r, fmt.Sprintf("limit must be between 1 and %d", maxCurveRuns), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	username := r.Header.Get("X-Username")
+	runs, err := s.recentStoredRuns(s.logUsername(username), limit)
+	if err != nil {
+		s.sendError(w, r, "Failed to fetch history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	series := make([]CurveSeries, 0, len(runs))
+	for _, run := range runs {
+		results := make([]SimulationResult, len(run.Results))
+		copy(results, run.Results)
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Year < results[j].Year })
+
+		p := run.Parameters
+		cs := CurveSeries{
+			ID:         run.ID,
+			Label:      fmt.Sprintf("#%d scenario %d, drilling %d, oil %g, rate %g (%s)", run.ID, p.Scenario, p.DrillingRate, p.OilPrice, p.ExchangeRate, run.Timestamp.UTC().Format("2006-01-02 15:04")),
+			Timestamp:  run.Timestamp,
+			Parameters: p,
+			X:          make([]float64, len(results)),
+			Y:          make([]float64, len(results)),
+		}
+		for i, res := range results {
+			cs.X[i] = res.Year
+			cs.Y[i] = value(res)
+		}
+		series = append(series, cs)
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"metric": metric,
+			"series": series,
+		},
+	})
+}
+
+// storedRawOutput loads the model output kept with one of username's
+// runs; ok is false when none was kept.
+func (s *Server) storedRawOutput(username string, id int) (raw string, ok bool, err error) {
+	if s.database() == nil {
+		return "", false, fmt.Errorf("database not connected")
+	}
+	var out sql.NullString
+	query := `SELECT raw_output FROM request_logs WHERE id = $1 AND username = $2`
+	err = s.database().QueryRow(query, id, s.logUsername(username)).Scan(&out)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, errRunNotFound
+	}
+	return out.String, out.Valid, err
+}
+
+func (s *Server) updateStoredResults(username string, id int, results []SimulationResult) error {
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE request_logs SET results = $1, result_count = $2 WHERE id = $3 AND username = $4`
+	_, err = s.database().Exec(query, string(b), len(results), id, s.logUsername(username))
+	return err
+}
+
+// handleReparse is POST /api/history/{id}/reparse: the run's stored raw
+// output parsed again with the current CSV settings. ?store=true also
+// replaces the stored results, which later reports and baselines use.
+func (s *Server) handleReparse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.sendError(w, r, "Invalid run id", http.StatusBadRequest)
+		return
+	}
+
+	raw, ok, err := s.storedRawOutput(username, id)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.sendError(w, r, "Run has no stored output (STORE_RAW_OUTPUT was off, the run failed or its output was too large)", http.StatusUnprocessableEntity)
+		return
+	}
+
+	cfg := s.config()
+	parser, err := parseCSVOutput(raw, cfg)
+	if err != nil {
+		s.sendErrorCode(w, r, "Failed to parse stored output: "+err.Error(), "model_parse", http.StatusUnprocessableEntity)
+		return
+	}
+	// As a live run would, so an unchanged output compares equal.
+	results, duplicates := dedupeResults(parser.results, cfg.DedupeResults)
+	previous, err := s.getStoredResults(username, id)
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stored := false
+	if r.URL.Query().Get("store") == "true" {
+		if err := s.updateStoredResults(username, id, results); err != nil {
+			s.sendError(w, r, "Failed to store results: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stored = true
+		log.Printf("[%s] Re-parsed run %d: %d results (was %d)", username, id, len(results), len(previous))
+	}
+
+	data := map[string]interface{}{
+		"id":                  id,
+		"results":             results,
+		"previousResultCount": len(previous),
+		"changed":             !reflect.DeepEqual(results, previous),
+		"stored":              stored,
+	}
+	if duplicates > 0 {
+		data["duplicates"] = duplicates
+	}
+	if len(parser.logs) > 0 {
+		data["modelLogs"] = parser.logs
+	}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Stored output re-parsed",
+		Data:    data,
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffResults(t *testing.T) {
+	baseline := []SimulationResult{
+		{Year: 2025, Revenue: 100, ProductionVolume: 10, NewWellsFund: 1, OldWellsFund: 50},
+		{Year: 2026, Revenue: 110, ProductionVolume: 12, NewWellsFund: 2, OldWellsFund: 49},
+	}
+	tests := []struct {
+		name    string
+		current []SimulationResult
+		want    []ResultDelta
+	}{
+		{"same run", baseline, []ResultDelta{{Year: 2025}, {Year: 2026}}},
+		{
+			"run minus baseline",
+			[]SimulationResult{{Year: 2025, Revenue: 150, ProductionVolume: 8, NewWellsFund: 3, OldWellsFund: 50}},
+			[]ResultDelta{{Year: 2025, Revenue: 50, ProductionVolume: -2, NewWellsFund: 2}},
+		},
+		{
+			"years only in one run are left out",
+			[]SimulationResult{{Year: 2024, Revenue: 1}, {Year: 2026, Revenue: 100, ProductionVolume: 12, NewWellsFund: 2, OldWellsFund: 49}},
+			[]ResultDelta{{Year: 2026, Revenue: -10}},
+		},
+		{
+			"sorted by year",
+			[]SimulationResult{baseline[1], baseline[0]},
+			[]ResultDelta{{Year: 2025}, {Year: 2026}},
+		},
+		{"empty run", nil, []ResultDelta{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffResults(tt.current, baseline); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffResults = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// storedRun is a request_logs row as handleReparse reads it.
+type storedRun struct {
+	owner   string
+	raw     interface{} // string, or nil for no stored output
+	results string
+}
+
+// storedRuns serves the request_logs queries of reparse from runs, by id.
+func storedRuns(t *testing.T, runs map[int64]*storedRun) fakeSQL {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		var run *storedRun
+		if len(args) == 2 || len(args) == 4 {
+			id, owner := args[len(args)-2].(int64), args[len(args)-1].(string)
+			if r := runs[id]; r != nil && r.owner == owner {
+				run = r
+			}
+		}
+		switch {
+		case strings.HasPrefix(query, "SELECT raw_output FROM request_logs"):
+			if run == nil {
+				return []string{"raw_output"}, nil, nil
+			}
+			return []string{"raw_output"}, [][]driver.Value{{run.raw}}, nil
+		case strings.HasPrefix(query, "SELECT results FROM request_logs"):
+			if run == nil {
+				return []string{"results"}, nil, nil
+			}
+			return []string{"results"}, [][]driver.Value{{run.results}}, nil
+		case strings.HasPrefix(query, "UPDATE request_logs SET results"):
+			if run != nil {
+				run.results = args[0].(string)
+			}
+			return nil, nil, nil
+		}
+		t.Errorf("unexpected query %q", query)
+		return nil, nil, errors.New("unexpected query")
+	}
+}
+
+func TestReparse(t *testing.T) {
+	rows := parseTestCSV(t, csvRows, nil).results
+	stored, _ := json.Marshal(rows)
+	firstOnly, _ := json.Marshal(rows[:1])
+	// The model printed csvRows' first row twice; the live run with
+	// DEDUPE_RESULTS on stored it once.
+	repeated := csvRows + "0,1,100.5,10,2,40\n"
+
+	tests := []struct {
+		name       string
+		dedupe     bool
+		path       string
+		status     int
+		results    int
+		duplicates int
+		changed    bool
+		stored     bool
+	}{
+		{"unchanged", false, "/api/history/7/reparse", http.StatusOK, 2, 0, false, false},
+		{"changed and stored", false, "/api/history/10/reparse?store=true", http.StatusOK, 2, 0, true, true},
+		{"dedupe on, unchanged", true, "/api/history/11/reparse?store=true", http.StatusOK, 2, 1, false, true},
+		{"dedupe off keeps the repeat", false, "/api/history/11/reparse", http.StatusOK, 3, 1, true, false},
+		{"someone else's run", false, "/api/history/8/reparse", http.StatusNotFound, 0, 0, false, false},
+		{"no stored output", false, "/api/history/9/reparse", http.StatusUnprocessableEntity, 0, 0, false, false},
+		{"bad id", false, "/api/history/seven/reparse", http.StatusBadRequest, 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := map[int64]*storedRun{
+				7:  {owner: "user", raw: csvRows, results: string(stored)},
+				8:  {owner: "admin", raw: csvRows, results: string(stored)},
+				9:  {owner: "user", raw: nil, results: string(stored)},
+				10: {owner: "user", raw: csvRows, results: string(firstOnly)},
+				11: {owner: "user", raw: repeated, results: string(stored)},
+			}
+			s := newTestServer(t, nil, func(cfg *Config) { cfg.DedupeResults = tt.dedupe })
+			s.db.Store(openFakeDB(storedRuns(t, runs)))
+
+			rec := serve(t, s.routes(t.TempDir()), "POST", tt.path, s.login("user"), nil)
+			var data struct {
+				Results    []SimulationResult `json:"results"`
+				Duplicates int                `json:"duplicates"`
+				Changed    bool               `json:"changed"`
+				Stored     bool               `json:"stored"`
+			}
+			decodeResponse(t, rec, &data)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if len(data.Results) != tt.results || data.Duplicates != tt.duplicates || data.Changed != tt.changed || data.Stored != tt.stored {
+				t.Errorf("got %d results, %d duplicates, changed %v, stored %v; want %d, %d, %v, %v",
+					len(data.Results), data.Duplicates, data.Changed, data.Stored, tt.results, tt.duplicates, tt.changed, tt.stored)
+			}
+			// Storing run 10's re-parse is the only change to what any
+			// run has stored.
+			for id, run := range runs {
+				want := string(stored)
+				if id == 10 && !(tt.stored && strings.Contains(tt.path, "/10/")) {
+					want = string(firstOnly)
+				}
+				if run.results != want {
+					t.Errorf("run %d's stored results became %s, want %s", id, run.results, want)
+				}
+			}
+		})
+	}
+}
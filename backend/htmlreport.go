@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ==================== HTML reports ====================
+
+// htmlReportCSP lets the page run its own inline script and styles and
+// nothing else, so it stays inert if a value ever slipped past escaping.
+const htmlReportCSP = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'"
+
+// htmlReportPage is what htmlReportTemplate renders.
+type htmlReportPage struct {
+	Run         ReportRun
+	Units       map[string]string
+	GeneratedAt string
+}
+
+// htmlReportTemplate is a standalone page: styles, chart script and data
+// are all inline, so the saved file opens offline. The chart plots revenue
+// and production volume by year on a canvas, each on its own scale.
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num": formatFloat,
+	"fixed": func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	},
+	"time": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Run {{.Run.ID}} - scenario {{.Run.Parameters.Scenario}}</title>
+<style>
+body { font-family: system-ui, -apple-system, "Segoe UI", Roboto, sans-serif; margin: 2rem auto; max-width: 960px; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.6rem; margin-bottom: 0.2rem; }
+h2 { font-size: 1.2rem; margin-top: 2rem; border-bottom: 1px solid #ddd; padding-bottom: 0.3rem; }
+.meta { color: #666; margin-top: 0; }
+.cards { display: grid; grid-template-columns: repeat(auto-fit, minmax(180px, 1fr)); gap: 0.8rem; }
+.card { border: 1px solid #ddd; border-radius: 6px; padding: 0.6rem 0.8rem; }
+.card .label { color: #666; font-size: 0.85rem; }
+.card .value { font-size: 1.15rem; font-weight: 600; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9rem; }
+th, td { padding: 0.35rem 0.6rem; border-bottom: 1px solid #eee; text-align: right; }
+th { background: #f5f5f5; }
+th:first-child, td:first-child { text-align: left; }
+canvas { width: 100%; height: 320px; }
+.legend span { display: inline-block; margin-right: 1.2rem; }
+.legend i { display: inline-block; width: 12px; height: 12px; margin-right: 0.3rem; vertical-align: middle; }
+@media print { canvas { height: 260px; } }
+</style>
+</head>
+<body>
+<h1>Run {{.Run.ID}}</h1>
+<p class="meta">Run at {{time .Run.Timestamp}} &middot; generated {{.GeneratedAt}}</p>
+
+<h2>Parameters</h2>
+<div class="cards">
+<div class="card"><div class="label">Scenario</div><div class="value">{{.Run.Parameters.Scenario}}</div></div>
+<div class="card"><div class="label">Drilling rate</div><div class="value">{{.Run.Parameters.DrillingRate}}</div></div>
+<div class="card"><div class="label">Oil price</div><div class="value">{{num .Run.Parameters.OilPrice}}</div></div>
+<div class="card"><div class="label">Exchange rate</div><div class="value">{{num .Run.Parameters.ExchangeRate}}</div></div>
+{{- with .Run.Parameters.Seed}}
+<div class="card"><div class="label">Seed</div><div class="value">{{.}}</div></div>
+{{- end}}
+</div>
+
+<h2>Summary</h2>
+{{- with .Run.Summary}}
+<div class="cards">
+<div class="card"><div class="label">Years</div><div class="value">{{num .FirstYear}}&ndash;{{num .LastYear}}</div></div>
+<div class="card"><div class="label">Total revenue, {{index $.Units "revenue"}}</div><div class="value">{{fixed .TotalRevenue}}</div></div>
+<div class="card"><div class="label">Peak revenue ({{num .PeakRevenueYear}})</div><div class="value">{{fixed .PeakRevenue}}</div></div>
+<div class="card"><div class="label">Total production, {{index $.Units "productionVolume"}}</div><div class="value">{{fixed .TotalProductionVolume}}</div></div>
+<div class="card"><div class="label">NPV at {{num .DiscountRate}}</div><div class="value">{{fixed .NPV}}</div></div>
+</div>
+{{- end}}
+
+<h2>Revenue and production</h2>
+<p class="legend"><span><i style="background:#1f77b4"></i>Revenue, {{index .Units "revenue"}}</span><span><i style="background:#ff7f0e"></i>Production volume, {{index .Units "productionVolume"}}</span></p>
+<canvas id="chart"></canvas>
+
+<h2>Results</h2>
+<table>
+<thead><tr><th>Year</th><th>Scenario</th><th>Revenue, {{index .Units "revenue"}}</th><th>Production volume, {{index .Units "productionVolume"}}</th><th>New wells fund, {{index .Units "newWellsFund"}}</th><th>Old wells fund, {{index .Units "oldWellsFund"}}</th></tr></thead>
+<tbody>
+{{- range .Run.Results}}
+<tr><td>{{num .Year}}</td><td>{{.Scenario}}</td><td>{{num .Revenue}}</td><td>{{num .ProductionVolume}}</td><td>{{num .NewWellsFund}}</td><td>{{num .OldWellsFund}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+
+<script>
+(function () {
+  var rows = {{.Run.Results}} || [];
+  var canvas = document.getElementById("chart");
+  var ratio = window.devicePixelRatio || 1;
+  var w = canvas.clientWidth, h = canvas.clientHeight;
+  canvas.width = w * ratio;
+  canvas.height = h * ratio;
+  var ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  if (rows.length === 0) {
+    ctx.fillStyle = "#666";
+    ctx.fillText("No results", 10, 20);
+    return;
+  }
+  var pad = { left: 60, right: 60, top: 10, bottom: 30 };
+  var years = rows.map(function (r) { return r.year; });
+  var minX = Math.min.apply(null, years), maxX = Math.max.apply(null, years);
+  var x = function (v) { return pad.left + (maxX === minX ? 0.5 : (v - minX) / (maxX - minX)) * (w - pad.left - pad.right); };
+  function scale(key) {
+    var vs = rows.map(function (r) { return r[key]; });
+    var lo = Math.min(0, Math.min.apply(null, vs)), hi = Math.max.apply(null, vs);
+    if (hi === lo) { hi = lo + 1; }
+    return { lo: lo, hi: hi, y: function (v) { return h - pad.bottom - (v - lo) / (hi - lo) * (h - pad.top - pad.bottom); } };
+  }
+  function line(key, color, s) {
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    rows.forEach(function (r, i) {
+      var px = x(r.year), py = s.y(r[key]);
+      if (i === 0) { ctx.moveTo(px, py); } else { ctx.lineTo(px, py); }
+    });
+    ctx.stroke();
+  }
+  var rev = scale("revenue"), prod = scale("productionVolume");
+  ctx.font = "11px sans-serif";
+  ctx.strokeStyle = "#ccc";
+  ctx.beginPath();
+  ctx.moveTo(pad.left, pad.top);
+  ctx.lineTo(pad.left, h - pad.bottom);
+  ctx.lineTo(w - pad.right, h - pad.bottom);
+  ctx.lineTo(w - pad.right, pad.top);
+  ctx.stroke();
+  ctx.fillStyle = "#666";
+  ctx.textAlign = "center";
+  years.forEach(function (v) { ctx.fillText(v, x(v), h - pad.bottom + 15); });
+  ctx.textAlign = "right";
+  ctx.fillText(rev.hi.toPrecision(4), pad.left - 5, pad.top + 10);
+  ctx.fillText(rev.lo.toPrecision(4), pad.left - 5, h - pad.bottom);
+  ctx.textAlign = "left";
+  ctx.fillText(prod.hi.toPrecision(4), w - pad.right + 5, pad.top + 10);
+  ctx.fillText(prod.lo.toPrecision(4), w - pad.right + 5, h - pad.bottom);
+  line("revenue", "#1f77b4", rev);
+  line("productionVolume", "#ff7f0e", prod);
+})();
+</script>
+</body>
+</html>
+`))
+
+// handleRunReportHTML is GET /api/history/{id}/report.html: one of the
+// caller's stored runs as a standalone page for people who won't open
+// JSON or CSV.
+func (s *Server) handleRunReportHTML(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.sendError(w, r, "Invalid run id", http.StatusBadRequest)
+		return
+	}
+
+	cfg := s.config()
+	run, err := s.loadReportRun(s.logUsername(username), id)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	run.Summary = summarizeRun(run.Results, cfg.DiscountRate)
+	if run.Results == nil {
+		run.Results = []SimulationResult{}
+	}
+
+	var buf bytes.Buffer
+	page := htmlReportPage{Run: run, Units: cfg.ResultUnits, GeneratedAt: time.Now().UTC().Format("2006-01-02 15:04:05 UTC")}
+	if err := htmlReportTemplate.Execute(&buf, page); err != nil {
+		s.sendError(w, r, "Failed to render report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] HTML report of run %d", username, id)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", htmlReportCSP)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"run-%d.html\"", id))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
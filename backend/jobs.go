@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== Jobs ====================
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// Job is a model run executed in the background. cancel aborts the run's
+// context, which kills the JVM.
+type Job struct {
+	ID         string             `json:"id"`
+	Username   string             `json:"username"`
+	Status     JobStatus          `json:"status"`
+	Parameters ModelRequest       `json:"parameters"`
+	Results    []SimulationResult `json:"results,omitempty"`
+	Partial    bool               `json:"partial,omitempty"`
+	Duplicates int                `json:"duplicates,omitempty"`
+	ModelLogs  []string           `json:"modelLogs,omitempty"`
+	// Progress is the model's last progress marker while the job runs.
+	Progress *float64 `json:"progress,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// ErrorCode is the code /api/run-model would answer the failure with.
+	ErrorCode string `json:"errorCode,omitempty"`
+	// CallbackURL, if set, receives the finished job as a JSON POST.
+	CallbackURL string     `json:"callbackUrl,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+
+	cancel context.CancelFunc
+	// streamed holds the rows read so far while the job runs, for
+	// /api/jobs/{id}/tail.
+	streamed []SimulationResult
+}
+
+// JobRequest is a ModelRequest plus job-only options.
+type JobRequest struct {
+	ModelRequest
+	CallbackURL string `json:"callbackUrl"`
+}
+
+// UnmarshalJSON is needed because ModelRequest's would otherwise be
+// promoted and skip CallbackURL.
+func (req *JobRequest) UnmarshalJSON(data []byte) error {
+	if err := req.ModelRequest.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	var opts struct {
+		CallbackURL string `json:"callbackUrl"`
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return err
+	}
+	req.CallbackURL = opts.CallbackURL
+	return nil
+}
+
+func (j *Job) finished() bool {
+	return j.Status != JobRunning
+}
+
+// getJob returns a copy of the job safe to encode outside the lock.
+func (s *Server) getJob(id string) (Job, bool) {
+	s.jobsMu.RLock()
+	defer s.jobsMu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+func (s *Server) startJob(username string, req ModelRequest, callbackURL string) Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:          generateToken()[:16],
+		Username:    username,
+		Status:      JobRunning,
+		Parameters:  req,
+		CreatedAt:   time.Now(),
+		CallbackURL: callbackURL,
+		cancel:      cancel,
+	}
+
+	s.jobsMu.Lock()
+	s.jobs[job.ID] = job
+	snapshot := *job
+	s.jobsMu.Unlock()
+
+	ctx = withRowReporter(ctx, func(i int, row SimulationResult) {
+		s.jobsMu.Lock()
+		job.streamed = append(job.streamed[:i], row)
+		s.jobsMu.Unlock()
+	})
+	go func() {
+		defer cancel()
+		out, err := s.executeModel(ctx, job.ID, username, req)
+
+		s.jobsMu.Lock()
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Results = out.Results
+		job.streamed = nil
+		job.Partial = out.Partial
+		job.Duplicates = out.Duplicates
+		job.ModelLogs = out.Logs
+		switch {
+		case job.Status == JobCanceled:
+			// Canceled by the user; keep that status whatever the run returned.
+		case err != nil:
+			job.Status = JobFailed
+			job.Error = err.Error()
+			_, job.ErrorCode = modelErrorStatus(err)
+		default:
+			job.Status = JobSucceeded
+		}
+		done := *job
+		s.jobsMu.Unlock()
+
+		if done.CallbackURL != "" {
+			deliverCallback(done)
+		}
+	}()
+
+	return snapshot
+}
+
+// cancelJob marks a running job canceled and kills its process. It reports
+// false if the job had already finished or is gone, leaving the Job zero
+// in that case.
+func (s *Server) cancelJob(id string) (Job, bool) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	if j.finished() {
+		return *j, false
+	}
+	j.Status = JobCanceled
+	j.cancel()
+	return *j, true
+}
+
+// sweepJobs drops jobs that finished more than JOB_RETENTION ago, so the
+// job table doesn't grow with every run ever submitted.
+func (s *Server) sweepJobs() {
+	for range time.Tick(time.Minute) {
+		s.pruneJobs(time.Now().Add(-s.config().JobRetention))
+	}
+}
+
+// pruneJobs drops the jobs that finished before cutoff.
+func (s *Server) pruneJobs(cutoff time.Time) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && j.FinishedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w, r) {
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+
+	var req JobRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if err := s.validateModelRequest(&req.ModelRequest); err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	project, err := s.requestProject(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Project = project
+	if req.CallbackURL != "" {
+		if err := s.validateCallbackURL(req.CallbackURL); err != nil {
+			s.sendError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	job := s.startJob(username, req.ModelRequest, req.CallbackURL)
+	log.Printf("[%s] Submitted job %s", username, job.ID)
+
+	s.writeJSON(w, r, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Job submitted",
+		Data:    job,
+	})
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("X-Username")
+	id := r.PathValue("id")
+
+	job, ok := s.getJob(id)
+	if !ok || job.Username != username {
+		s.sendError(w, r, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !job.finished() {
+			job.Progress = s.runProgress(id)
+		}
+	case "DELETE":
+		var canceled bool
+		job, canceled = s.cancelJob(id)
+		if job.ID == "" {
+			// Dropped by sweepJobs since getJob.
+			s.sendError(w, r, "Job not found", http.StatusNotFound)
+			return
+		}
+		if !canceled {
+			s.sendError(w, r, "Job already "+string(job.Status), http.StatusConflict)
+			return
+		}
+		log.Printf("[%s] Canceled job %s", username, id)
+	default:
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    job,
+	})
+}
+
+// jobTail is the part of a job's rows from offset on: the rows read so
+// far while it runs, its results once it has finished.
+func (s *Server) jobTail(id string, offset int) (Job, []SimulationResult, int, bool) {
+	s.jobsMu.RLock()
+	defer s.jobsMu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, nil, 0, false
+	}
+	rows := j.streamed
+	if j.finished() {
+		rows = j.Results
+	}
+	total := len(rows)
+	if offset >= total {
+		return *j, []SimulationResult{}, total, true
+	}
+	tail := make([]SimulationResult, total-offset)
+	copy(tail, rows[offset:])
+	return *j, tail, total, true
+}
+
+// handleJobTail is GET /api/jobs/{id}/tail: the rows the job has produced
+// past ?offset=, so a poller sees results before the job finishes. With
+// MODEL_OUTPUT_MODE=file no rows appear until it does.
+func (s *Server) handleJobTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	id := r.PathValue("id")
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.sendError(w, r, "offset must be a whole number, 0 or more", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	job, rows, total, ok := s.jobTail(id, offset)
+	if !ok || job.Username != username {
+		s.sendError(w, r, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	data := map[string]interface{}{
+		"id":     id,
+		"status": job.Status,
+		"offset": offset,
+		"rows":   rows,
+		"next":   offset + len(rows),
+		"total":  total,
+		"done":   job.finished(),
+	}
+	if !job.finished() {
+		if p := s.runProgress(id); p != nil {
+			data["progress"] = *p
+		}
+	}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: data})
+}
+
+// ==================== Job callbacks ====================
+
+const (
+	callbackAttempts = 3
+	callbackBackoff  = 2 * time.Second
+)
+
+// callbackClient doesn't follow redirects: an allowed host could otherwise
+// bounce the request to one that isn't.
+var callbackClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// validateCallbackURL accepts only http(s) URLs on a host listed in
+// CALLBACK_ALLOWED_HOSTS, so jobs can't be used to reach internal services.
+func (s *Server) validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callbackUrl must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("callbackUrl must not contain credentials")
+	}
+	if !containsString(s.config().CallbackAllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("callbackUrl host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// deliverCallback POSTs the finished job to its callback URL, retrying with
+// a growing delay on network errors and non-2xx answers.
+func deliverCallback(job Job) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("[%s] Job %s callback: failed to encode job: %v", job.Username, job.ID, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = postCallback(job.CallbackURL, body)
+		if err == nil {
+			log.Printf("[%s] Job %s callback delivered", job.Username, job.ID)
+			return
+		}
+		if attempt == callbackAttempts {
+			log.Printf("[%s] Job %s callback failed after %d attempts: %v", job.Username, job.ID, attempt, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * callbackBackoff)
+	}
+}
+
+func postCallback(target string, body []byte) error {
+	resp, err := callbackClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return nil
+}
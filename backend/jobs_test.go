@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPruneJobsDropsOnlyExpiredFinishedJobs(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	now := time.Now()
+	old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	s.jobs["old"] = &Job{ID: "old", Status: JobSucceeded, FinishedAt: &old}
+	s.jobs["recent"] = &Job{ID: "recent", Status: JobFailed, FinishedAt: &recent}
+	s.jobs["running"] = &Job{ID: "running", Status: JobRunning, CreatedAt: old}
+
+	s.pruneJobs(now.Add(-time.Hour))
+
+	if _, ok := s.getJob("old"); ok {
+		t.Error("job finished before the cutoff was kept")
+	}
+	for _, id := range []string{"recent", "running"} {
+		if _, ok := s.getJob(id); !ok {
+			t.Errorf("job %q was dropped", id)
+		}
+	}
+}
+
+func TestCancelJobUnknownID(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	job, canceled := s.cancelJob("missing")
+	if canceled || job.ID != "" {
+		t.Errorf("cancelJob(missing) = %+v, %v; want zero job, false", job, canceled)
+	}
+}
+
+func TestDeleteExpiredJobIsNotFound(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	finished := time.Now().Add(-2 * time.Hour)
+	s.jobs["done"] = &Job{ID: "done", Username: "admin", Status: JobSucceeded, FinishedAt: &finished}
+	s.pruneJobs(time.Now().Add(-s.config().JobRetention))
+
+	rec := serve(t, s.routes(t.TempDir()), "DELETE", "/api/jobs/done", s.login("admin"), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE expired job: status %d, want 404: %s", rec.Code, rec.Body)
+	}
+}
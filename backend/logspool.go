@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ==================== Request log spool ====================
+
+// With REQUEST_LOG_SPOOL set, request_logs rows that can't be written
+// because the database is down are appended to that file, one JSON object
+// per line, instead of being dropped. Each healthy database check replays
+// the file, so rows come back within DB_HEALTH_INTERVAL of a reconnect;
+// one left over from an earlier process is replayed the same way.
+
+// spooledLog is a requestLogEntry as a spool line. Project and Requested
+// are kept apart because ModelRequest leaves them out of its JSON.
+type spooledLog struct {
+	Username   string             `json:"username"`
+	Request    ModelRequest       `json:"request"`
+	Project    string             `json:"project,omitempty"`
+	Requested  *RequestedParams   `json:"requested,omitempty"`
+	Success    bool               `json:"success"`
+	Results    []SimulationResult `json:"results,omitempty"`
+	Raw        []byte             `json:"raw,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	DurationMs int64              `json:"durationMs"`
+	Source     string             `json:"source,omitempty"`
+}
+
+func newSpooledLog(e requestLogEntry) spooledLog {
+	return spooledLog{
+		Username:   e.username,
+		Request:    e.req,
+		Project:    e.req.Project,
+		Requested:  e.req.Requested,
+		Success:    e.success,
+		Results:    e.results,
+		Raw:        e.raw,
+		Error:      e.errMsg,
+		DurationMs: e.duration.Milliseconds(),
+		Source:     e.source,
+	}
+}
+
+func (l spooledLog) entry() requestLogEntry {
+	req := l.Request
+	req.Project = l.Project
+	req.Requested = l.Requested
+	return requestLogEntry{l.Username, req, l.Success, l.Results, l.Raw, l.Error, time.Duration(l.DurationMs) * time.Millisecond, l.Source}
+}
+
+// spoolRequestLogs appends batch to the spool file and reports whether it
+// did; false when REQUEST_LOG_SPOOL is unset or the write failed.
+func (s *Server) spoolRequestLogs(batch []requestLogEntry) bool {
+	path := s.config().RequestLogSpool
+	if path == "" {
+		return false
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range batch {
+		if err := enc.Encode(newSpooledLog(e)); err != nil {
+			s.errorLog.Printf("Failed to encode request log for the spool: %v", err)
+			return false
+		}
+	}
+
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		s.errorLog.Printf("Failed to open request log spool: %v", err)
+		return false
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.errorLog.Printf("Failed to write request log spool: %v", err)
+		return false
+	}
+	s.metrics.add(s.metrics.spooledLogs, "", float64(len(batch)))
+	return true
+}
+
+// replaySpooledLogs writes the spooled rows to request_logs, LOG_BATCH_SIZE
+// at a time, and empties the spool. If the database goes away again the
+// rows not yet written stay for the next healthy check. A batch the
+// database refuses while it is up is dropped, or it would be retried
+// forever; so is a line that doesn't parse.
+func (s *Server) replaySpooledLogs() {
+	cfg := s.config()
+	if cfg.RequestLogSpool == "" {
+		return
+	}
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+	data, err := os.ReadFile(cfg.RequestLogSpool)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.errorLog.Printf("Failed to read request log spool: %v", err)
+		}
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	var entries []requestLogEntry
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64<<10), len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var l spooledLog
+		if err := json.Unmarshal(line, &l); err != nil {
+			s.metrics.inc(s.metrics.droppedLogs, "")
+			log.Printf("WARN Skipping unreadable request log spool line %d: %v", n, err)
+			continue
+		}
+		entries = append(entries, l.entry())
+		lines = append(lines, line)
+	}
+
+	written, replayed := 0, 0
+	for written < len(entries) {
+		db := s.database()
+		if db == nil {
+			break
+		}
+		end := min(written+cfg.LogBatchSize, len(entries))
+		if err := execRequestLogs(db, entries[written:end]); err != nil {
+			if pingDatabase(db) != nil {
+				s.errorLog.Printf("Database went away replaying the request log spool: %v", err)
+				break
+			}
+			s.metrics.add(s.metrics.droppedLogs, "", float64(end-written))
+			s.errorLog.Printf("Dropping %d spooled request log rows the database refused: %v", end-written, err)
+		} else {
+			replayed += end - written
+		}
+		written = end
+	}
+
+	var rest bytes.Buffer
+	for _, line := range lines[written:] {
+		rest.Write(line)
+		rest.WriteByte('\n')
+	}
+	if err := os.WriteFile(cfg.RequestLogSpool, rest.Bytes(), 0640); err != nil {
+		s.errorLog.Printf("Failed to rewrite request log spool: %v", err)
+		return
+	}
+	if replayed > 0 {
+		s.metrics.add(s.metrics.replayedLogs, "", float64(replayed))
+		log.Printf("Replayed %d spooled request log rows, %d left", replayed, len(lines)-written)
+	}
+}
+
+// checkRequestLogSpool fails startup if the spool file can't be opened for
+// appending, rather than on the first outage.
+func checkRequestLogSpool(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("REQUEST_LOG_SPOOL: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// ==================== Log throttling ====================
+
+// logThrottle collapses a message that keeps recurring: the first
+// occurrence is logged, repeats within the window are only counted, and
+// the count is logged as a summary when the window closes.
+type logThrottle struct {
+	window time.Duration // 0 logs everything
+
+	mu      sync.Mutex
+	entries map[uint64]*throttledMessage // message hash -> entry
+}
+
+type throttledMessage struct {
+	text       string
+	since      time.Time
+	suppressed int
+}
+
+func newLogThrottle(window time.Duration) *logThrottle {
+	return &logThrottle{window: window, entries: make(map[uint64]*throttledMessage)}
+}
+
+func messageHash(text string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	return h.Sum64()
+}
+
+// Printf logs like log.Printf unless the same message was logged less
+// than a window ago.
+func (t *logThrottle) Printf(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if t.window <= 0 {
+		log.Print(text)
+		return
+	}
+
+	key := messageHash(text)
+	now := time.Now()
+	t.mu.Lock()
+	e, ok := t.entries[key]
+	if ok && now.Sub(e.since) < t.window {
+		e.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	t.entries[key] = &throttledMessage{text: text, since: now}
+	t.mu.Unlock()
+
+	if ok {
+		logSuppressed(e)
+	}
+	log.Print(text)
+}
+
+// flush summarizes and forgets messages whose window has closed.
+func (t *logThrottle) flush(now time.Time) {
+	t.mu.Lock()
+	var done []*throttledMessage
+	for key, e := range t.entries {
+		if now.Sub(e.since) >= t.window {
+			done = append(done, e)
+			delete(t.entries, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, e := range done {
+		logSuppressed(e)
+	}
+}
+
+func logSuppressed(e *throttledMessage) {
+	if e.suppressed > 0 {
+		log.Printf("%d more occurrences since %s of: %s", e.suppressed, e.since.Format(time.TimeOnly), e.text)
+	}
+}
+
+// run flushes once per window, so a count is reported even if the message
+// stops recurring.
+func (t *logThrottle) run() {
+	if t.window <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.flush(now)
+	}
+}
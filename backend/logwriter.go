@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ==================== Request log writer ====================
+
+// maxLogBatch bounds LOG_BATCH_SIZE; each row takes requestLogParams of
+// Postgres' 65535 bind parameters.
+const maxLogBatch = 1000
+
+const requestLogParams = 20
+
+// requestLogEntry is one request_logs row waiting to be written. username
+// is already the stored form (see logUsername).
+type requestLogEntry struct {
+	username string
+	req      ModelRequest
+	success  bool
+	results  []SimulationResult
+	raw      []byte // nil unless STORE_RAW_OUTPUT keeps it
+	errMsg   string
+	duration time.Duration
+	source   string // "" for a run of the caller's own, else logSourceCached or logSourceShared
+}
+
+// logRequest records a finished run in request_logs. With a queue the row
+// is handed to writeRequestLogs and the caller doesn't wait on the
+// database; when the queue is full the row is dropped and counted. raw is
+// only kept with STORE_RAW_OUTPUT, and then only up to
+// RAW_OUTPUT_MAX_BYTES, since a cut-off output can't be parsed again.
+// Without a database the row goes to REQUEST_LOG_SPOOL, if set.
+func (s *Server) logRequest(username string, req ModelRequest, success bool, results []SimulationResult, raw []byte, errMsg string, duration time.Duration, source string) {
+	cfg := s.config()
+	if s.database() == nil && cfg.RequestLogSpool == "" {
+		return
+	}
+	if !cfg.StoreRawOutput || cfg.RawOutputMaxBytes > 0 && len(raw) > cfg.RawOutputMaxBytes {
+		raw = nil
+	}
+	e := requestLogEntry{s.logUsername(username), req, success, results, raw, errMsg, duration, source}
+
+	s.logQueueMu.RLock()
+	defer s.logQueueMu.RUnlock()
+	if s.logQueue == nil || s.logClosed {
+		s.insertRequestLogs([]requestLogEntry{e})
+		return
+	}
+	select {
+	case s.logQueue <- e:
+	default:
+		s.metrics.inc(s.metrics.droppedLogs, "")
+		s.errorLog.Printf("Request log queue full (%d rows), dropping a row", cap(s.logQueue))
+	}
+}
+
+// writeRequestLogs drains the queue until closeRequestLogs, inserting
+// whatever has piled up since the last write in one statement of at most
+// batchSize rows.
+func (s *Server) writeRequestLogs(queue <-chan requestLogEntry, batchSize int) {
+	defer close(s.logWriterDone)
+	for e := range queue {
+		batch := []requestLogEntry{e}
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case e, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		s.insertRequestLogs(batch)
+	}
+}
+
+// closeRequestLogs stops queueing, waits up to timeout for the rows
+// already queued to be written and reports how many were left behind.
+// Runs that finish afterwards write their row inline.
+func (s *Server) closeRequestLogs(timeout time.Duration) {
+	if s.logQueue == nil {
+		return
+	}
+	s.logQueueMu.Lock()
+	if s.logClosed {
+		s.logQueueMu.Unlock()
+		return
+	}
+	s.logClosed = true
+	close(s.logQueue)
+	s.logQueueMu.Unlock()
+
+	select {
+	case <-s.logWriterDone:
+		log.Println("Request log queue flushed")
+	case <-time.After(timeout):
+		log.Printf("Gave up flushing the request log queue, %d rows not written", len(s.logQueue))
+	}
+}
+
+// insertRequestLogs writes batch as one multi-row INSERT. When the
+// database is down the rows are spooled if REQUEST_LOG_SPOOL is set, and
+// dropped otherwise.
+func (s *Server) insertRequestLogs(batch []requestLogEntry) {
+	db := s.database()
+	if db == nil {
+		if s.spoolRequestLogs(batch) {
+			return
+		}
+		s.metrics.add(s.metrics.droppedLogs, "", float64(len(batch)))
+		s.errorLog.Printf("Database not connected, dropping %d request log rows", len(batch))
+		return
+	}
+
+	if err := execRequestLogs(db, batch); err != nil {
+		// An insert the database refused while it is up is not retried.
+		if pingDatabase(db) != nil && s.spoolRequestLogs(batch) {
+			return
+		}
+		s.metrics.add(s.metrics.droppedLogs, "", float64(len(batch)))
+		s.errorLog.Printf("Failed to log request: %v", err)
+	}
+}
+
+// execRequestLogs is the INSERT behind insertRequestLogs.
+func execRequestLogs(db *sql.DB, batch []requestLogEntry) error {
+	values := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, len(batch)*requestLogParams)
+	for i, e := range batch {
+		var resultsJSON interface{} // NULL unless there are results
+		if len(e.results) > 0 {
+			if b, err := json.Marshal(e.results); err != nil {
+				log.Printf("Failed to encode results for log: %v", err)
+			} else {
+				resultsJSON = string(b)
+			}
+		}
+		var raw interface{} // NULL unless kept
+		if e.raw != nil {
+			raw = string(e.raw)
+		}
+		p := make([]string, requestLogParams)
+		for j := range p {
+			p[j] = fmt.Sprintf("$%d", i*requestLogParams+j+1)
+		}
+		p[11] = "NULLIF(" + p[11] + ", '')" // project
+		p[19] = "NULLIF(" + p[19] + ", '')" // result_source
+		values = append(values, "("+strings.Join(p, ", ")+")")
+		// The requested parameters stay NULL for runs the server derived.
+		var requested [5]interface{}
+		var adjusted interface{}
+		if rp := e.req.Requested; rp != nil {
+			requested = [5]interface{}{rp.Scenario, rp.DrillingRate, rp.OilPrice, rp.ExchangeRate, nil}
+			if rp.OilPriceCurrency != "" {
+				requested[4] = rp.OilPriceCurrency
+			}
+			adjusted = e.req.adjusted()
+		}
+		args = append(args, e.username, e.req.Scenario, e.req.DrillingRate, e.req.OilPrice, e.req.ExchangeRate, e.success,
+			len(e.results), e.errMsg, resultsJSON, e.duration.Milliseconds(), e.req.Seed, e.req.Project, raw,
+			requested[0], requested[1], requested[2], requested[3], requested[4], adjusted, e.source)
+	}
+
+	query := `INSERT INTO request_logs (username, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, error_msg, results, duration_ms, seed, project, raw_output,
+				requested_scenario, requested_drilling_rate, requested_oil_price, requested_exchange_rate, requested_oil_price_currency, params_adjusted, result_source)
+			  VALUES ` + strings.Join(values, ", ")
+	_, err := db.Exec(query, args...)
+	return err
+}
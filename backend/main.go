@@ -1,32 +1,76 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ==================== Types ====================
 
+// serverVersion is reported by /api/status and the OpenAPI spec.
+const serverVersion = "2.0.0"
+
 type ModelRequest struct {
 	Scenario     int     `json:"scenario"`
 	DrillingRate int     `json:"drillingRate"`
 	OilPrice     float64 `json:"oilPrice"`
 	ExchangeRate float64 `json:"exchangeRate"`
+	// OilPriceCurrency is the currency OilPrice was sent in; validation
+	// converts the price to USD and clears it.
+	OilPriceCurrency string `json:"oilPriceCurrency,omitempty"`
+	// Seed fixes the model's random seed; nil lets the model choose.
+	Seed *int64 `json:"seed,omitempty"`
+	// Project comes from the PROJECT_HEADER request header, never the body.
+	Project string `json:"-"`
+	// Requested is what the client sent, before validateModelRequest
+	// filled in defaults; nil for runs the server made up itself.
+	Requested *RequestedParams `json:"-"`
+}
+
+// RequestedParams are run parameters as the client sent them; zero means
+// left out.
+type RequestedParams struct {
+	Scenario     int     `json:"scenario"`
+	DrillingRate int     `json:"drillingRate"`
+	OilPrice     float64 `json:"oilPrice"`
+	ExchangeRate float64 `json:"exchangeRate"`
+	// OilPriceCurrency is set when OilPrice was not in USD.
+	OilPriceCurrency string `json:"oilPriceCurrency,omitempty"`
+}
+
+// adjusted reports whether validation changed any parameter the client
+// sent, or filled in one it left out.
+func (req ModelRequest) adjusted() bool {
+	p := req.Requested
+	return p != nil && (p.Scenario != req.Scenario || p.DrillingRate != req.DrillingRate ||
+		p.OilPrice != req.OilPrice || p.ExchangeRate != req.ExchangeRate)
 }
 
 type SimulationResult struct {
@@ -42,6 +86,7 @@ type APIResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 }
 
@@ -50,6 +95,44 @@ type User struct {
 	Password string `json:"password"`
 }
 
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// PasswordRuleError names the password policy rule that was violated.
+type PasswordRuleError struct {
+	Rule    string
+	Message string
+}
+
+func (e *PasswordRuleError) Error() string {
+	return e.Message
+}
+
+// Session is a logged-in token. Sessions keep a fixed expiry; nothing
+// extends them.
+type Session struct {
+	Username  string
+	ExpiresAt time.Time
+	// RefreshToken is the refresh token this access token was minted
+	// from, empty for a plain login token.
+	RefreshToken string
+}
+
+// TokenStatus is the body of /api/token/verify.
+type TokenStatus struct {
+	Valid      bool       `json:"valid"`
+	Status     string     `json:"status"` // valid, expiring, expired or invalid
+	Username   string     `json:"username,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	TTLSeconds int64      `json:"ttlSeconds"`
+}
+
+// sessionExpiringWindow is how close to expiry a token is reported as
+// "expiring" so clients can prompt for a fresh login.
+const sessionExpiringWindow = 5 * time.Minute
+
 type RequestLog struct {
 	ID           int       `json:"id"`
 	Username     string    `json:"username"`
@@ -61,20 +144,64 @@ type RequestLog struct {
 	Success      bool      `json:"success"`
 	ResultCount  int       `json:"resultCount"`
 	Error        string    `json:"error,omitempty"`
+	Seed         *int64    `json:"seed,omitempty"`
+	Project      string    `json:"project,omitempty"`
+	// Requested and Adjusted show where the effective parameters above
+	// differ from what was sent; runs logged before they were recorded
+	// have neither.
+	Requested *RequestedParams `json:"requested,omitempty"`
+	Adjusted  bool             `json:"adjusted,omitempty"`
+	// Source is "cached" or "shared" when the results weren't from a run
+	// of the caller's own.
+	Source string `json:"source,omitempty"`
 }
 
-// ==================== Global State ====================
+// seedUsers creates the initial accounts. The admin comes from
+// ADMIN_USER/ADMIN_PASSWORD; outside prod the well-known demo accounts are
+// used when those aren't set.
+func (s *Server) seedUsers() error {
+	cfg := s.config()
+	name, password := cfg.seedAdmin()
+	if name == "" {
+		log.Println("WARNING: ADMIN_USER/ADMIN_PASSWORD not set, no admin account was created")
+	} else if err := s.addSeedUser(name, password); err != nil {
+		return err
+	} else if cfg.AdminUser != "" && cfg.AdminPassword != "" {
+		log.Printf("Seeded admin user '%s' from environment", cfg.AdminUser)
+	} else {
+		log.Println("**************************************************************")
+		log.Println("WARNING: using insecure default admin credentials admin/admin123")
+		log.Println("         set ADMIN_USER and ADMIN_PASSWORD before deploying")
+		log.Println("**************************************************************")
+	}
 
-var (
-	db       *sql.DB
-	users    = make(map[string]string) // username -> password
-	sessions = make(map[string]string) // token -> username
-	mu       sync.RWMutex
-)
+	if !cfg.isProd() {
+		if err := s.addSeedUser("user", "user123"); err != nil {
+			return err
+		}
+		log.Println("WARNING: demo account user/user123 is enabled (APP_ENV=dev)")
+	}
+	return nil
+}
+
+func (s *Server) addSeedUser(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hash password for %s: %w", username, err)
+	}
+	s.mu.Lock()
+	s.users[username] = hash
+	s.mu.Unlock()
+	return nil
+}
 
-func init() {
-	users["admin"] = "admin123"
-	users["user"] = "user123"
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
 func main() {
@@ -84,56 +211,192 @@ func main() {
 	}
 	projectRoot := filepath.Dir(wd)
 
+	cfg, err := loadConfig(projectRoot)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if cfg.LogFile != "" {
+		if err := openLogFile(cfg.LogFile); err != nil {
+			log.Fatal("Failed to open LOG_FILE: ", err)
+		}
+	}
+	if err := checkRequestLogSpool(cfg.RequestLogSpool); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Running with APP_ENV=%s", cfg.AppEnv)
+
 	// Connect to PostgreSQL
-	connStr := "host=localhost port=5432 user=postgres password=postgres dbname=AnyLogicDB sslmode=disable"
-	db, err = sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	dbReady := false
 	if err != nil {
 		log.Printf("Warning: Failed to connect to database: %v", err)
+		db = nil
+	} else if err := db.Ping(); err != nil {
+		log.Printf("Warning: Database ping failed: %v", err)
 	} else {
-		if err := db.Ping(); err != nil {
-			log.Printf("Warning: Database ping failed: %v", err)
+		log.Println("Connected to PostgreSQL database")
+		dbReady = true
+	}
+
+	var dbReplica *sql.DB
+	if cfg.DatabaseReplicaURL != "" {
+		dbReplica, err = sql.Open("postgres", cfg.DatabaseReplicaURL)
+		if err != nil {
+			log.Printf("Warning: Failed to connect to read replica: %v", err)
+			dbReplica = nil
+		} else if err := dbReplica.Ping(); err != nil {
+			log.Printf("Warning: Read replica ping failed, reads will fall back to primary: %v", err)
 		} else {
-			log.Println("Connected to PostgreSQL database")
-			initDatabase()
+			log.Println("Connected to PostgreSQL read replica")
 		}
 	}
 
+	live := newLiveConfig(cfg)
+	metrics := newMetricsRegistry()
+	srv := newServer(live, db, dbReplica, FallbackModelRunner{cfg: live, metrics: metrics}, metrics)
+	if err := srv.seedUsers(); err != nil {
+		log.Fatal("Failed to seed users: ", err)
+	}
+	if dbReady {
+		srv.prepareDatabase()
+		go srv.replaySpooledLogs()
+	}
+	if cfg.DBHealthInterval > 0 {
+		go srv.watchDatabase(cfg.DBHealthInterval)
+	}
+	go srv.errorLog.run()
+
+	logModelCommands(cfg)
+	jar := checkModelJar(filepath.Join(cfg.ModelDir, "model.jar"))
+	srv.setModelJar(jar)
+	switch {
+	case jar.Valid:
+		log.Printf("Model jar OK: %s (%d bytes, modified %s, sha256 %s)", jar.Path, jar.Size, jar.ModTime.Format(time.RFC3339), jar.SHA256)
+	case cfg.usesModelJar():
+		log.Printf("WARNING: model jar is unusable, model runs will fail: %s: %s", jar.Path, jar.Error)
+	}
+	if cfg.ModelWarmup {
+		go func() { logWarmup(srv.warmModel()) }()
+	}
+	if cfg.DiskCacheDir != "" {
+		if err := os.MkdirAll(cfg.DiskCacheDir, 0750); err != nil {
+			log.Fatal("Failed to create RESULT_CACHE_DIR: ", err)
+		}
+		srv.trimDiskCache()
+		log.Printf("Disk result cache: %s (TTL %s)", cfg.DiskCacheDir, cfg.DiskCacheTTL)
+	}
+
 	fmt.Println("==========================================")
 	fmt.Println("  Oil Company Model Server v2.0")
 	fmt.Println("==========================================")
 	fmt.Println("  Project root:", projectRoot)
+	fmt.Println("  Model dir:", cfg.ModelDir)
+	fmt.Println("  Model output:", cfg.ModelOutputMode)
 	fmt.Println()
 	fmt.Println("  API Endpoints:")
 	fmt.Println("    POST /api/login      - Login")
 	fmt.Println("    POST /api/register   - Register new user")
 	fmt.Println("    POST /api/logout     - Logout")
+	fmt.Println("    POST /api/refresh    - New access token from a refresh token")
+	fmt.Println("    GET  /api/token/verify - Check token validity and TTL")
+	fmt.Println("    POST /api/change-password - Change password (auth required)")
 	fmt.Println("    POST /api/run-model  - Run simulation (auth required)")
+	fmt.Println("    POST /api/compare    - Run several scenarios side by side (auth required)")
+	fmt.Println("    POST /api/estimate   - Expected duration of a sweep (auth required)")
+	fmt.Println("    POST /api/sensitivity - Revenue sensitivity to each parameter (auth required)")
+	fmt.Println("    GET|PUT /api/preferences - Default output format (auth required)")
 	fmt.Println("    GET  /api/history    - Request history (auth required)")
+	fmt.Println("    GET  /api/history/curves - One metric by year across recent runs (auth required)")
+	fmt.Println("    POST /api/history/{id}/baseline - Mark run as baseline (auth required)")
+	fmt.Println("    POST /api/history/{id}/reparse - Parse a run's stored output again (auth required)")
+	fmt.Println("    POST /api/history/{id}/share - Signed read-only link to a run (auth required)")
+	fmt.Println("    GET  /api/history/{id}/report.html - A run as a standalone HTML report (auth required)")
+	fmt.Println("    GET  /api/shared/{token} - Results behind a share link")
+	fmt.Println("    POST /api/history/import - Bulk-import history rows (admin)")
+	fmt.Println("    POST /api/history/timeline - Signed iCalendar feed URL for your runs (auth required)")
+	fmt.Println("    GET  /api/history/timeline.ics - Run history as iCalendar, ?token= from the above")
+	fmt.Println("    GET  /api/export     - Download a run as CSV, XLSX or Parquet (auth required)")
+	fmt.Println("    POST /api/report     - Download several runs as one CSV, XLSX or JSON report (auth required)")
+	fmt.Println("    POST /api/jobs       - Submit async simulation (auth required)")
+	fmt.Println("    GET  /api/jobs/{id}  - Job status and results (auth required)")
+	fmt.Println("    DELETE /api/jobs/{id} - Cancel a running job (auth required)")
+	fmt.Println("    GET  /api/jobs/{id}/tail - Rows a job has produced so far (auth required)")
+	fmt.Println("    GET  /api/scenarios  - Available scenarios")
 	fmt.Println("    GET  /api/status     - Server status")
+	fmt.Println("    GET  /api/ready      - Readiness check")
+	fmt.Println("    GET  /api/openapi.json - OpenAPI 3 description of this API")
+	fmt.Println("    GET  /api/stats/result-sizes - Result count histogram (admin)")
+	fmt.Println("    GET  /api/metrics.json - Metrics as JSON (admin)")
+	fmt.Println("    GET  /metrics        - Prometheus metrics")
+	fmt.Println("    POST /api/admin/maintenance - Toggle maintenance mode (admin)")
+	fmt.Println("    GET  /api/admin/running - Model runs in progress (admin)")
+	fmt.Println("    POST /api/admin/cache/invalidate - Drop cached results matching a filter (admin)")
+	fmt.Println("    POST /api/admin/warm - Check java and preload the model classpath (admin)")
+	fmt.Println("    GET  /api/admin/model/check - Self-test of the model setup, ?run=true for a trial run (admin)")
+	fmt.Println("    GET  /api/admin/stream/requests - Live feed of finished model runs, SSE (admin)")
+	fmt.Println("    GET  /api/admin/logs - Tail or download the server log (admin)")
+	fmt.Println("    GET  /api/admin/config - Effective configuration, secrets redacted (admin)")
+	fmt.Println("    POST /api/admin/users/{name}/disable|enable - Switch an account off or on (admin)")
+	fmt.Println("    GET  /api/admin/apikeys - List service account API keys, masked (admin)")
+	fmt.Println("    POST /api/admin/apikeys - Create an API key (admin)")
+	fmt.Println("    DELETE /api/admin/apikeys/{id} - Revoke an API key (admin)")
+	fmt.Println("    GET  /api/admin/audit - Admin action audit trail (admin)")
 	fmt.Println()
-	fmt.Println("  Default users: admin/admin123, user/user123")
-	fmt.Println("  Frontend: http://localhost:8080")
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		scheme = "https"
+	}
+	fmt.Printf("  Frontend: %s://localhost:8080\n", scheme)
 	fmt.Println("==========================================")
 
 	frontendDir := filepath.Join(projectRoot, "frontend")
 	os.MkdirAll(frontendDir, 0755)
 
-	http.HandleFunc("/", handleStatic(projectRoot))
-	http.HandleFunc("/api/login", handleLogin)
-	http.HandleFunc("/api/register", handleRegister)
-	http.HandleFunc("/api/logout", handleLogout)
-	http.HandleFunc("/api/run-model", authMiddleware(handleRunModel(projectRoot)))
-	http.HandleFunc("/api/history", authMiddleware(handleHistory))
-	http.HandleFunc("/api/status", handleStatus)
+	if cfg.ShareSecret == "" {
+		log.Printf("SHARE_SECRET not set, share links will stop working on restart")
+	}
 
-	log.Println("Server starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	go srv.sweepSessions()
+	go srv.sweepJobs()
+	go srv.reloadOnSIGHUP(projectRoot)
+
+	log.Printf("Server starting on :8080 (%s)...", scheme)
+	hs := srv.httpServer(":8080", projectRoot)
+	hs.RegisterOnShutdown(srv.runEvents.close)
+	go shutdownOnSignal(hs, cfg.ShutdownTimeout)
+	if cfg.TLS.enabled() {
+		hs.TLSConfig = cfg.TLS.config()
+		err = hs.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	} else {
+		err = hs.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("Server failed:", err)
 	}
+	srv.closeRequestLogs(cfg.ShutdownTimeout)
 }
 
-func initDatabase() {
-	query := `
+// shutdownOnSignal stops hs gracefully on SIGINT or SIGTERM, giving
+// requests in flight up to timeout to finish.
+func shutdownOnSignal(hs *http.Server, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	log.Printf("Got %s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+}
+
+// schema is applied in order at startup; every statement must be safe to
+// re-run against an existing database.
+var schema = []struct {
+	table string
+	query string
+}{
+	{"request_logs", `
 	CREATE TABLE IF NOT EXISTS request_logs (
 		id SERIAL PRIMARY KEY,
 		username VARCHAR(255) NOT NULL,
@@ -145,48 +408,118 @@ func initDatabase() {
 		success BOOLEAN,
 		result_count INT,
 		error_msg TEXT
-	)`
-	if _, err := db.Exec(query); err != nil {
-		log.Printf("Failed to create request_logs table: %v", err)
-	} else {
-		log.Println("Database table 'request_logs' ready")
-	}
+	)`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS results JSONB`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS duration_ms INT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS seed BIGINT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS project TEXT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS raw_output TEXT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS requested_scenario INT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS requested_drilling_rate INT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS requested_oil_price DOUBLE PRECISION`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS requested_exchange_rate DOUBLE PRECISION`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS requested_oil_price_currency TEXT`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS params_adjusted BOOLEAN`},
+	{"request_logs", `ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS result_source TEXT`},
+	{"users", `
+	CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`},
+	{"users", `ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE`},
+	{"scenarios", `
+	CREATE TABLE IF NOT EXISTS scenarios (
+		id INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		drilling_rate INT NOT NULL DEFAULT 50,
+		oil_price DOUBLE PRECISION NOT NULL DEFAULT 80,
+		exchange_rate DOUBLE PRECISION NOT NULL DEFAULT 75
+	)`},
+	{"user_baselines", `
+	CREATE TABLE IF NOT EXISTS user_baselines (
+		username VARCHAR(255) PRIMARY KEY,
+		request_id INT NOT NULL REFERENCES request_logs(id) ON DELETE CASCADE,
+		set_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`},
+	{"preferences", `
+	CREATE TABLE IF NOT EXISTS preferences (
+		username VARCHAR(255) PRIMARY KEY,
+		output_format TEXT NOT NULL DEFAULT 'json',
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`},
+	{"api_keys", `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id VARCHAR(32) PRIMARY KEY,
+		key_hash TEXT NOT NULL UNIQUE,
+		hint TEXT NOT NULL,
+		account VARCHAR(255) NOT NULL,
+		scopes TEXT NOT NULL,
+		created_by VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`},
+	{"admin_audit", `
+	CREATE TABLE IF NOT EXISTS admin_audit (
+		id SERIAL PRIMARY KEY,
+		timestamp TIMESTAMP NOT NULL,
+		admin VARCHAR(255) NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT,
+		status INT NOT NULL,
+		success BOOLEAN NOT NULL,
+		error_msg TEXT,
+		request_id TEXT
+	)`},
+	{"admin_audit", `CREATE INDEX IF NOT EXISTS admin_audit_admin_idx ON admin_audit (admin, id)`},
 }
 
-func logRequest(username string, req ModelRequest, success bool, resultCount int, errMsg string) {
-	if db == nil {
-		return
-	}
-	query := `INSERT INTO request_logs (username, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, error_msg)
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := db.Exec(query, username, req.Scenario, req.DrillingRate, req.OilPrice, req.ExchangeRate, success, resultCount, errMsg)
-	if err != nil {
-		log.Printf("Failed to log request: %v", err)
+// initDatabase applies the schema, reporting whether all of it went in.
+func (s *Server) initDatabase() bool {
+	for _, st := range schema {
+		if _, err := s.database().Exec(st.query); err != nil {
+			log.Printf("Failed to set up %s table: %v", st.table, err)
+			return false
+		}
 	}
+	log.Println("Database tables ready")
+	return true
 }
 
-func getRequestHistory(username string) ([]RequestLog, error) {
-	if db == nil {
-		return nil, fmt.Errorf("database not connected")
+// logUsername is the identity stored in request_logs: the raw username, or
+// a salted HMAC of it when anonymization is on.
+func (s *Server) logUsername(username string) string {
+	if !s.config().AnonymizeUsernames {
+		return username
 	}
+	mac := hmac.New(sha256.New, []byte(s.config().UsernameSalt))
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	query := `SELECT id, username, timestamp, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, COALESCE(error_msg, '')
-			  FROM request_logs WHERE username = $1 ORDER BY timestamp DESC LIMIT 50`
-	rows, err := db.Query(query, username)
-	if err != nil {
-		return nil, err
+// queryRead runs a read-only query on the replica when one is configured,
+// retrying on the primary if the replica fails. Lookups of one run,
+// baseline or setting go to the primary instead: the caller has often
+// just written it, and a lagging replica would answer "not found".
+func (s *Server) queryRead(query string, args ...interface{}) (*sql.Rows, error) {
+	if s.dbReplica != nil {
+		rows, err := s.dbReplica.Query(query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		s.errorLog.Printf("Read replica query failed, using primary: %v", err)
+	}
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
 	}
-	defer rows.Close()
+	return s.database().Query(query, args...)
+}
 
-	var logs []RequestLog
-	for rows.Next() {
-		var l RequestLog
-		if err := rows.Scan(&l.ID, &l.Username, &l.Timestamp, &l.Scenario, &l.DrillingRate, &l.OilPrice, &l.ExchangeRate, &l.Success, &l.ResultCount, &l.Error); err != nil {
-			continue
-		}
-		logs = append(logs, l)
+func databaseStatus(d *sql.DB) string {
+	if d != nil && d.Ping() == nil {
+		return "connected"
 	}
-	return logs, nil
+	return "disconnected"
 }
 
 func generateToken() string {
@@ -195,143 +528,518 @@ func generateToken() string {
 	return hex.EncodeToString(b)
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
 	if r.Method == "OPTIONS" {
 		return
 	}
 	if r.Method != "POST" {
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		sendError(w, "Invalid JSON", http.StatusBadRequest)
+	if err := s.decodeJSON(r, &user); err != nil {
+		s.sendDecodeError(w, r, err)
 		return
 	}
 
-	mu.RLock()
-	password, exists := users[user.Username]
-	mu.RUnlock()
-
-	if !exists || password != user.Password {
-		sendError(w, "Invalid username or password", http.StatusUnauthorized)
+	hash, exists := s.lookupPasswordHash(user.Username)
+	if !exists || !checkPassword(hash, user.Password) {
+		s.sendError(w, r, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if s.isDisabled(user.Username) {
+		s.sendErrorCode(w, r, "Account is disabled, contact an administrator", "account_disabled", http.StatusForbidden)
 		return
 	}
 
-	token := generateToken()
-	mu.Lock()
-	sessions[token] = user.Username
-	mu.Unlock()
+	data := map[string]interface{}{"username": user.Username}
+	if r.URL.Query().Get("refresh") == "true" {
+		refreshToken, refreshExpiresAt := s.newRefreshSession(user.Username)
+		data["token"], data["expiresAt"] = s.newSession(user.Username, refreshToken, s.config().AccessTokenTTL)
+		data["refreshToken"] = refreshToken
+		data["refreshExpiresAt"] = refreshExpiresAt
+	} else {
+		data["token"], data["expiresAt"] = s.newSession(user.Username, "", s.config().SessionTTL)
+	}
 
 	log.Printf("User '%s' logged in", user.Username)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Login successful",
-		Data: map[string]string{
-			"token":    token,
-			"username": user.Username,
-		},
+		Data:    data,
 	})
 }
 
-func handleRegister(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
 	if r.Method == "OPTIONS" {
 		return
 	}
 	if r.Method != "POST" {
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		sendError(w, "Invalid JSON", http.StatusBadRequest)
+	if err := s.decodeJSON(r, &user); err != nil {
+		s.sendDecodeError(w, r, err)
 		return
 	}
 
-	if len(user.Username) < 3 || len(user.Password) < 4 {
-		sendError(w, "Username must be 3+ chars, password 4+ chars", http.StatusBadRequest)
+	if len(user.Username) < 3 {
+		s.sendError(w, r, "Username must be 3+ chars", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(user.Username, serviceAccountPrefix) {
+		s.sendError(w, r, "Usernames starting with "+serviceAccountPrefix+" are reserved for service accounts", http.StatusBadRequest)
+		return
+	}
+	// An ADMIN_USERS name nobody holds yet would make its registrant an
+	// admin; one that is held is taken anyway.
+	if s.isAdmin(user.Username) {
+		s.sendError(w, r, "Username is reserved", http.StatusForbidden)
+		return
+	}
+	if err := validatePassword(s.config().PasswordPolicy, user.Password); err != nil {
+		s.sendPasswordError(w, r, err)
 		return
 	}
 
-	mu.Lock()
-	if _, exists := users[user.Username]; exists {
-		mu.Unlock()
-		sendError(w, "Username already exists", http.StatusConflict)
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		s.sendError(w, r, "Failed to store password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.createUser(user.Username, hash); err != nil {
+		if errors.Is(err, errUserExists) {
+			s.sendError(w, r, "Username already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to register '%s': %v", user.Username, err)
+		s.sendError(w, r, "Failed to register user", http.StatusInternalServerError)
 		return
 	}
-	users[user.Username] = user.Password
-	mu.Unlock()
 
 	log.Printf("New user registered: '%s'", user.Username)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Registration successful. Please login.",
 	})
 }
 
-func handleLogout(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+
+	var req ChangePasswordRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+
+	// Check the old password before spending a bcrypt round on the new one.
+	current, _ := s.lookupPasswordHash(username)
+	if !checkPassword(current, req.OldPassword) {
+		s.sendError(w, r, "Current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	if err := validatePassword(s.config().PasswordPolicy, req.NewPassword); err != nil {
+		s.sendPasswordError(w, r, err)
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		s.sendError(w, r, "Failed to store password", http.StatusInternalServerError)
+		return
+	}
+	if err := s.updatePasswordHash(username, hash); err != nil {
+		log.Printf("Failed to change password for '%s': %v", username, err)
+		s.sendError(w, r, "Failed to store password", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User '%s' changed password", username)
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Password changed",
+	})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
 	if r.Method == "OPTIONS" {
 		return
 	}
 
-	token := r.Header.Get("Authorization")
-	if strings.HasPrefix(token, "Bearer ") {
-		token = strings.TrimPrefix(token, "Bearer ")
+	token := bearerToken(r)
+	s.mu.RLock()
+	session := s.sessions[token]
+	s.mu.RUnlock()
+
+	refreshToken, err := s.logoutRefreshToken(r, session)
+	if err != nil {
+		s.sendDecodeError(w, r, err)
+		return
 	}
 
-	mu.Lock()
-	delete(sessions, token)
-	mu.Unlock()
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+	if refreshToken != "" {
+		n := s.revokeRefreshToken(refreshToken)
+		log.Printf("Refresh token revoked along with %d access tokens", n)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Logged out",
 	})
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// handleTokenVerify reports on the bearer token without touching the
+// session. It always answers 200 so clients can branch on the status field.
+func (s *Server) handleTokenVerify(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := bearerToken(r)
+	s.mu.RLock()
+	session, exists := s.sessions[token]
+	s.mu.RUnlock()
+
+	status := TokenStatus{Status: "invalid"}
+	if exists && token != "" {
+		expiresAt := session.ExpiresAt
+		remaining := time.Until(expiresAt)
+		status.Username = session.Username
+		status.ExpiresAt = &expiresAt
+		switch {
+		case remaining <= 0:
+			status.Status = "expired"
+		case remaining < sessionExpiringWindow:
+			status.Valid = true
+			status.Status = "expiring"
+			status.TTLSeconds = int64(remaining.Seconds())
+		default:
+			status.Valid = true
+			status.Status = "valid"
+			status.TTLSeconds = int64(remaining.Seconds())
+		}
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    status,
+	})
+}
+
+// sweepSessions drops sessions that expired over an hour ago. Recently
+// expired ones are kept so /api/token/verify can still say "expired".
+func (s *Server) sweepSessions() {
+	for range time.Tick(10 * time.Minute) {
+		cutoff := time.Now().Add(-time.Hour)
+		s.mu.Lock()
+		for token, session := range s.sessions {
+			if session.ExpiresAt.Before(cutoff) {
+				delete(s.sessions, token)
+			}
+		}
+		for token, refresh := range s.refreshSessions {
+			if refresh.ExpiresAt.Before(cutoff) {
+				delete(s.refreshSessions, token)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		setCORSHeaders(w)
+		s.setCORSHeaders(w, r)
 		if r.Method == "OPTIONS" {
 			return
 		}
 
-		token := r.Header.Get("Authorization")
-		if strings.HasPrefix(token, "Bearer ") {
-			token = strings.TrimPrefix(token, "Bearer ")
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			if r = s.authenticateAPIKey(w, r, key); r != nil {
+				next(w, r)
+			}
+			return
 		}
 
-		mu.RLock()
-		username, exists := sessions[token]
-		mu.RUnlock()
+		token := bearerToken(r)
 
-		if !exists || token == "" {
-			sendError(w, "Unauthorized. Please login.", http.StatusUnauthorized)
+		s.mu.RLock()
+		session, exists := s.sessions[token]
+		revoked := exists && s.sessionRevoked(session)
+		s.mu.RUnlock()
+
+		if !exists || token == "" || revoked {
+			s.sendError(w, r, "Unauthorized. Please login.", http.StatusUnauthorized)
+			return
+		}
+		if time.Now().After(session.ExpiresAt) {
+			s.sendError(w, r, "Session expired. Please login.", http.StatusUnauthorized)
 			return
 		}
 
 		// Add username to request context via header (simple approach)
-		r.Header.Set("X-Username", username)
+		r.Header.Set("X-Username", session.Username)
+		next(w, r)
+	}
+}
+
+func (s *Server) securityHeadersMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sh := s.config().SecurityHeaders
+		if sh.Enabled {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if sh.FrameOptions != "" {
+				w.Header().Set("X-Frame-Options", sh.FrameOptions)
+			}
+			if sh.ContentSecurityPolicy != "" {
+				w.Header().Set("Content-Security-Policy", sh.ContentSecurityPolicy)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// requestIDMiddleware tags every request with an ID, reusing the caller's
+// X-Request-ID when it sends one, and echoes it back so log lines can be
+// matched to client reports.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = generateToken()[:16]
+			r.Header.Set("X-Request-ID", id)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trimSlashMiddleware serves /api/history/ as /api/history, and so on for
+// every API path, instead of letting it fall through to the static files.
+// The path is rewritten in place rather than redirected, since a redirect
+// would turn a POST into a GET for many clients. Other paths keep their
+// slash so frontend directories still resolve.
+func trimSlashMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if len(p) > len("/api/") && strings.HasPrefix(p, "/api/") && strings.HasSuffix(p, "/") || p == "/metrics/" {
+			r.URL.Path = strings.TrimRight(p, "/")
+			r.URL.RawPath = strings.TrimRight(r.URL.RawPath, "/")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestID(r *http.Request) string {
+	return r.Header.Get("X-Request-ID")
+}
+
+// requireJSON answers 415 when a POST or PUT carries a body not declared
+// as application/json (any charset). Bodyless POSTs such as logout pass.
+// The body is held to MAX_BODY_BYTES; see requireJSONUpTo.
+func (s *Server) requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireJSONUpTo(defaultBodyLimit, next)
+}
+
+// bodyLimit picks the setting that caps a route's request body.
+type bodyLimit func(Config) int
+
+func defaultBodyLimit(cfg Config) int { return cfg.MaxBodyBytes }
+
+func importBodyLimit(cfg Config) int { return cfg.MaxImportBodyBytes }
+
+// requireJSONUpTo is requireJSON for a route whose body may be up to
+// limit bytes. A larger body gets 413 naming the limit before the handler
+// runs; one without a Content-Length is read up to the limit first.
+func (s *Server) requireJSONUpTo(limit bodyLimit, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reject := func(msg, code string, status int) {
+			// Public handlers set CORS headers themselves, after this.
+			if w.Header().Get("Access-Control-Allow-Origin") == "" {
+				s.setCORSHeaders(w, r)
+			}
+			s.sendErrorCode(w, r, msg, code, status)
+		}
+		if (r.Method == "POST" || r.Method == "PUT") && r.ContentLength != 0 {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				reject("Content-Type must be application/json", "unsupported_media_type", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		if n := limit(s.config()); n > 0 && r.ContentLength != 0 {
+			tooLarge := fmt.Sprintf("Request body is larger than the %d byte limit for %s", n, r.URL.Path)
+			if r.ContentLength > int64(n) {
+				reject(tooLarge, "body_too_large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.ContentLength < 0 {
+				body, err := io.ReadAll(io.LimitReader(r.Body, int64(n)+1))
+				if err != nil {
+					reject("Failed to read request body: "+err.Error(), "", http.StatusBadRequest)
+					return
+				}
+				if len(body) > n {
+					reject(tooLarge, "body_too_large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
 		next(w, r)
 	}
 }
 
+// errEmptyBody is what decodeJSON returns for a request without a body,
+// which the decoder would report as a bare EOF.
+var errEmptyBody = errors.New("request body is empty")
+
+// strictJSON reports whether r's body may only hold known fields: with
+// STRICT_JSON on, unless the client sends X-Allow-Unknown-Fields: true.
+func (s *Server) strictJSON(r *http.Request) bool {
+	return s.config().StrictJSON && r.Header.Get("X-Allow-Unknown-Fields") != "true"
+}
+
+// decodeJSON decodes r's body into v, rejecting fields v doesn't have when
+// strictJSON says so.
+func (s *Server) decodeJSON(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	strict := s.strictJSON(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errEmptyBody
+		}
+		return err
+	}
+	// The decoder can't see into a type's own UnmarshalJSON.
+	if _, custom := v.(json.Unmarshaler); strict && custom {
+		return unknownField(body, v)
+	}
+	return nil
+}
+
+// unknownField returns an error naming the first top-level field of the
+// JSON object body that none of vs, pointers to structs, has. Names match
+// case-insensitively, as encoding/json matches them.
+func unknownField(body []byte, vs ...interface{}) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+	var known []string
+	for _, v := range vs {
+		known = appendJSONFields(known, reflect.TypeOf(v).Elem())
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+outer:
+	for _, name := range names {
+		for _, k := range known {
+			if strings.EqualFold(k, name) {
+				continue outer
+			}
+		}
+		return fmt.Errorf("json: unknown field %q", name)
+	}
+	return nil
+}
+
+// appendJSONFields appends the JSON names of t's fields, embedded structs
+// included.
+func appendJSONFields(names []string, t reflect.Type) []string {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			names = appendJSONFields(names, f.Type)
+		case !f.IsExported():
+		case name == "":
+			names = append(names, f.Name)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sendDecodeError answers a decodeJSON error with 400, telling an empty
+// body apart from malformed JSON.
+func (s *Server) sendDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errEmptyBody) {
+		s.sendError(w, r, "Request body is empty", http.StatusBadRequest)
+		return
+	}
+	s.sendError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+}
+
+// adminMiddleware allows only users listed in the ADMIN_USERS config, and
+// audits what they change.
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if k := requestAPIKey(r); k != nil {
+			if !k.allows(scopeAdmin) {
+				s.sendErrorCode(w, r, "API key lacks the admin scope", "insufficient_scope", http.StatusForbidden)
+				return
+			}
+		} else if !s.isAdmin(r.Header.Get("X-Username")) {
+			s.sendError(w, r, "Admin access required", http.StatusForbidden)
+			return
+		}
+		s.audited(next)(w, r)
+	})
+}
+
+func (s *Server) isAdmin(username string) bool {
+	return containsString(s.config().AdminUsers, username)
+}
+
 // ==================== Handlers ====================
 
-func handleStatic(projectRoot string) http.HandlerFunc {
+func (s *Server) handleStatic(projectRoot string) http.HandlerFunc {
 	frontendDir := filepath.Join(projectRoot, "frontend")
 	return func(w http.ResponseWriter, r *http.Request) {
-		setCORSHeaders(w)
+		s.setCORSHeaders(w, r)
 		if r.Method == "OPTIONS" {
 			return
 		}
@@ -346,6 +1054,12 @@ func handleStatic(projectRoot string) http.HandlerFunc {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
+		// Whether or not the file exists, so the allowlist can't be probed.
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fullPath), "."))
+		if !containsString(s.config().StaticExtensions, ext) {
+			http.NotFound(w, r)
+			return
+		}
 
 		switch {
 		case strings.HasSuffix(path, ".html"):
@@ -360,190 +1074,489 @@ func handleStatic(projectRoot string) http.HandlerFunc {
 	}
 }
 
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
 	if r.Method == "OPTIONS" {
 		return
 	}
 
-	dbStatus := "disconnected"
-	if db != nil && db.Ping() == nil {
-		dbStatus = "connected"
+	replicaStatus := "not configured"
+	if s.config().DatabaseReplicaURL != "" {
+		replicaStatus = databaseStatus(s.dbReplica)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Server is running",
 		Data: map[string]interface{}{
-			"timestamp": time.Now().Unix(),
-			"version":   "2.0.0",
-			"database":  dbStatus,
+			"timestamp":      time.Now().Unix(),
+			"version":        serverVersion,
+			"database":       databaseStatus(s.database()),
+			"databaseHealth": s.dbHealth.snapshot(),
+			"replica":        replicaStatus,
+			"modelJar":       s.currentModelJar(),
+			"maintenance":    s.currentMaintenance(),
+			"running":        s.countRunning(),
 		},
 	})
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
+// logModelCommands looks up MODEL_CMD and each fallback command on PATH,
+// warning about those that aren't there. Startup goes on without them, so
+// /api/ready can report the problem.
+func logModelCommands(cfg Config) {
+	if path, err := exec.LookPath(cfg.ModelCmd); err != nil {
+		log.Printf("WARNING: MODEL_CMD not found, model runs will fail: %v", err)
+	} else {
+		log.Printf("Model command: %s", path)
+	}
+	for _, b := range cfg.ModelFallbacks {
+		if path, err := exec.LookPath(b.Cmd); err != nil {
+			log.Printf("WARNING: fallback model command not found: %v", err)
+		} else {
+			log.Printf("Fallback model command: %s", path)
+		}
+	}
+}
+
+// handleReady reports whether the server can actually run the model.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	cfg := s.config()
+	if _, err := exec.LookPath(cfg.ModelCmd); err != nil {
+		s.sendError(w, r, "Model command unusable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	jar := s.currentModelJar()
+	if cfg.usesModelJar() && !jar.Valid {
+		s.sendError(w, r, "Model jar unusable: "+jar.Error, http.StatusServiceUnavailable)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Ready",
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	username := r.Header.Get("X-Username")
-	logs, err := getRequestHistory(username)
-	if err != nil {
-		sendError(w, "Failed to fetch history: "+err.Error(), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrometheus(w, s.metrics.snapshot())
+}
+
+func (s *Server) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APIResponse{
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    logs,
+		Data:    s.metrics.snapshot(),
 	})
 }
 
-func handleRunModel(projectRoot string) http.HandlerFunc {
-	modelDir := filepath.Join(projectRoot, "model")
+func (s *Server) handleRunModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.rejectIfMaintenance(w, r) {
+		return
+	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	username := r.Header.Get("X-Username")
 
-		username := r.Header.Get("X-Username")
+	var req ModelRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if err := s.validateModelRequest(&req); err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	project, err := s.requestProject(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Project = project
+
+	replications, err := parseReplications(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if replications > 0 {
+		s.handleReplications(w, r, username, req, replications)
+		return
+	}
+	format, err := s.outputFormat(r, username)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields, err := parseResultFields(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		var req ModelRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			sendError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+	wantNPV := r.URL.Query().Get("npv") == "true"
+	var rate float64
+	if wantNPV {
+		var err error
+		if rate, err = s.discountRate(r); err != nil {
+			s.sendError(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		// Validate parameters
-		if req.Scenario < 1 || req.Scenario > 3 {
-			req.Scenario = 1
-		}
-		if req.DrillingRate <= 0 {
-			req.DrillingRate = 50
-		}
-		if req.OilPrice <= 0 {
-			req.OilPrice = 80.0
+	// Check the baseline up front so a missing one doesn't cost a model run.
+	var baselineID int
+	var baseline []SimulationResult
+	vsBaseline := r.URL.Query().Get("vsBaseline") == "true"
+	if vsBaseline {
+		var err error
+		baselineID, baseline, err = s.getBaseline(username)
+		if errors.Is(err, errRunNotFound) {
+			s.sendError(w, r, "No baseline set", http.StatusBadRequest)
+			return
 		}
-		if req.ExchangeRate <= 0 {
-			req.ExchangeRate = 75.0
+		if err != nil {
+			s.sendError(w, r, "Failed to load baseline: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
 
-		log.Printf("[%s] Running model: scenario=%d, drilling=%d, oilPrice=%.2f, exchange=%.2f",
-			username, req.Scenario, req.DrillingRate, req.OilPrice, req.ExchangeRate)
+	// The scenario's default-parameter run goes alongside the caller's.
+	type baselineRun struct {
+		results []SimulationResult
+		err     error
+	}
+	var scenarioBase ModelRequest
+	var scenarioBaseRun chan baselineRun
+	if r.URL.Query().Get("vsScenarioBaseline") == "true" {
+		scenarioBase = s.scenarioBaselineRequest(req)
+		scenarioBaseRun = make(chan baselineRun, 1)
+		go func() {
+			results, err := s.scenarioBaselineResults(r.Context(), requestID(r)+"/baseline", username, scenarioBase)
+			scenarioBaseRun <- baselineRun{results, err}
+		}()
+	}
 
-		classpath := strings.Join([]string{
-			modelDir,
-			filepath.Join(modelDir, "model.jar"),
-			filepath.Join(modelDir, "lib", "*"),
-			filepath.Join(modelDir, "lib", "logging", "*"),
-			filepath.Join(modelDir, "lib", "database", "*"),
-			filepath.Join(modelDir, "lib", "database", "querydsl", "*"),
-			filepath.Join(modelDir, "lib", "database", "ucanaccess", "*"),
-		}, ":")
+	out, err := s.runModelShared(r.Context(), requestID(r), username, req)
+	if r.Context().Err() != nil {
+		log.Printf("[%s] Client went away before the response, dropping it (request %s)", username, requestID(r))
+		return
+	}
+	if err != nil {
+		status, code := modelErrorStatus(err)
+		// Admins get the command line to debug classpath and argument
+		// problems; a run turned away for lack of a slot never had one.
+		var modelErr *ModelError
+		if s.isAdmin(username) && errors.As(err, &modelErr) && !errors.Is(err, ErrServerBusy) {
+			s.sendErrorData(w, r, err.Error(), code, status, map[string]interface{}{
+				"invocation": describeModelCommand(s.config(), req),
+			})
+			return
+		}
+		s.sendErrorCode(w, r, err.Error(), code, status)
+		return
+	}
 
-		cmd := exec.Command("java",
-			"-cp", classpath,
-			"ModelRunner",
-			strconv.Itoa(req.Scenario),
-			strconv.Itoa(req.DrillingRate),
-			fmt.Sprintf("%.2f", req.OilPrice),
-			fmt.Sprintf("%.2f", req.ExchangeRate),
-		)
-		cmd.Dir = modelDir
+	var scenarioDeltas []ResultDelta
+	if scenarioBaseRun != nil {
+		run := <-scenarioBaseRun
+		if run.err != nil {
+			status, code := modelErrorStatus(run.err)
+			s.sendErrorCode(w, r, "Scenario baseline: "+run.err.Error(), code, status)
+			return
+		}
+		scenarioDeltas = diffResults(out.Results, run.results)
+	}
 
-		output, err := cmd.Output()
+	// Report the seed the model picked when the caller left it open.
+	if req.Seed == nil {
+		req.Seed = out.Seed
+	}
+	if format == outputCSV {
+		s.writeResultsCSVResponse(w, r, out)
+		return
+	}
+	data := map[string]interface{}{
+		"parameters": req,
+		"results":    out.Results,
+		"seed":       req.Seed,
+		"timestamp":  time.Now().Unix(),
+	}
+	// A converted oil price is shown next to the one that was sent.
+	if rp := req.Requested; rp != nil && rp.OilPriceCurrency != "" {
+		data["requested"] = rp
+	}
+	if len(out.Logs) > 0 {
+		data["modelLogs"] = out.Logs
+	}
+	if out.Backend != "" {
+		data["backend"] = out.Backend
+	}
+	if r.URL.Query().Get("cumulative") == "true" {
+		data["results"] = cumulativeResults(out.Results)
+	}
+	if r.URL.Query().Get("withUnits") == "true" {
+		units := resultUnits(s.config().ResultUnits)
+		results, err := withUnits(data["results"], units)
 		if err != nil {
-			errMsg := ""
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				errMsg = string(exitErr.Stderr)
-			} else {
-				errMsg = err.Error()
-			}
-			log.Printf("[%s] Model execution failed: %s", username, errMsg)
-			logRequest(username, req, false, 0, errMsg)
-			sendError(w, "Model execution failed: "+errMsg, http.StatusInternalServerError)
+			s.sendError(w, r, "Failed to attach units: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		results, err := parseCSVOutput(string(output))
+		data["results"] = results
+		data["units"] = units
+	}
+	if fields != nil {
+		results, err := projectFields(data["results"], fields)
 		if err != nil {
-			log.Printf("[%s] Failed to parse results: %v", username, err)
-			logRequest(username, req, false, 0, err.Error())
-			sendError(w, "Failed to parse results: "+err.Error(), http.StatusInternalServerError)
+			s.sendError(w, r, "Failed to select fields: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		data["results"] = results
+	}
+	if r.URL.Query().Get("include") == "raw" {
+		raw, truncated := capOutput(out.Raw, s.config().RawOutputMaxBytes)
+		data["rawCsv"] = raw
+		if truncated {
+			data["rawCsvTruncated"] = true
+		}
+	}
 
-		log.Printf("[%s] Model completed successfully, %d results", username, len(results))
-		logRequest(username, req, true, len(results), "")
+	if wantNPV {
+		data["npv"] = computeNPV(out.Results, rate)
+		data["discountRate"] = rate
+	}
+
+	if vsBaseline {
+		data["baseline"] = map[string]interface{}{
+			"id":     baselineID,
+			"deltas": diffResults(out.Results, baseline),
+		}
+	}
+	if scenarioBaseRun != nil {
+		data["scenarioBaseline"] = map[string]interface{}{
+			"parameters": scenarioBase,
+			"deltas":     scenarioDeltas,
+		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: true,
-			Message: "Simulation completed",
-			Data: map[string]interface{}{
-				"parameters": req,
-				"results":    results,
-				"timestamp":  time.Now().Unix(),
-			},
-		})
+	status := http.StatusOK
+	message := "Simulation completed"
+	if out.Duplicates > 0 {
+		data["duplicates"] = out.Duplicates
 	}
+	if out.Partial {
+		data["partial"] = true
+		status = http.StatusPartialContent
+		message = "Simulation cut short, returning partial results"
+	}
+
+	resp := APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	}
+	if format == outputMsgpack {
+		s.writeMsgpack(w, r, status, resp)
+		return
+	}
+	s.writeJSON(w, r, status, resp)
+}
+
+// writeResultsCSVResponse answers with just the results, as CSV laid out
+// like /api/export. A partial run is still 206.
+func (s *Server) writeResultsCSVResponse(w http.ResponseWriter, r *http.Request, out ModelOutput) {
+	var buf bytes.Buffer
+	if err := writeResultsCSV(&buf, out.Results); err != nil {
+		s.sendError(w, r, "Failed to encode CSV: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if out.Partial {
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Type", exportFormats["csv"].contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
 
 // ==================== Helpers ====================
 
-func parseCSVOutput(output string) ([]SimulationResult, error) {
-	var results []SimulationResult
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	lineNum := 0
+// capOutput returns at most max bytes of output as a string, reporting
+// whether anything was cut off. The cut is moved back to the start of a
+// character so a multi-byte one isn't split. A max of 0 disables the cap.
+func capOutput(output []byte, max int) (string, bool) {
+	if max <= 0 || len(output) <= max {
+		return string(output), false
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return string(output[:cut]), true
+}
+
+// bcryptMaxBytes is the longest password bcrypt accepts.
+const bcryptMaxBytes = 72
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		lineNum++
-		if line == "" || lineNum == 1 {
-			continue
-		}
+// validatePassword checks a password against policy p and returns a
+// *PasswordRuleError naming the first rule that failed.
+func validatePassword(p PasswordPolicy, password string) error {
+	n := utf8.RuneCountInString(password)
 
-		parts := strings.Split(line, ",")
-		if len(parts) < 6 {
-			continue
+	if n < p.MinLength {
+		return &PasswordRuleError{Rule: "min_length", Message: fmt.Sprintf("Password must be at least %d chars", p.MinLength)}
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return &PasswordRuleError{Rule: "max_length", Message: fmt.Sprintf("Password must be at most %d chars", p.MaxLength)}
+	}
+	// Non-ASCII characters take more than a byte, so a password within
+	// MaxLength can still be too long for bcrypt.
+	if len(password) > bcryptMaxBytes {
+		return &PasswordRuleError{Rule: "max_length", Message: fmt.Sprintf("Password must be at most %d bytes in UTF-8", bcryptMaxBytes)}
+	}
+
+	var hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			hasSymbol = true
 		}
+	}
+	if p.RequireDigit && !hasDigit {
+		return &PasswordRuleError{Rule: "digit", Message: "Password must contain a digit"}
+	}
+	if p.RequireSymbol && !hasSymbol {
+		return &PasswordRuleError{Rule: "symbol", Message: "Password must contain a symbol"}
+	}
+	return nil
+}
 
-		year, _ := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
-		scenario, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
-		revenue, _ := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
-		production, _ := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
-		newWells, _ := strconv.ParseFloat(strings.TrimSpace(parts[4]), 64)
-		oldWells, _ := strconv.ParseFloat(strings.TrimSpace(parts[5]), 64)
+func (s *Server) sendPasswordError(w http.ResponseWriter, r *http.Request, err error) {
+	code := ""
+	var ruleErr *PasswordRuleError
+	if errors.As(err, &ruleErr) {
+		code = "password_" + ruleErr.Rule
+	}
+	s.sendErrorCode(w, r, err.Error(), code, http.StatusBadRequest)
+}
 
-		results = append(results, SimulationResult{
-			Year:             year,
-			Scenario:         scenario,
-			Revenue:          revenue,
-			ProductionVolume: production,
-			NewWellsFund:     newWells,
-			OldWellsFund:     oldWells,
-		})
+// setCORSHeaders allows the request's origin if CORS_ORIGINS lists it (or
+// "*"). Other origins get no CORS headers, so browsers keep them out.
+func (s *Server) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	switch origin := r.Header.Get("Origin"); {
+	case containsString(s.config().CORSOrigins, "*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && containsString(s.config().CORSOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	default:
+		return
 	}
-	return results, scanner.Err()
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Envelope, X-Allow-Unknown-Fields, "+s.config().ProjectHeader)
 }
 
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+func (s *Server) sendError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	s.sendErrorCode(w, r, message, "", status)
 }
 
-func sendError(w http.ResponseWriter, message string, status int) {
+// writeJSON encodes v as the response body. Output is indented when the
+// client asks for it with ?pretty=true or an X-Pretty header.
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if resp, ok := v.(APIResponse); ok && resp.Success && resp.Data != nil && !s.wantEnvelope(r) {
+		v = resp.Data
+	}
+
+	var body []byte
+	var err error
+	if wantPretty(r) {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		http.Error(w, `{"success":false,"error":"Failed to encode response"}`, http.StatusInternalServerError)
+		return
+	}
+	// Errors are small; only a successful payload can run away.
+	if limit := s.config().MaxResponseBytes; limit > 0 && len(body) > limit && status < 300 {
+		log.Printf("Response for %s %s (request %s) is %d bytes, over MAX_RESPONSE_BYTES %d",
+			r.Method, r.URL.Path, requestID(r), len(body), limit)
+		s.sendErrorCode(w, r, fmt.Sprintf("Response would be %d bytes, over the %d byte limit; narrow the query (fewer years or scenarios)", len(body), limit),
+			"response_too_large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(APIResponse{
+	// The status line is already out, so all that's left to do on a failed
+	// write (usually a client that hung up) is leave a trace of it.
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		log.Printf("Failed to write response for %s %s (request %s): %v", r.Method, r.URL.Path, requestID(r), err)
+	}
+}
+
+// wantEnvelope reports whether a successful response keeps the APIResponse
+// wrapper. X-Envelope overrides the RESPONSE_ENVELOPE default; errors are
+// always wrapped.
+func (s *Server) wantEnvelope(r *http.Request) bool {
+	if envelope, err := strconv.ParseBool(r.Header.Get("X-Envelope")); err == nil {
+		return envelope
+	}
+	return s.config().ResponseEnvelope
+}
+
+func wantPretty(r *http.Request) bool {
+	if v := r.URL.Query().Get("pretty"); v != "" {
+		pretty, _ := strconv.ParseBool(v)
+		return pretty
+	}
+	pretty, _ := strconv.ParseBool(r.Header.Get("X-Pretty"))
+	return pretty
+}
+
+// sendErrorCode is sendError with a machine-readable code clients can branch on.
+//
+// Unless VERBOSE_ERRORS is on, server-side (5xx) details are only logged and
+// the client gets a generic message it can quote via the request ID.
+func (s *Server) sendErrorCode(w http.ResponseWriter, r *http.Request, message, code string, status int) {
+	s.sendErrorData(w, r, message, code, status, nil)
+}
+
+// sendErrorData is sendErrorCode with details in data, for callers that
+// have already decided the client may see them.
+func (s *Server) sendErrorData(w http.ResponseWriter, r *http.Request, message, code string, status int, data interface{}) {
+	if status >= 500 && !s.config().VerboseErrors {
+		log.Printf("%s %s failed with %d (request %s): %s", r.Method, r.URL.Path, status, requestID(r), message)
+		message = http.StatusText(status)
+	}
+	s.writeJSON(w, r, status, APIResponse{
 		Success: false,
 		Error:   message,
+		Code:    code,
+		Data:    data,
 	})
 }
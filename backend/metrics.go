@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== Metrics ====================
+
+// metricsRegistry is a minimal in-process registry. Both the Prometheus
+// text endpoint and the JSON endpoint render the same snapshot, so the two
+// formats can't drift apart.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   []*counter
+	histograms []*histogram
+	gauges     []*gauge
+
+	modelRuns     *counter
+	modelDuration *histogram
+	slowRuns      *counter
+	queueTimeouts *counter
+	droppedLogs   *counter
+	spooledLogs   *counter
+	replayedLogs  *counter
+	fallbacks     *counter
+	duplicateRows *counter
+	// endpointRejects counts the 429s from ENDPOINT_CONCURRENCY.
+	endpointRejects *counter
+}
+
+type counter struct {
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+// gauge reports whatever value returns at snapshot time. A labeled gauge
+// has values instead, one sample per label value.
+type gauge struct {
+	name   string
+	help   string
+	value  func() float64
+	label  string
+	values func() map[string]float64
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+type CounterSnapshot struct {
+	Name   string          `json:"name"`
+	Help   string          `json:"help"`
+	Values []CounterSample `json:"values"`
+}
+
+type CounterSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+type GaugeSnapshot struct {
+	Name  string  `json:"name"`
+	Help  string  `json:"help"`
+	Value float64 `json:"value"`
+	// Values holds a labeled gauge's samples; Value is then 0.
+	Values []CounterSample `json:"values,omitempty"`
+}
+
+type HistogramSnapshot struct {
+	Name    string            `json:"name"`
+	Help    string            `json:"help"`
+	Buckets []HistogramBucket `json:"buckets"`
+	Sum     float64           `json:"sum"`
+	Count   uint64            `json:"count"`
+}
+
+// HistogramBucket holds the cumulative count of observations <= UpperBound.
+type HistogramBucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+type MetricsSnapshot struct {
+	Counters   []CounterSnapshot   `json:"counters"`
+	Gauges     []GaugeSnapshot     `json:"gauges"`
+	Histograms []HistogramSnapshot `json:"histograms"`
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{}
+	m.modelRuns = m.newCounter("model_runs_total", "Model runs by outcome.", "status")
+	m.modelDuration = m.newHistogram("model_run_duration_seconds", "Model run wall-clock duration.",
+		[]float64{1, 2, 5, 10, 20, 30, 60, 120, 300})
+	m.slowRuns = m.newCounter("model_slow_runs_total", "Model runs slower than SLOW_RUN_MS.", "")
+	m.queueTimeouts = m.newCounter("model_queue_timeouts_total", "Runs turned away after QUEUE_WAIT_TIMEOUT without a free slot.", "")
+	m.fallbacks = m.newCounter("model_fallbacks_total", "Runs served by a MODEL_FALLBACK_CMDS backend after the ones before it failed.", "backend")
+	m.duplicateRows = m.newCounter("model_duplicate_rows_total", "Result rows repeating an earlier year and scenario in the same run.", "")
+	m.endpointRejects = m.newCounter("http_concurrency_rejections_total", "Requests turned away with 429 because their endpoint was at its ENDPOINT_CONCURRENCY limit.", "endpoint")
+	m.droppedLogs = m.newCounter("request_logs_dropped_total", "Request log rows not written: queue full, database down or insert failed.", "")
+	m.spooledLogs = m.newCounter("request_logs_spooled_total", "Request log rows written to REQUEST_LOG_SPOOL while the database was down.", "")
+	m.replayedLogs = m.newCounter("request_logs_replayed_total", "Spooled request log rows replayed into the database.", "")
+	return m
+}
+
+func (m *metricsRegistry) newCounter(name, help, label string) *counter {
+	c := &counter{name: name, help: help, label: label, values: make(map[string]float64)}
+	m.counters = append(m.counters, c)
+	return c
+}
+
+func (m *metricsRegistry) newGauge(name, help string, value func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	m.mu.Lock()
+	m.gauges = append(m.gauges, g)
+	m.mu.Unlock()
+	return g
+}
+
+func (m *metricsRegistry) newLabeledGauge(name, help, label string, values func() map[string]float64) *gauge {
+	g := &gauge{name: name, help: help, label: label, values: values}
+	m.mu.Lock()
+	m.gauges = append(m.gauges, g)
+	m.mu.Unlock()
+	return g
+}
+
+func (m *metricsRegistry) newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	m.histograms = append(m.histograms, h)
+	return h
+}
+
+func (m *metricsRegistry) inc(c *counter, labelValue string) {
+	m.add(c, labelValue, 1)
+}
+
+func (m *metricsRegistry) add(c *counter, labelValue string, n float64) {
+	m.mu.Lock()
+	c.values[labelValue] += n
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) observe(h *histogram, v float64) {
+	m.mu.Lock()
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+	m.mu.Unlock()
+}
+
+// observeModelRun records the outcome and duration of a single model run.
+func (m *metricsRegistry) observeModelRun(start time.Time, success bool) {
+	status := "success"
+	if !success {
+		status = "error"
+	}
+	m.inc(m.modelRuns, status)
+	m.observe(m.modelDuration, time.Since(start).Seconds())
+}
+
+func (m *metricsRegistry) snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := MetricsSnapshot{
+		Counters:   make([]CounterSnapshot, 0, len(m.counters)),
+		Gauges:     make([]GaugeSnapshot, 0, len(m.gauges)),
+		Histograms: make([]HistogramSnapshot, 0, len(m.histograms)),
+	}
+	for _, c := range m.counters {
+		cs := CounterSnapshot{Name: c.name, Help: c.help, Values: labeledSamples(c.label, c.values)}
+		snap.Counters = append(snap.Counters, cs)
+	}
+	for _, g := range m.gauges {
+		gs := GaugeSnapshot{Name: g.name, Help: g.help}
+		if g.values != nil {
+			gs.Values = labeledSamples(g.label, g.values())
+		} else {
+			gs.Value = g.value()
+		}
+		snap.Gauges = append(snap.Gauges, gs)
+	}
+	for _, h := range m.histograms {
+		hs := HistogramSnapshot{Name: h.name, Help: h.help, Sum: h.sum, Count: h.count}
+		for i, ub := range h.buckets {
+			hs.Buckets = append(hs.Buckets, HistogramBucket{UpperBound: ub, Count: h.counts[i]})
+		}
+		snap.Histograms = append(snap.Histograms, hs)
+	}
+	return snap
+}
+
+// labeledSamples turns values into samples sorted by label value.
+func labeledSamples(label string, values map[string]float64) []CounterSample {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := []CounterSample{}
+	for _, k := range keys {
+		sample := CounterSample{Value: values[k]}
+		if label != "" {
+			sample.Labels = map[string]string{label: k}
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// writePrometheus renders a snapshot in the Prometheus text exposition format.
+func writePrometheus(w io.Writer, snap MetricsSnapshot) {
+	for _, c := range snap.Counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+		for _, s := range c.Values {
+			fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(s.Labels), formatFloat(s.Value))
+		}
+	}
+	for _, g := range snap.Gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.Name, g.Help, g.Name)
+		if g.Values != nil {
+			for _, s := range g.Values {
+				fmt.Fprintf(w, "%s%s %s\n", g.Name, formatLabels(s.Labels), formatFloat(s.Value))
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s %s\n", g.Name, formatFloat(g.Value))
+	}
+	for _, h := range snap.Histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+		for _, b := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.Name, formatFloat(b.UpperBound), b.Count)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.Name, h.Count)
+		fmt.Fprintf(w, "%s_sum %s\n", h.Name, formatFloat(h.Sum))
+		fmt.Fprintf(w, "%s_count %d\n", h.Name, h.Count)
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
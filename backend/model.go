@@ -0,0 +1,995 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== Model ====================
+
+// ModelJarInfo describes model.jar as found at startup.
+type ModelJarInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// SHA256 identifies the jar's contents; it is part of the result cache
+	// key, so a new model never answers from an old model's results.
+	SHA256 string `json:"sha256,omitempty"`
+	Valid  bool   `json:"valid"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkModelJar verifies that path is a readable zip archive. A truncated
+// or corrupt jar otherwise only shows up as an obscure Java error on every run.
+func checkModelJar(path string) ModelJarInfo {
+	info := ModelJarInfo{Path: path}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Size = st.Size()
+	info.ModTime = st.ModTime()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		info.Error = "not a valid jar: " + err.Error()
+		return info
+	}
+	defer zr.Close()
+
+	if len(zr.File) == 0 {
+		info.Error = "jar archive is empty"
+		return info
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.SHA256 = sum
+	info.Valid = true
+	return info
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// refreshModelJar re-checks model.jar when its size or modification time
+// no longer match what was recorded, so a jar replaced on disk is picked
+// up without a restart.
+func (s *Server) refreshModelJar() ModelJarInfo {
+	jar := s.currentModelJar()
+	if st, err := os.Stat(jar.Path); err == nil && st.Size() == jar.Size && st.ModTime().Equal(jar.ModTime) {
+		return jar
+	}
+
+	info := checkModelJar(jar.Path)
+	s.modelJarMu.Lock()
+	defer s.modelJarMu.Unlock()
+	if info.SHA256 != s.modelJar.SHA256 || info.Valid != s.modelJar.Valid {
+		log.Printf("Model jar changed: sha256 %q -> %q, valid=%v", s.modelJar.SHA256, info.SHA256, info.Valid)
+	}
+	s.modelJar = info
+	return info
+}
+
+func (s *Server) setModelJar(info ModelJarInfo) {
+	s.modelJarMu.Lock()
+	s.modelJar = info
+	s.modelJarMu.Unlock()
+}
+
+func (s *Server) currentModelJar() ModelJarInfo {
+	s.modelJarMu.RLock()
+	defer s.modelJarMu.RUnlock()
+	return s.modelJar
+}
+
+// projectIDPattern is what a PROJECT_HEADER value may look like.
+var projectIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// requestProject reads the PROJECT_HEADER tag a run is filed under. A
+// missing header is no project.
+func (s *Server) requestProject(r *http.Request) (string, error) {
+	header := s.config().ProjectHeader
+	v := strings.TrimSpace(r.Header.Get(header))
+	if v == "" {
+		return "", nil
+	}
+	if !projectIDPattern.MatchString(v) {
+		return "", fmt.Errorf("%s must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit", header)
+	}
+	return v, nil
+}
+
+// validateModelRequest checks the scenario against the known set and fills
+// in missing or out-of-range parameters from its defaults. A missing
+// scenario means the first one. The parameters must then satisfy the
+// scenario's PARAM_RULES.
+func (s *Server) validateModelRequest(req *ModelRequest) error {
+	if req.Requested == nil {
+		req.Requested = &RequestedParams{Scenario: req.Scenario, DrillingRate: req.DrillingRate, OilPrice: req.OilPrice, ExchangeRate: req.ExchangeRate}
+	}
+	if err := convertOilPrice(req); err != nil {
+		return err
+	}
+	if req.Scenario == 0 {
+		req.Scenario = s.currentScenarios()[0].ID
+	}
+	sc, ok := s.findScenario(req.Scenario)
+	if !ok {
+		return s.unknownScenarioError(req.Scenario)
+	}
+	if req.DrillingRate <= 0 {
+		req.DrillingRate = sc.DrillingRate
+	}
+	if req.OilPrice <= 0 {
+		req.OilPrice = sc.OilPrice
+	}
+	if req.ExchangeRate <= 0 {
+		req.ExchangeRate = sc.ExchangeRate
+	}
+	if req.Seed != nil && !hasPlaceholder(s.config().ModelArgs, "seed") {
+		return fmt.Errorf("seed is not supported: MODEL_ARGS has no {seed} placeholder")
+	}
+	return s.config().checkParamRules(*req)
+}
+
+// UnmarshalJSON accepts the numbers as JSON numbers or as strings, with a
+// decimal comma if need be, since not every client serializes them the
+// same way: "oilPrice": 80.5, "80.5" and "80,5" all mean 80.5.
+func (req *ModelRequest) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Scenario     json.RawMessage `json:"scenario"`
+		DrillingRate json.RawMessage `json:"drillingRate"`
+		OilPrice     json.RawMessage `json:"oilPrice"`
+		ExchangeRate json.RawMessage `json:"exchangeRate"`
+		Seed         json.RawMessage `json:"seed"`
+		Currency     string          `json:"oilPriceCurrency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return objectError(err)
+	}
+	out := ModelRequest{OilPriceCurrency: raw.Currency}
+	for _, err := range []error{
+		lenientInt("scenario", raw.Scenario, &out.Scenario),
+		lenientInt("drillingRate", raw.DrillingRate, &out.DrillingRate),
+		lenientFloat("oilPrice", raw.OilPrice, &out.OilPrice),
+		lenientFloat("exchangeRate", raw.ExchangeRate, &out.ExchangeRate),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if s, err := lenientNumber("seed", raw.Seed); err != nil {
+		return err
+	} else if s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("seed must be a whole number, got %s", raw.Seed)
+		}
+		out.Seed = &seed
+	}
+	*req = out
+	return nil
+}
+
+// objectError replaces encoding/json's complaint about the anonymous
+// struct a lenient UnmarshalJSON decodes into when the body isn't an
+// object at all.
+func objectError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field == "" {
+		return fmt.Errorf("expected a JSON object, got %s", typeErr.Value)
+	}
+	return err
+}
+
+// lenientNumber returns the number in raw as text strconv can parse, or ""
+// when raw is missing or null. A string holding a number is unquoted and
+// a lone comma in it taken for the decimal point; "1,234.5" is rejected
+// rather than guessing at a thousands separator.
+func lenientNumber(field string, raw json.RawMessage) (string, error) {
+	s := strings.TrimSpace(string(raw))
+	if s == "" || s == "null" {
+		return "", nil
+	}
+	if s[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("%s: %v", field, err)
+		}
+		s = strings.TrimSpace(s)
+		if strings.Count(s, ",") == 1 && !strings.Contains(s, ".") {
+			s = strings.Replace(s, ",", ".", 1)
+		}
+	}
+	if v, err := strconv.ParseFloat(s, 64); err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return "", fmt.Errorf("%s must be a number, got %s", field, raw)
+	}
+	return s, nil
+}
+
+func lenientFloat(field string, raw json.RawMessage, dst *float64) error {
+	s, err := lenientNumber(field, raw)
+	if err != nil || s == "" {
+		return err
+	}
+	*dst, _ = strconv.ParseFloat(s, 64)
+	return nil
+}
+
+// lenientInt also takes a whole number written with a fraction, "50.0".
+func lenientInt(field string, raw json.RawMessage, dst *int) error {
+	s, err := lenientNumber(field, raw)
+	if err != nil || s == "" {
+		return err
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+		return fmt.Errorf("%s must be a whole number, got %s", field, raw)
+	}
+	*dst = int(v)
+	return nil
+}
+
+// ModelOutput is what a single model run produced.
+type ModelOutput struct {
+	Results []SimulationResult
+	Raw     []byte
+	// Partial is set when the run was cut short (timeout or cancel) after
+	// some rows had already been read; Results holds those rows.
+	Partial bool
+	// Seed is the seed the model reported using on stderr, if any.
+	Seed *int64
+	// Logs are the MODEL_LOG_PREFIX lines from the output, kept out of
+	// the results.
+	Logs []string
+	// Progress is the last progress marker the model printed, if any.
+	Progress *float64
+	// Backend names the ModelBackend that produced the output, when the
+	// runner tracks it.
+	Backend string
+	// Duplicates counts the rows that repeated an earlier year and
+	// scenario; with DEDUPE_RESULTS they are no longer in Results.
+	Duplicates int
+}
+
+type progressContextKey struct{}
+
+// withProgressReporter has a runner that reads output as it arrives pass
+// each progress marker to report.
+func withProgressReporter(ctx context.Context, report func(float64)) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, report)
+}
+
+func progressReporter(ctx context.Context) func(float64) {
+	report, _ := ctx.Value(progressContextKey{}).(func(float64))
+	return report
+}
+
+type noLogContextKey struct{}
+
+// withoutRequestLog has executeModel and runModelShared leave the run out
+// of request_logs, for runs the server makes on a caller's behalf.
+func withoutRequestLog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noLogContextKey{}, true)
+}
+
+func requestLogged(ctx context.Context) bool {
+	noLog, _ := ctx.Value(noLogContextKey{}).(bool)
+	return !noLog
+}
+
+type rowContextKey struct{}
+
+// withRowReporter has a runner that reads output as it arrives pass each
+// result row to report, with its index among the rows. A fallback backend
+// starts again from index 0.
+func withRowReporter(ctx context.Context, report func(int, SimulationResult)) context.Context {
+	return context.WithValue(ctx, rowContextKey{}, report)
+}
+
+func rowReporter(ctx context.Context) func(int, SimulationResult) {
+	report, _ := ctx.Value(rowContextKey{}).(func(int, SimulationResult))
+	return report
+}
+
+// RunningModel is a model run in flight, as listed by /api/admin/running.
+// ID is the job ID for background runs and the request ID otherwise.
+type RunningModel struct {
+	ID         string       `json:"id"`
+	Username   string       `json:"username"`
+	Parameters ModelRequest `json:"parameters"`
+	StartedAt  time.Time    `json:"startedAt"`
+	// Progress is the model's last progress marker, in percent.
+	Progress *float64 `json:"progress,omitempty"`
+}
+
+// trackRun registers a run until the returned func is called.
+func (s *Server) trackRun(id, username string, req ModelRequest) func() {
+	s.runningMu.Lock()
+	s.running[id] = RunningModel{ID: id, Username: username, Parameters: req, StartedAt: time.Now()}
+	s.runningMu.Unlock()
+	return func() {
+		s.runningMu.Lock()
+		delete(s.running, id)
+		s.runningMu.Unlock()
+	}
+}
+
+func (s *Server) setRunProgress(id string, pct float64) {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	if run, ok := s.running[id]; ok {
+		run.Progress = &pct
+		s.running[id] = run
+	}
+}
+
+// runProgress is the last progress reported by the run with id, nil when
+// there is none or the run is over.
+func (s *Server) runProgress(id string) *float64 {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	return s.running[id].Progress
+}
+
+// acquireRunSlot takes one of the MAX_CONCURRENT_RUNS slots, waiting at
+// most QUEUE_WAIT_TIMEOUT for one to free up. Without a limit it returns
+// at once. The returned func gives the slot back.
+func (s *Server) acquireRunSlot(ctx context.Context) (func(), error) {
+	if s.runSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.runSlots }
+	select {
+	case s.runSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	wait := s.config().QueueWaitTimeout
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s.runSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		s.metrics.inc(s.metrics.queueTimeouts, "")
+		return nil, newModelError(ErrServerBusy, "Server busy, try again later: no model slot freed up within %s", wait)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// listRunning returns the runs in flight, oldest first.
+func (s *Server) listRunning() []RunningModel {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	list := make([]RunningModel, 0, len(s.running))
+	for _, run := range s.running {
+		list = append(list, run)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+func (s *Server) countRunning() int {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	return len(s.running)
+}
+
+// executeModel runs the model for username and records the outcome in the
+// logs, metrics and request history (unless ctx is withoutRequestLog). id
+// identifies the run in the running list. The returned error message is
+// meant for the client.
+func (s *Server) executeModel(ctx context.Context, id, username string, req ModelRequest) (ModelOutput, error) {
+	release, err := s.acquireRunSlot(ctx)
+	if err != nil {
+		s.errorLog.Printf("[%s] %v", username, err)
+		return ModelOutput{}, err
+	}
+	defer release()
+	defer s.trackRun(id, username, req)()
+	cfg := s.config()
+	logged := requestLogged(ctx)
+
+	log.Printf("[%s] Running model: scenario=%d, drilling=%d, oilPrice=%.2f, exchange=%.2f",
+		username, req.Scenario, req.DrillingRate, req.OilPrice, req.ExchangeRate)
+
+	if cfg.ModelTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ModelTimeout)
+		defer cancel()
+	}
+
+	ctx = withProgressReporter(ctx, func(pct float64) { s.setRunProgress(id, pct) })
+	start := time.Now()
+	out, err := s.runner.Run(ctx, req)
+	elapsed := time.Since(start)
+	// File output is only read at the end, so nobody saw the progress.
+	if cfg.ModelOutputMode == outputModeFile && out.Progress != nil {
+		log.Printf("[%s] Model last reported %.0f%% progress", username, *out.Progress)
+	}
+	// Record the seed the model chose so the run can be repeated.
+	if req.Seed == nil {
+		req.Seed = out.Seed
+	}
+	s.metrics.observeModelRun(start, err == nil)
+	s.publishRun(id, username, req, out, err, elapsed)
+	if cfg.SlowRunThreshold > 0 && elapsed > cfg.SlowRunThreshold {
+		s.metrics.inc(s.metrics.slowRuns, "")
+		log.Printf("WARN [%s] Slow model run: %s (threshold %s), scenario=%d, drilling=%d, oilPrice=%.2f, exchange=%.2f, success=%v",
+			username, elapsed.Round(time.Millisecond), cfg.SlowRunThreshold,
+			req.Scenario, req.DrillingRate, req.OilPrice, req.ExchangeRate, err == nil)
+	}
+	if err != nil {
+		s.errorLog.Printf("[%s] %v", username, err)
+		if logged {
+			s.logRequest(username, req, false, nil, nil, err.Error(), elapsed, "")
+		}
+		return out, err
+	}
+
+	out.Results, out.Duplicates = dedupeResults(out.Results, cfg.DedupeResults)
+	if out.Duplicates > 0 {
+		action := "kept"
+		if cfg.DedupeResults {
+			action = "dropped"
+		}
+		log.Printf("WARN [%s] Model returned %d duplicate (year, scenario) rows, %s", username, out.Duplicates, action)
+		s.metrics.add(s.metrics.duplicateRows, "", float64(out.Duplicates))
+	}
+
+	if out.Partial {
+		reason := "Partial result: " + abortReason(ctx.Err(), cfg.ModelTimeout)
+		log.Printf("[%s] %s, returning %d results", username, reason, len(out.Results))
+		if logged {
+			s.logRequest(username, req, true, out.Results, out.Raw, reason, elapsed, "")
+		}
+		return out, nil
+	}
+
+	log.Printf("[%s] Model completed successfully, %d results", username, len(out.Results))
+	if logged {
+		s.logRequest(username, req, true, out.Results, out.Raw, "", elapsed, "")
+	}
+	return out, nil
+}
+
+// buildClasspath lists model.jar and its bundled libraries.
+func buildClasspath(modelDir string) string {
+	return strings.Join([]string{
+		modelDir,
+		filepath.Join(modelDir, "model.jar"),
+		filepath.Join(modelDir, "lib", "*"),
+		filepath.Join(modelDir, "lib", "logging", "*"),
+		filepath.Join(modelDir, "lib", "database", "*"),
+		filepath.Join(modelDir, "lib", "database", "querydsl", "*"),
+		filepath.Join(modelDir, "lib", "database", "ucanaccess", "*"),
+	}, ":")
+}
+
+// defaultModelCmdArgs starts ModelRunner from model.jar on the JVM.
+const defaultModelCmdArgs = "-cp {classpath} ModelRunner"
+
+// defaultModelArgs is the positional order ModelRunner.java expects. Its
+// --seed= option is dropped when the request has no seed.
+const defaultModelArgs = "{scenario} {drillingRate} {oilPrice} {exchangeRate} {output} --seed={seed}"
+
+var modelArgPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// modelArgValues maps each template placeholder to its value for a run.
+// {seed} is empty, and so dropped, when the request has none.
+func modelArgValues(req ModelRequest, outputPath string) map[string]string {
+	seed := ""
+	if req.Seed != nil {
+		seed = strconv.FormatInt(*req.Seed, 10)
+	}
+	return map[string]string{
+		"scenario":     strconv.Itoa(req.Scenario),
+		"drillingRate": strconv.Itoa(req.DrillingRate),
+		"oilPrice":     fmt.Sprintf("%.2f", req.OilPrice),
+		"exchangeRate": fmt.Sprintf("%.2f", req.ExchangeRate),
+		"seed":         seed,
+		"project":      req.Project,
+		"output":       outputPath,
+	}
+}
+
+// hasPlaceholder reports whether the template references {name}.
+func hasPlaceholder(template []string, name string) bool {
+	for _, tok := range template {
+		for _, m := range modelArgPlaceholder.FindAllStringSubmatch(tok, -1) {
+			if m[1] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// seedLine matches a "Seed: 123" line on ModelRunner's stderr.
+var seedLine = regexp.MustCompile(`(?im)^\s*(?:random\s+)?seed\s*[:=]\s*(-?\d+)\s*$`)
+
+// reportedSeed extracts the seed a stochastic model says it used.
+func reportedSeed(stderr []byte) *int64 {
+	m := seedLine.FindSubmatch(stderr)
+	if m == nil {
+		return nil
+	}
+	seed, err := strconv.ParseInt(string(m[1]), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &seed
+}
+
+// commandArgValues are the placeholders that describe the model install
+// rather than the run.
+func commandArgValues(cfg Config) map[string]string {
+	return map[string]string{
+		"classpath": buildClasspath(cfg.ModelDir),
+		"modelDir":  cfg.ModelDir,
+	}
+}
+
+// validateModelArgs rejects templates that reference unknown fields;
+// setting names the template in the error.
+func validateModelArgs(setting string, template []string) error {
+	known := modelArgValues(ModelRequest{}, "")
+	for k, v := range commandArgValues(Config{}) {
+		known[k] = v
+	}
+	for _, tok := range template {
+		for _, m := range modelArgPlaceholder.FindAllStringSubmatch(tok, -1) {
+			if _, ok := known[m[1]]; !ok {
+				return fmt.Errorf("unknown placeholder {%s} in %s", m[1], setting)
+			}
+		}
+	}
+	return nil
+}
+
+// expandModelArgs fills in the template. A token whose placeholders all
+// expand to "" is dropped, so {output} or --out={output} disappears in
+// stdout mode.
+func expandModelArgs(template []string, values map[string]string) []string {
+	args := make([]string, 0, len(template))
+	for _, tok := range template {
+		placeholders, filled := 0, 0
+		arg := modelArgPlaceholder.ReplaceAllStringFunc(tok, func(p string) string {
+			placeholders++
+			v := values[p[1:len(p)-1]]
+			if v != "" {
+				filled++
+			}
+			return v
+		})
+		if placeholders > 0 && filled == 0 {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// buildModelCommand assembles the model invocation for req without
+// starting it: cfg.ModelCmd with cfg.ModelCmdArgs, then cfg.ModelArgs.
+// outputPath fills {output}.
+func buildModelCommand(ctx context.Context, cfg Config, req ModelRequest, outputPath string) *exec.Cmd {
+	values := modelArgValues(req, outputPath)
+	for k, v := range commandArgValues(cfg) {
+		values[k] = v
+	}
+	args := expandModelArgs(cfg.ModelCmdArgs, values)
+	args = append(args, expandModelArgs(cfg.ModelArgs, values)...)
+
+	cmd := exec.CommandContext(ctx, cfg.ModelCmd, args...)
+	cmd.Dir = cfg.ModelDir
+	cmd.Env = os.Environ()
+	if req.Project != "" {
+		cmd.Env = append(cmd.Env, "MODEL_PROJECT_ID="+req.Project)
+	}
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// ModelInvocation is how a run's JVM is (or would be) started, for admins
+// debugging a failed run.
+type ModelInvocation struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	Dir  string   `json:"dir"`
+	Env  []string `json:"env"`
+}
+
+// invocationEnvPrefixes pick the environment variables that affect how the
+// JVM finds and runs the model.
+var invocationEnvPrefixes = []string{"JAVA_", "_JAVA_", "JDK_", "CLASSPATH=", "PATH=", "LANG=", "LC_", "MODEL_PROJECT_ID="}
+
+var (
+	// secretEnvName matches variables whose whole value is withheld.
+	secretEnvName = regexp.MustCompile(`(?i)(secret|password|passwd|token|credential|key)`)
+	// secretEnvValue matches key=value pairs inside a value, such as a
+	// -Dpassword=... in JAVA_TOOL_OPTIONS.
+	secretEnvValue = regexp.MustCompile(`(?i)([\w.-]*(?:secret|password|passwd|token|credential|key)[\w.-]*=)[^\s,;]+`)
+)
+
+// describeModelCommand reconstructs the command javaRunner runs for req.
+// File mode's output path is a fresh temp file per run, so it shows as a
+// placeholder. Secrets in the environment are redacted.
+func describeModelCommand(cfg Config, req ModelRequest) ModelInvocation {
+	outputPath := ""
+	if cfg.ModelOutputMode == outputModeFile {
+		outputPath = "<temp file>"
+	}
+	cmd := buildModelCommand(context.Background(), cfg, req, outputPath)
+
+	inv := ModelInvocation{Path: cmd.Path, Args: cmd.Args, Dir: cmd.Dir, Env: []string{}}
+	for _, kv := range cmd.Env {
+		if !hasAnyPrefix(kv, invocationEnvPrefixes) {
+			continue
+		}
+		name, value, _ := strings.Cut(kv, "=")
+		if secretEnvName.MatchString(name) {
+			value = "[redacted]"
+		} else {
+			value = secretEnvValue.ReplaceAllString(value, "${1}[redacted]")
+		}
+		inv.Env = append(inv.Env, name+"="+value)
+	}
+	sort.Strings(inv.Env)
+	return inv
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// javaRunner runs ModelRunner in a JVM as configured by cfg. Each run
+// uses the config current when it started.
+type javaRunner struct {
+	cfg *liveConfig
+}
+
+// Run launches ModelRunner and parses its CSV. Canceling ctx kills the JVM
+// along with anything it spawned.
+func (j javaRunner) Run(ctx context.Context, req ModelRequest) (ModelOutput, error) {
+	return runModelCommand(ctx, j.cfg.Load(), req)
+}
+
+// ModelBackend is one way of running the model: MODEL_CMD with
+// MODEL_CMD_ARGS, or an entry of MODEL_FALLBACK_CMDS. Name is the
+// command's base name.
+type ModelBackend struct {
+	Name    string
+	Cmd     string
+	CmdArgs []string
+}
+
+// modelBackends lists the backends to try, MODEL_CMD first.
+func (c Config) modelBackends() []ModelBackend {
+	primary := ModelBackend{Name: filepath.Base(c.ModelCmd), Cmd: c.ModelCmd, CmdArgs: c.ModelCmdArgs}
+	return append([]ModelBackend{primary}, c.ModelFallbacks...)
+}
+
+// withBackend is c set up to run the model through b.
+func (c Config) withBackend(b ModelBackend) Config {
+	c.ModelCmd, c.ModelCmdArgs = b.Cmd, b.CmdArgs
+	return c
+}
+
+// FallbackModelRunner tries each backend in order and returns the first
+// success, so a flaky primary (a native build, say) can fall back to the
+// JVM. A run that times out or is canceled is not retried: the time it
+// had is gone. When every backend fails the error names each failure and
+// keeps the last one's kind.
+type FallbackModelRunner struct {
+	cfg     *liveConfig
+	metrics *metricsRegistry
+}
+
+func (f FallbackModelRunner) Run(ctx context.Context, req ModelRequest) (ModelOutput, error) {
+	cfg := f.cfg.Load()
+	backends := cfg.modelBackends()
+	var failures []string
+	var last error
+	for i, b := range backends {
+		out, err := runModelCommand(ctx, cfg.withBackend(b), req)
+		if err == nil {
+			out.Backend = b.Name
+			if i > 0 {
+				f.metrics.inc(f.metrics.fallbacks, b.Name)
+				log.Printf("Model run served by fallback backend %s", b.Name)
+			}
+			return out, nil
+		}
+		if len(backends) == 1 || ctx.Err() != nil {
+			return out, err
+		}
+		failures = append(failures, b.Name+": "+err.Error())
+		last = err
+		if i+1 < len(backends) {
+			log.Printf("Model backend %s failed, trying %s: %v", b.Name, backends[i+1].Name, err)
+		}
+	}
+
+	kind := ErrModelExit
+	var modelErr *ModelError
+	if errors.As(last, &modelErr) {
+		kind = modelErr.Kind
+	}
+	return ModelOutput{}, newModelError(kind, "All model backends failed: %s", strings.Join(failures, "; "))
+}
+
+// runModelCommand runs the model once with cfg's command.
+func runModelCommand(ctx context.Context, cfg Config, req ModelRequest) (ModelOutput, error) {
+	if cfg.usesModelJar() {
+		if _, err := os.Stat(filepath.Join(cfg.ModelDir, "model.jar")); err != nil {
+			return ModelOutput{}, newModelError(ErrModelNotFound, "Model not available: %v", err)
+		}
+	}
+	if cfg.ModelOutputMode == outputModeFile {
+		return runFile(ctx, cfg, req)
+	}
+	return runStreaming(ctx, cfg, req)
+}
+
+// newOutputDecoder converts output from charset; loadConfig has already
+// rejected unknown charsets.
+func newOutputDecoder(charset string) outputDecoder {
+	enc, _ := outputEncoding(charset)
+	return outputDecoder{enc: enc}
+}
+
+// runStreaming parses stdout as it arrives. If the run is cut short, the
+// rows read so far are returned as a partial result.
+func runStreaming(ctx context.Context, cfg Config, req ModelRequest) (ModelOutput, error) {
+	var out ModelOutput
+	var stderr bytes.Buffer
+
+	cmd := buildModelCommand(ctx, cfg, req, "")
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return out, fmt.Errorf("Model execution failed: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return out, startError(err)
+	}
+
+	var raw bytes.Buffer
+	var decodeErr error
+	decoder := newOutputDecoder(cfg.ModelOutputCharset)
+	parser := newCSVParser(cfg)
+	parser.onProgress = progressReporter(ctx)
+	parser.onRow = rowReporter(ctx)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, min(64<<10, cfg.ModelMaxLineBytes)), cfg.ModelMaxLineBytes)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		// After a bad line keep draining stdout so the JVM can exit.
+		if decodeErr != nil {
+			continue
+		}
+		line, err := decoder.decodeLine(scanner.Bytes(), lineNo)
+		if err != nil {
+			decodeErr = err
+			continue
+		}
+		raw.Write(line)
+		raw.WriteByte('\n')
+		parser.parseLine(string(line))
+	}
+	// The scanner stops at a line over MODEL_MAX_LINE_BYTES; drain the
+	// rest so the JVM isn't left blocked on a full pipe.
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		io.Copy(io.Discard, stdout)
+	}
+	waitErr := cmd.Wait()
+	out.Raw = raw.Bytes()
+	out.Results = parser.results
+	out.Logs = parser.logs
+	out.Progress = parser.progress
+	out.Seed = reportedSeed(stderr.Bytes())
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if len(out.Results) > 0 {
+			out.Partial = true
+			return out, nil
+		}
+		return out, abortError(ctxErr, cfg.ModelTimeout)
+	}
+	if errors.Is(scanErr, bufio.ErrTooLong) {
+		return out, newModelError(ErrParse, "Model wrote a line over MODEL_MAX_LINE_BYTES (%d)", cfg.ModelMaxLineBytes)
+	}
+	if scanErr != nil {
+		return out, newModelError(ErrParse, "Failed to read model output: %v", scanErr)
+	}
+	if waitErr != nil {
+		return out, modelExecError(waitErr, stderr.Bytes())
+	}
+	if decodeErr != nil {
+		return out, newModelError(ErrParse, "%v", decodeErr)
+	}
+	return out, nil
+}
+
+// runFile has ModelRunner write its CSV to a temp file, which is read once
+// the process exits and always removed.
+func runFile(ctx context.Context, cfg Config, req ModelRequest) (ModelOutput, error) {
+	var out ModelOutput
+
+	outputPath, err := createOutputFile()
+	if err != nil {
+		return out, fmt.Errorf("Failed to create output file: %v", err)
+	}
+	defer os.Remove(outputPath)
+
+	var stderr bytes.Buffer
+	cmd := buildModelCommand(ctx, cfg, req, outputPath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return out, abortError(ctxErr, cfg.ModelTimeout)
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return out, startError(err)
+		}
+		return out, modelExecError(err, stderr.Bytes())
+	}
+
+	out.Seed = reportedSeed(stderr.Bytes())
+
+	// A model that never opens the file, such as a ModelRunner.class built
+	// before it took the output argument, must not pass for one that ran
+	// and found nothing.
+	data, err := os.ReadFile(outputPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return out, newModelError(ErrParse, "Model removed its output file without writing results")
+	}
+	if err != nil {
+		return out, fmt.Errorf("Failed to read output file: %v", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return out, newModelError(ErrParse, "Model wrote nothing to its output file; check that MODEL_ARGS passes {output} and ModelRunner.class is up to date")
+	}
+	decoder := newOutputDecoder(cfg.ModelOutputCharset)
+	if out.Raw, err = decoder.decodeAll(data); err != nil {
+		return out, newModelError(ErrParse, "%v", err)
+	}
+	parser, err := parseCSVOutput(string(out.Raw), cfg)
+	if err != nil {
+		return out, newModelError(ErrParse, "Failed to parse results: %v", err)
+	}
+	out.Results, out.Logs, out.Progress = parser.results, parser.logs, parser.progress
+	return out, nil
+}
+
+// Kinds of model failure, matched with errors.Is. The runner wraps them in
+// a ModelError so the message stays meant for the client.
+var (
+	ErrModelTimeout  = errors.New("model timed out")
+	ErrModelExit     = errors.New("model exited with an error")
+	ErrParse         = errors.New("model output could not be parsed")
+	ErrModelNotFound = errors.New("model not available")
+	ErrServerBusy    = errors.New("no model slot free")
+)
+
+// ModelError is a model failure of a known kind.
+type ModelError struct {
+	Kind    error
+	Message string
+}
+
+func (e *ModelError) Error() string { return e.Message }
+func (e *ModelError) Unwrap() error { return e.Kind }
+
+func newModelError(kind error, format string, args ...interface{}) error {
+	return &ModelError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// modelErrorStatus maps a run failure to the HTTP status and error code
+// handlers answer with. Failures of no known kind are plain 500s.
+func modelErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrModelTimeout):
+		return http.StatusGatewayTimeout, "model_timeout"
+	case errors.Is(err, ErrModelExit):
+		return http.StatusBadGateway, "model_exit"
+	case errors.Is(err, ErrParse):
+		return http.StatusUnprocessableEntity, "model_parse"
+	case errors.Is(err, ErrModelNotFound):
+		return http.StatusServiceUnavailable, "model_not_found"
+	case errors.Is(err, ErrServerBusy):
+		return http.StatusServiceUnavailable, "server_busy"
+	}
+	return http.StatusInternalServerError, ""
+}
+
+// startError classifies a failure to launch the JVM.
+func startError(err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return newModelError(ErrModelNotFound, "Model execution failed: %v", err)
+	}
+	return newModelError(ErrModelExit, "Model execution failed: %v", err)
+}
+
+func modelExecError(err error, stderr []byte) error {
+	errMsg := string(stderr)
+	if errMsg == "" {
+		errMsg = err.Error()
+	}
+	return newModelError(ErrModelExit, "Model execution failed: %s", errMsg)
+}
+
+// abortError describes a run cut short by ctx. Only a timeout is a model
+// failure; a cancel means the caller gave up.
+func abortError(ctxErr error, timeout time.Duration) error {
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
+		return newModelError(ErrModelTimeout, "Model execution %s", abortReason(ctxErr, timeout))
+	}
+	return fmt.Errorf("Model execution %s", abortReason(ctxErr, timeout))
+}
+
+func abortReason(err error, timeout time.Duration) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Sprintf("timed out after %s", timeout)
+	}
+	return "canceled"
+}
+
+// createOutputFile reserves an empty temp file for ModelRunner to write into.
+// The caller is responsible for removing it.
+func createOutputFile() (string, error) {
+	f, err := os.CreateTemp("", "model-output-*.csv")
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModelErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{newModelError(ErrModelTimeout, "timed out"), http.StatusGatewayTimeout, "model_timeout"},
+		{newModelError(ErrModelExit, "exit 1"), http.StatusBadGateway, "model_exit"},
+		{newModelError(ErrParse, "bad csv"), http.StatusUnprocessableEntity, "model_parse"},
+		{newModelError(ErrModelNotFound, "no java"), http.StatusServiceUnavailable, "model_not_found"},
+		{ErrServerBusy, http.StatusServiceUnavailable, "server_busy"},
+		{fmt.Errorf("wrapped: %w", newModelError(ErrParse, "bad csv")), http.StatusUnprocessableEntity, "model_parse"},
+		{errors.New("something else"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			status, code := modelErrorStatus(tt.err)
+			if status != tt.status || code != tt.code {
+				t.Errorf("modelErrorStatus = %d, %q; want %d, %q", status, code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestRunModelAnswersModelErrors(t *testing.T) {
+	tests := []struct {
+		kind   error
+		status int
+		code   string
+	}{
+		{ErrModelTimeout, http.StatusGatewayTimeout, "model_timeout"},
+		{ErrModelExit, http.StatusBadGateway, "model_exit"},
+		{ErrParse, http.StatusUnprocessableEntity, "model_parse"},
+		{ErrModelNotFound, http.StatusServiceUnavailable, "model_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			runner := &fakeRunner{run: func(context.Context, ModelRequest) (ModelOutput, error) {
+				return ModelOutput{}, newModelError(tt.kind, "model failed")
+			}}
+			s := newTestServer(t, runner, nil)
+			rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model", s.login("user"), ModelRequest{})
+			resp := decodeResponse(t, rec, nil)
+			if rec.Code != tt.status || resp.Code != tt.code || resp.Success {
+				t.Errorf("status %d, code %q; want %d, %q: %s", rec.Code, resp.Code, tt.status, tt.code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRunErrorKinds(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"missing java", startError(&exec.Error{Name: "java", Err: exec.ErrNotFound}), ErrModelNotFound},
+		{"other start failure", startError(errors.New("permission denied")), ErrModelExit},
+		{"nonzero exit", modelExecError(errors.New("exit status 1"), []byte("NoClassDefFoundError")), ErrModelExit},
+		{"deadline", abortError(context.DeadlineExceeded, time.Minute), ErrModelTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.kind) {
+				t.Errorf("%v is not %v", tt.err, tt.kind)
+			}
+		})
+	}
+	if err := abortError(context.Canceled, time.Minute); errors.Is(err, ErrModelTimeout) {
+		t.Errorf("a canceled run is reported as a timeout: %v", err)
+	}
+}
+
+func TestModelRequestLenientNumbers(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want ModelRequest
+	}{
+		{"numbers", `{"scenario":2,"drillingRate":50,"oilPrice":80.5,"exchangeRate":75}`,
+			ModelRequest{Scenario: 2, DrillingRate: 50, OilPrice: 80.5, ExchangeRate: 75}},
+		{"strings", `{"scenario":"2","drillingRate":" 50 ","oilPrice":"80.5","exchangeRate":"75"}`,
+			ModelRequest{Scenario: 2, DrillingRate: 50, OilPrice: 80.5, ExchangeRate: 75}},
+		{"comma decimals", `{"oilPrice":"80,5","exchangeRate":"75,25"}`,
+			ModelRequest{OilPrice: 80.5, ExchangeRate: 75.25}},
+		{"whole number with a fraction", `{"drillingRate":50.0}`, ModelRequest{DrillingRate: 50}},
+		{"nulls and missing", `{"oilPrice":null}`, ModelRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ModelRequest
+			if err := json.Unmarshal([]byte(tt.body), &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelRequestRejectsBadNumbers(t *testing.T) {
+	tests := []struct{ body, err string }{
+		{`{"oilPrice":"eighty"}`, "oilPrice must be a number"},
+		{`{"oilPrice":"1,234.5"}`, "oilPrice must be a number"},
+		{`{"oilPrice":"1,2,3"}`, "oilPrice must be a number"},
+		{`{"exchangeRate":"NaN"}`, "exchangeRate must be a number"},
+		{`{"drillingRate":50.5}`, "drillingRate must be a whole number"},
+		{`{"scenario":true}`, "scenario must be a number"},
+		{`{"seed":"1.5"}`, "seed must be a whole number"},
+		{`[1,2]`, "expected a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			var req ModelRequest
+			err := json.Unmarshal([]byte(tt.body), &req)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestModelRequestSeed(t *testing.T) {
+	var req ModelRequest
+	if err := json.Unmarshal([]byte(`{"seed":"42"}`), &req); err != nil || req.Seed == nil || *req.Seed != 42 {
+		t.Errorf("seed %v, error %v; want 42", req.Seed, err)
+	}
+}
+
+// fakeCommands puts empty executables with the given names on a PATH of
+// their own and returns its directory.
+func fakeCommands(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	return dir
+}
+
+// testConfig is loadConfig's answer for the current environment.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	cfg, err := loadConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+func TestBuildModelCommand(t *testing.T) {
+	bin := fakeCommands(t, "java")
+	cfg := testConfig(t)
+	seed := int64(7)
+	req := ModelRequest{Scenario: 2, DrillingRate: 60, OilPrice: 85.5, ExchangeRate: 74.25}
+	java := []string{"java", "-cp", buildClasspath(cfg.ModelDir), "ModelRunner"}
+
+	tests := []struct {
+		name    string
+		seed    *int64
+		project string
+		output  string
+		args    []string
+	}{
+		{"stdout", nil, "", "", []string{"2", "60", "85.50", "74.25"}},
+		{"file", nil, "", "/tmp/out.csv", []string{"2", "60", "85.50", "74.25", "/tmp/out.csv"}},
+		{"seed", &seed, "", "", []string{"2", "60", "85.50", "74.25", "--seed=7"}},
+		{"project", nil, "field-7", "", []string{"2", "60", "85.50", "74.25"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := req
+			req.Seed, req.Project = tt.seed, tt.project
+			cmd := buildModelCommand(context.Background(), cfg, req, tt.output)
+
+			if want := filepath.Join(bin, "java"); cmd.Path != want {
+				t.Errorf("Path %q, want %q", cmd.Path, want)
+			}
+			if want := append(append([]string(nil), java...), tt.args...); !reflect.DeepEqual(cmd.Args, want) {
+				t.Errorf("Args\n got %q\nwant %q", cmd.Args, want)
+			}
+			if cmd.Dir != cfg.ModelDir {
+				t.Errorf("Dir %q, want %q", cmd.Dir, cfg.ModelDir)
+			}
+			hasProject := false
+			for _, kv := range cmd.Env {
+				hasProject = hasProject || kv == "MODEL_PROJECT_ID=field-7"
+			}
+			if hasProject != (tt.project != "") {
+				t.Errorf("MODEL_PROJECT_ID=field-7 in the environment: %v, want %v", hasProject, tt.project != "")
+			}
+		})
+	}
+}
+
+func TestValidateModelArgs(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{defaultModelArgs, ""},
+		{"--scenario={scenario} --drilling={drillingRate} --out={output}", ""},
+		{"-cp {classpath} -Dmodel.dir={modelDir} ModelRunner", ""},
+		{"--project={project} --seed={seed}", ""},
+		{"--drilling={drilling}", "unknown placeholder {drilling} in MODEL_ARGS"},
+		{"{scenario}:{year}", "unknown placeholder {year} in MODEL_ARGS"},
+		{"--flag={}", "unknown placeholder {} in MODEL_ARGS"},
+	}
+	for _, tt := range tests {
+		err := validateModelArgs("MODEL_ARGS", strings.Fields(tt.template))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q rejected: %v", tt.template, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%q: error %v, want %q", tt.template, err, tt.err)
+		}
+	}
+}
+
+func TestExpandModelArgs(t *testing.T) {
+	seed := int64(42)
+	noSeed := ModelRequest{Scenario: 3, DrillingRate: 50, OilPrice: 80, ExchangeRate: 75}
+	withSeed := noSeed
+	withSeed.Seed = &seed
+
+	tests := []struct {
+		name     string
+		template string
+		req      ModelRequest
+		output   string
+		want     []string
+	}{
+		{"default without seed", defaultModelArgs, noSeed, "", []string{"3", "50", "80.00", "75.00"}},
+		{"default with seed", defaultModelArgs, withSeed, "", []string{"3", "50", "80.00", "75.00", "--seed=42"}},
+		{"named flags", "--scenario={scenario} --drilling={drillingRate}", noSeed, "", []string{"--scenario=3", "--drilling=50"}},
+		{"literal text around an empty placeholder", "--out={output} --verbose", noSeed, "", []string{"--verbose"}},
+		{"literal text around a filled placeholder", "--out={output}", noSeed, "/tmp/o.csv", []string{"--out=/tmp/o.csv"}},
+		{"one of two placeholders filled", "{scenario}:{seed}", noSeed, "", []string{"3:"}},
+		{"all of two placeholders empty", "{output}{seed}", noSeed, "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expandModelArgs(strings.Fields(tt.template), modelArgValues(tt.req, tt.output))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildModelCommandWithoutJava(t *testing.T) {
+	bin := fakeCommands(t, "python3")
+	t.Setenv("MODEL_CMD", "python3")
+	t.Setenv("MODEL_CMD_ARGS", "run.py {scenario}")
+	t.Setenv("MODEL_ARGS", "--drilling={drillingRate}")
+	cfg := testConfig(t)
+	if cfg.usesModelJar() {
+		t.Error("a template without {classpath} still needs model.jar")
+	}
+
+	cmd := buildModelCommand(context.Background(), cfg, ModelRequest{Scenario: 2, DrillingRate: 60}, "")
+	if want := filepath.Join(bin, "python3"); cmd.Path != want {
+		t.Errorf("Path %q, want %q", cmd.Path, want)
+	}
+	if want := []string{"python3", "run.py", "2", "--drilling=60"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("Args %q, want %q", cmd.Args, want)
+	}
+	for _, arg := range cmd.Args {
+		if arg == "-cp" || strings.Contains(arg, "model.jar") {
+			t.Errorf("Args %q carry a classpath", cmd.Args)
+		}
+	}
+}
+
+func TestModelCmdArgsNone(t *testing.T) {
+	fakeCommands(t, "oilmodel")
+	t.Setenv("MODEL_CMD", "oilmodel")
+	t.Setenv("MODEL_CMD_ARGS", "none")
+	cmd := buildModelCommand(context.Background(), testConfig(t), ModelRequest{Scenario: 1, DrillingRate: 50, OilPrice: 80, ExchangeRate: 75}, "")
+	if want := []string{"oilmodel", "1", "50", "80.00", "75.00"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("Args %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestStartupWarnsAboutMissingModelCmd(t *testing.T) {
+	fakeCommands(t, "java")
+	logged := captureLog(t)
+	logModelCommands(testConfig(t))
+	if !strings.Contains(logged.String(), "Model command: ") || strings.Contains(logged.String(), "WARNING") {
+		t.Errorf("java on PATH: logged %q", logged)
+	}
+
+	logged.Reset()
+	t.Setenv("MODEL_CMD", "no-such-model")
+	logModelCommands(testConfig(t))
+	if !strings.Contains(logged.String(), `WARNING: MODEL_CMD not found, model runs will fail: exec: "no-such-model"`) {
+		t.Errorf("missing command: logged %q", logged)
+	}
+}
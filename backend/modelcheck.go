@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ==================== Model self-check ====================
+
+const (
+	// modelCheckTTL is how long a check is served from cache, so a
+	// dashboard polling it doesn't start a JVM each time.
+	modelCheckTTL = 30 * time.Second
+	// modelCheckRunTimeout bounds the trial run when MODEL_TIMEOUT doesn't.
+	modelCheckRunTimeout = 2 * time.Minute
+)
+
+// ModelCheckReport is everything /api/admin/model/check looked at. Unlike
+// a warm-up it only stats the jars, and it can try a run.
+type ModelCheckReport struct {
+	Command string `json:"command"`
+	// JavaVersion is the whole `java -version` output, for the java
+	// command only.
+	JavaVersion string           `json:"javaVersion,omitempty"`
+	ModelDir    string           `json:"modelDir,omitempty"`
+	ModelJar    *ModelJarInfo    `json:"modelJar,omitempty"`
+	Classpath   []ClasspathCheck `json:"classpath,omitempty"`
+	Run         *ModelCheckRun   `json:"run,omitempty"`
+	CheckedAt   time.Time        `json:"checkedAt"`
+	DurationMs  float64          `json:"durationMs"`
+	Ready       bool             `json:"ready"`
+	Problems    []string         `json:"problems,omitempty"`
+	Cached      bool             `json:"cached"`
+}
+
+// ClasspathCheck is one buildClasspath entry and the jars it stands for.
+type ClasspathCheck struct {
+	Entry string     `json:"entry"`
+	Jars  []JarCheck `json:"jars"`
+}
+
+// JarCheck is what stat said about a classpath jar.
+type JarCheck struct {
+	Path    string     `json:"path"`
+	Size    int64      `json:"size"`
+	ModTime *time.Time `json:"modTime,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ModelCheckRun is the trial run: the scenario defaults, no seed, nothing
+// cached or logged.
+type ModelCheckRun struct {
+	Request    ModelRequest `json:"request"`
+	Backend    string       `json:"backend,omitempty"`
+	Results    int          `json:"results"`
+	DurationMs float64      `json:"durationMs"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// modelCheckCache keeps the last report with and without a trial run. mu
+// only guards reports; a check runs outside it, in flight.
+type modelCheckCache struct {
+	mu      sync.Mutex
+	reports map[bool]ModelCheckReport
+	flight  singleflight.Group // keyed by run
+}
+
+// checkModel reports on MODEL_CMD, java, the classpath and, with run, a
+// trial run.
+func (s *Server) checkModel(run bool) ModelCheckReport {
+	start := time.Now()
+	cfg := s.config()
+	rep := ModelCheckReport{CheckedAt: start.UTC()}
+
+	path, err := exec.LookPath(cfg.ModelCmd)
+	if err != nil {
+		rep.Problems = append(rep.Problems, err.Error())
+	}
+	rep.Command = path
+	if err == nil && filepath.Base(path) == "java" {
+		rep.JavaVersion, err = javaVersion(path)
+		if err != nil {
+			rep.Problems = append(rep.Problems, "java -version failed: "+err.Error())
+		}
+	}
+
+	if cfg.usesModelJar() {
+		rep.ModelDir = cfg.ModelDir
+		jar := s.refreshModelJar()
+		rep.ModelJar = &jar
+		if !jar.Valid {
+			rep.Problems = append(rep.Problems, "model.jar: "+jar.Error)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.ModelDir, "ModelRunner.class")); err != nil {
+			rep.Problems = append(rep.Problems, err.Error())
+		}
+		for _, entry := range strings.Split(buildClasspath(cfg.ModelDir), ":") {
+			rep.Classpath = append(rep.Classpath, checkClasspathEntry(entry, &rep.Problems))
+		}
+	}
+
+	if run {
+		rep.Run = s.trialRun(cfg)
+		if rep.Run.Error != "" {
+			rep.Problems = append(rep.Problems, "trial run: "+rep.Run.Error)
+		}
+	}
+
+	rep.Ready = len(rep.Problems) == 0
+	rep.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return rep
+}
+
+func checkClasspathEntry(entry string, problems *[]string) ClasspathCheck {
+	c := ClasspathCheck{Entry: entry, Jars: []JarCheck{}}
+	for _, jar := range classpathJars(entry) {
+		j := JarCheck{Path: jar}
+		fi, err := os.Stat(jar)
+		if err != nil {
+			j.Error = err.Error()
+			*problems = append(*problems, err.Error())
+		} else {
+			t := fi.ModTime().UTC()
+			j.Size, j.ModTime = fi.Size(), &t
+		}
+		c.Jars = append(c.Jars, j)
+	}
+	return c
+}
+
+// trialRun runs the model on the first scenario's defaults. It waits for
+// a run slot like any other run, but stays out of the result cache, the
+// running list and request_logs.
+func (s *Server) trialRun(cfg Config) *ModelCheckRun {
+	tr := &ModelCheckRun{}
+	if err := s.validateModelRequest(&tr.Request); err != nil {
+		tr.Error = err.Error()
+		return tr
+	}
+	tr.Request.Requested = nil
+
+	timeout := cfg.ModelTimeout
+	if timeout <= 0 {
+		timeout = modelCheckRunTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	release, err := s.acquireRunSlot(ctx)
+	if err != nil {
+		tr.Error = err.Error()
+		return tr
+	}
+	defer release()
+
+	start := time.Now()
+	out, err := s.runner.Run(ctx, tr.Request)
+	tr.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	tr.Backend, tr.Results = out.Backend, len(out.Results)
+	switch {
+	case err != nil:
+		tr.Error = err.Error()
+	case out.Partial:
+		tr.Error = "cut short: " + abortReason(ctx.Err(), timeout)
+	case len(out.Results) == 0:
+		tr.Error = "the model produced no results"
+	}
+	return tr
+}
+
+// cachedModelCheck returns a report younger than modelCheckTTL, or checks
+// again. Callers arriving during a check of the same kind wait for it
+// instead of starting their own; a trial run doesn't hold up a check
+// without one, or a cached answer.
+func (s *Server) cachedModelCheck(run, refresh bool) ModelCheckReport {
+	c := &s.modelChecks
+	c.mu.Lock()
+	rep, ok := c.reports[run]
+	c.mu.Unlock()
+	if ok && !refresh && time.Since(rep.CheckedAt) < modelCheckTTL {
+		rep.Cached = true
+		return rep
+	}
+	v, _, _ := c.flight.Do(strconv.FormatBool(run), func() (interface{}, error) {
+		rep := s.checkModel(run)
+		c.mu.Lock()
+		if c.reports == nil {
+			c.reports = make(map[bool]ModelCheckReport)
+		}
+		c.reports[run] = rep
+		c.mu.Unlock()
+		return rep, nil
+	})
+	return v.(ModelCheckReport)
+}
+
+// handleModelCheck is GET /api/admin/model/check: a self-test of the
+// model setup, with ?run=true a trial run too. ?refresh=true skips the
+// cache.
+func (s *Server) handleModelCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	run := q.Get("run") == "true"
+	rep := s.cachedModelCheck(run, q.Get("refresh") == "true")
+	if !rep.Cached {
+		if rep.Ready {
+			log.Printf("[%s] Model check OK in %.0fms", r.Header.Get("X-Username"), rep.DurationMs)
+		} else {
+			log.Printf("[%s] Model check found problems: %s", r.Header.Get("X-Username"), strings.Join(rep.Problems, "; "))
+		}
+	}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: rep})
+}
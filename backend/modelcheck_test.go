@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestModelCheckIsCached(t *testing.T) {
+	runner := &fakeRunner{}
+	s := newTestServer(t, runner, nil)
+	h := s.routes(t.TempDir())
+	token := s.login("admin")
+	check := func(query string) ModelCheckReport {
+		t.Helper()
+		var rep ModelCheckReport
+		decodeResponse(t, serve(t, h, "GET", "/api/admin/model/check"+query, token, nil), &rep)
+		return rep
+	}
+
+	first := check("?run=true")
+	if first.Cached || first.Run == nil || runner.callCount() != 1 {
+		t.Fatalf("first check: cached %v, run %+v after %d runs", first.Cached, first.Run, runner.callCount())
+	}
+	again := check("?run=true")
+	if !again.Cached || !again.CheckedAt.Equal(first.CheckedAt) || runner.callCount() != 1 {
+		t.Errorf("second check: cached %v, checked at %s after %d runs; want the first report", again.Cached, again.CheckedAt, runner.callCount())
+	}
+	if rep := check(""); rep.Cached || rep.Run != nil {
+		t.Errorf("check without a run answered from the trial run's cache entry: %+v", rep)
+	}
+	if rep := check("?run=true&refresh=true"); rep.Cached || runner.callCount() != 2 {
+		t.Errorf("refresh: cached %v after %d runs, want a new trial run", rep.Cached, runner.callCount())
+	}
+
+	s.modelChecks.mu.Lock()
+	rep := s.modelChecks.reports[true]
+	rep.CheckedAt = rep.CheckedAt.Add(-modelCheckTTL)
+	s.modelChecks.reports[true] = rep
+	s.modelChecks.mu.Unlock()
+	if rep := check("?run=true"); rep.Cached || runner.callCount() != 3 {
+		t.Errorf("after modelCheckTTL: cached %v after %d runs, want a new trial run", rep.Cached, runner.callCount())
+	}
+}
+
+func TestModelCheckWithoutRunDoesNotWaitForTrialRun(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	runner := &fakeRunner{run: func(_ context.Context, req ModelRequest) (ModelOutput, error) {
+		close(started)
+		<-release
+		return ModelOutput{Results: fakeResults(req, 1)}, nil
+	}}
+	s := newTestServer(t, runner, nil)
+	trial := make(chan ModelCheckReport)
+	go func() { trial <- s.cachedModelCheck(true, false) }()
+	<-started
+
+	quick := make(chan ModelCheckReport)
+	go func() { quick <- s.cachedModelCheck(false, false) }()
+	select {
+	case rep := <-quick:
+		if rep.Run != nil {
+			t.Errorf("check without a run has a run: %+v", rep.Run)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("check without a run waited for the trial run")
+	}
+
+	close(release)
+	if rep := <-trial; rep.Run == nil || rep.Run.Error != "" {
+		t.Errorf("trial run: %+v", rep.Run)
+	}
+}
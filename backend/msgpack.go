@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ==================== MessagePack ====================
+
+// msgpackContentType is what a MessagePack answer is sent as.
+const msgpackContentType = "application/msgpack"
+
+// encodeMsgpack encodes v as MessagePack with the same shape as its JSON:
+// v goes through encoding/json first, so SimulationResult and the rest
+// keep their json field names, omitempty and custom marshalers. A
+// whole number comes out as the smallest integer that holds it, any
+// other number as a float64, and map keys are sorted.
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeMsgpackValue(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeMsgpackValue(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("msgpack: bad number %q", v)
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpackValue(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			writeMsgpackValue(buf, k)
+			if err := writeMsgpackValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unexpected %T", v)
+	}
+	return nil
+}
+
+// writeMsgpackInt writes n in the smallest integer format that holds it.
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		buf.WriteByte(byte(n)) // positive fixint
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(n)) // negative fixint
+	case n >= 0 && n <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(n)})
+	case n >= 0 && n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	case n >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(n))
+	case n >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(n)})
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeMsgpackHeader writes the length prefix of a string, array or map:
+// the fix form below fixMax, else the 8-bit form (strings only; 0 means
+// none), the 16-bit or the 32-bit one.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, c8, c16, c32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{c8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(c16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(c32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMsgpack is writeJSON for a MessagePack answer: the same envelope
+// rule and MAX_RESPONSE_BYTES limit. Errors stay JSON, through sendError.
+func (s *Server) writeMsgpack(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if resp, ok := v.(APIResponse); ok && resp.Success && resp.Data != nil && !s.wantEnvelope(r) {
+		v = resp.Data
+	}
+
+	body, err := encodeMsgpack(v)
+	if err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		s.sendError(w, r, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	if limit := s.config().MaxResponseBytes; limit > 0 && len(body) > limit && status < 300 {
+		log.Printf("Response for %s %s (request %s) is %d bytes, over MAX_RESPONSE_BYTES %d",
+			r.Method, r.URL.Path, requestID(r), len(body), limit)
+		s.sendErrorCode(w, r, fmt.Sprintf("Response would be %d bytes, over the %d byte limit; narrow the query (fewer years or scenarios)", len(body), limit),
+			"response_too_large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", msgpackContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Failed to write response for %s %s (request %s): %v", r.Method, r.URL.Path, requestID(r), err)
+	}
+}
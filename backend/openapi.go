@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ==================== OpenAPI ====================
+
+// The spec served at /api/openapi.json is built from apiOperations, with
+// the request and response schemas reflected from the structs the
+// handlers decode and answer with. routes checks the table against the
+// patterns it registers and logs any that only one of them has.
+
+// Who may call an operation.
+const (
+	authNone  = ""
+	authUser  = "user"
+	authAdmin = "admin"
+)
+
+// apiOperation describes one method on one route. Request and Data are
+// zero values of the body and of APIResponse.Data; nil leaves the body out
+// or the data a plain object. Produces is set for answers other than the
+// JSON envelope.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Auth     string
+	Summary  string
+	Request  interface{}
+	Data     interface{}
+	Produces string
+}
+
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/api/login", Summary: "Log in with username and password; ?refresh=true also returns a refresh token", Request: User{}},
+	{Method: "POST", Path: "/api/register", Summary: "Register a new user", Request: User{}},
+	{Method: "POST", Path: "/api/logout", Auth: authUser, Summary: "End the current session and revoke its refresh token", Request: RefreshRequest{}},
+	{Method: "POST", Path: "/api/refresh", Summary: "Exchange a refresh token for a new access token", Request: RefreshRequest{}},
+	{Method: "GET", Path: "/api/token/verify", Summary: "Status and remaining TTL of the bearer token", Data: TokenStatus{}},
+	{Method: "POST", Path: "/api/change-password", Auth: authUser, Summary: "Change the caller's password", Request: ChangePasswordRequest{}},
+	{Method: "POST", Path: "/api/run-model", Auth: authUser, Summary: "Run the model with the given parameters; ?format=msgpack for MessagePack, ?fields= to keep only some result keys", Request: ModelRequest{}},
+	{Method: "POST", Path: "/api/compare", Auth: authUser, Summary: "Run several scenarios with the same parameters", Request: CompareRequest{}},
+	{Method: "POST", Path: "/api/estimate", Auth: authUser, Summary: "Expected duration of a sweep", Request: EstimateRequest{}},
+	{Method: "POST", Path: "/api/sensitivity", Auth: authUser, Summary: "Change in total revenue when each parameter is raised by delta", Request: ModelRequest{}},
+	{Method: "GET", Path: "/api/preferences", Auth: authUser, Summary: "The caller's preferences", Data: Preferences{}},
+	{Method: "PUT", Path: "/api/preferences", Auth: authUser, Summary: "Replace the caller's preferences", Request: Preferences{}, Data: Preferences{}},
+	{Method: "GET", Path: "/api/history", Auth: authUser, Summary: "The caller's run history", Data: []RequestLog{}},
+	{Method: "GET", Path: "/api/history/curves", Auth: authUser, Summary: "One metric by year across the caller's last runs", Data: []CurveSeries{}},
+	{Method: "POST", Path: "/api/history/timeline", Auth: authUser, Summary: "Signed URL of an iCalendar feed of the caller's runs"},
+	{Method: "GET", Path: "/api/history/timeline.ics", Summary: "The feed; authenticated by ?token= from /api/history/timeline", Produces: "text/calendar"},
+	{Method: "POST", Path: "/api/history/import", Auth: authAdmin, Summary: "Bulk-insert history records", Request: []RequestLog{}},
+	{Method: "POST", Path: "/api/history/{id}/baseline", Auth: authUser, Summary: "Mark a run as the caller's baseline"},
+	{Method: "POST", Path: "/api/history/{id}/reparse", Auth: authUser, Summary: "Parse a run's stored model output again"},
+	{Method: "POST", Path: "/api/history/{id}/share", Auth: authUser, Summary: "Signed, expiring read-only link to a run"},
+	{Method: "GET", Path: "/api/history/{id}/report.html", Auth: authUser, Summary: "A stored run as a standalone HTML page with chart and table", Produces: "text/html"},
+	{Method: "GET", Path: "/api/shared/{token}", Summary: "Results of a shared run"},
+	{Method: "GET", Path: "/api/export", Auth: authUser, Summary: "Download a run's results as CSV, XLSX or Parquet", Produces: "application/octet-stream"},
+	{Method: "POST", Path: "/api/report", Auth: authUser, Summary: "One file with several stored runs", Request: ReportRequest{}, Produces: "application/octet-stream"},
+	{Method: "POST", Path: "/api/jobs", Auth: authUser, Summary: "Run the model in the background", Request: JobRequest{}, Data: Job{}},
+	{Method: "GET", Path: "/api/jobs/{id}", Auth: authUser, Summary: "Job status and results", Data: Job{}},
+	{Method: "DELETE", Path: "/api/jobs/{id}", Auth: authUser, Summary: "Cancel a running job", Data: Job{}},
+	{Method: "GET", Path: "/api/jobs/{id}/tail", Auth: authUser, Summary: "Rows a job has produced past ?offset=, before or after it finishes"},
+	{Method: "GET", Path: "/api/scenarios", Summary: "Scenarios and their default parameters", Data: []Scenario{}},
+	{Method: "GET", Path: "/api/status", Summary: "Server status"},
+	{Method: "GET", Path: "/api/ready", Summary: "Readiness; 503 when the model can't run"},
+	{Method: "GET", Path: "/api/openapi.json", Summary: "This document", Produces: "application/json"},
+	{Method: "GET", Path: "/api/stats/result-sizes", Auth: authAdmin, Summary: "Histogram of result counts over successful runs"},
+	{Method: "GET", Path: "/api/metrics.json", Auth: authAdmin, Summary: "Run counters and duration histograms", Data: MetricsSnapshot{}},
+	{Method: "GET", Path: "/metrics", Summary: "Metrics in Prometheus text format", Produces: "text/plain"},
+	{Method: "POST", Path: "/api/admin/maintenance", Auth: authAdmin, Summary: "Turn maintenance mode on or off", Request: MaintenanceRequest{}, Data: MaintenanceState{}},
+	{Method: "GET", Path: "/api/admin/running", Auth: authAdmin, Summary: "Model runs in progress", Data: []RunningModel{}},
+	{Method: "POST", Path: "/api/admin/cache/invalidate", Auth: authAdmin, Summary: "Drop cached results matching the filter", Request: CacheFilter{}},
+	{Method: "POST", Path: "/api/admin/warm", Auth: authAdmin, Summary: "Check the model command and preload the classpath", Data: WarmupReport{}},
+	{Method: "GET", Path: "/api/admin/model/check", Auth: authAdmin, Summary: "Self-test of java, the classpath and, with ?run=true, a trial run", Data: ModelCheckReport{}},
+	{Method: "GET", Path: "/api/admin/stream/requests", Auth: authAdmin, Summary: "Server-sent event per finished model run", Produces: "text/event-stream"},
+	{Method: "GET", Path: "/api/admin/logs", Auth: authAdmin, Summary: "Tail or download LOG_FILE"},
+	{Method: "GET", Path: "/api/admin/config", Auth: authAdmin, Summary: "Active configuration, secrets redacted"},
+	{Method: "POST", Path: "/api/admin/users/{name}/disable", Auth: authAdmin, Summary: "Disable an account and end its sessions"},
+	{Method: "POST", Path: "/api/admin/users/{name}/enable", Auth: authAdmin, Summary: "Re-enable a disabled account"},
+	{Method: "GET", Path: "/api/admin/apikeys", Auth: authAdmin, Summary: "Service account API keys", Data: []APIKey{}},
+	{Method: "POST", Path: "/api/admin/apikeys", Auth: authAdmin, Summary: "Create an API key", Request: CreateAPIKeyRequest{}},
+	{Method: "DELETE", Path: "/api/admin/apikeys/{id}", Auth: authAdmin, Summary: "Revoke an API key"},
+	{Method: "GET", Path: "/api/admin/audit", Auth: authAdmin, Summary: "Admin actions, newest first; ?limit=, ?offset=, ?admin=", Data: []AuditEntry{}},
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// checkAPIOperations logs the registered patterns apiOperations doesn't
+// describe and the operation paths nothing is registered for.
+func checkAPIOperations(patterns []string) {
+	registered := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		registered[p] = true
+	}
+	described := make(map[string]bool, len(apiOperations))
+	for _, op := range apiOperations {
+		described[op.Path] = true
+		if !registered[op.Path] {
+			log.Printf("WARNING: OpenAPI spec describes %s %s, which has no route", op.Method, op.Path)
+		}
+	}
+	for _, p := range patterns {
+		if p != "/" && !described[p] {
+			log.Printf("WARNING: route %s is missing from the OpenAPI spec", p)
+		}
+	}
+}
+
+// schemaBuilder reflects Go types into OpenAPI schemas, collecting named
+// structs under components/schemas.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = nil // a placeholder, for recursive types
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object is a struct's schema by its JSON field names. Embedded structs
+// without a tag are flattened, as encoding/json does. No field is marked
+// required: most request fields have defaults, and the handlers say which
+// are missing.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	b.addFields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, props map[string]interface{}) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(f.Type, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+	}
+}
+
+// openAPISpec builds the document from apiOperations. The result metrics
+// carry their units as x-unit.
+func openAPISpec(units map[string]string) map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	envelope := b.schema(reflect.TypeOf(APIResponse{}))
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelope}},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": operationID(op),
+		}
+
+		var params []interface{}
+		for _, m := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		var ok map[string]interface{}
+		switch {
+		case op.Produces != "":
+			ok = map[string]interface{}{"description": "OK", "content": map[string]interface{}{op.Produces: map[string]interface{}{}}}
+		default:
+			data := map[string]interface{}{"type": "object"}
+			if op.Data != nil {
+				data = b.schema(reflect.TypeOf(op.Data))
+			}
+			ok = map[string]interface{}{
+				"description": "OK",
+				"content": map[string]interface{}{"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"allOf": []interface{}{
+						envelope,
+						map[string]interface{}{"type": "object", "properties": map[string]interface{}{"data": data}},
+					}},
+				}},
+			}
+		}
+		operation["responses"] = map[string]interface{}{"200": ok, "default": errorResponse}
+
+		switch op.Auth {
+		case authUser:
+			operation["security"] = []interface{}{
+				map[string]interface{}{"bearerAuth": []string{}},
+				map[string]interface{}{"apiKey": []string{}},
+			}
+		case authAdmin:
+			operation["security"] = []interface{}{
+				map[string]interface{}{"bearerAuth": []string{}},
+				map[string]interface{}{"apiKey": []string{scopeAdmin}},
+			}
+			operation["description"] = "Requires an ADMIN_USERS account, or an API key with the admin scope."
+		default:
+			operation["security"] = []interface{}{}
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]interface{})
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	if result, ok := b.components["SimulationResult"].(map[string]interface{}); ok {
+		props := result["properties"].(map[string]interface{})
+		for metric, unit := range units {
+			if p, ok := props[metric].(map[string]interface{}); ok {
+				p["x-unit"] = unit
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Modelirovanie API",
+			"version": serverVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "Access token from /api/login"},
+				"apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "Service account key; GET needs the read scope, other methods run"},
+			},
+		},
+	}
+}
+
+// operationID is e.g. postApiHistoryIdReparse.
+func operationID(op apiOperation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// handleOpenAPI is GET /api/openapi.json. The document is bare, without
+// the response envelope.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.MarshalIndent(openAPISpec(s.config().ResultUnits), "", "  ")
+	if err != nil {
+		s.sendError(w, r, "Failed to build the OpenAPI spec: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ==================== Preferences ====================
+
+const (
+	outputJSON    = "json"
+	outputCSV     = "csv"
+	outputMsgpack = "msgpack"
+)
+
+// outputMediaTypes maps the Accept media types /api/run-model serves to
+// their output format.
+var outputMediaTypes = map[string]string{
+	"application/json":      outputJSON,
+	"text/csv":              outputCSV,
+	msgpackContentType:      outputMsgpack,
+	"application/x-msgpack": outputMsgpack,
+}
+
+// Preferences are per-user defaults. OutputFormat is what /api/run-model
+// answers when the request's Accept header doesn't choose.
+type Preferences struct {
+	OutputFormat string `json:"outputFormat"`
+}
+
+var defaultPreferences = Preferences{OutputFormat: outputJSON}
+
+// getPreferences returns username's preferences, or the defaults when
+// none are stored.
+func (s *Server) getPreferences(username string) (Preferences, error) {
+	if s.database() == nil {
+		return defaultPreferences, fmt.Errorf("database not connected")
+	}
+
+	prefs := defaultPreferences
+	query := `SELECT output_format FROM preferences WHERE username = $1`
+	err := s.database().QueryRow(query, s.logUsername(username)).Scan(&prefs.OutputFormat)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultPreferences, nil
+	}
+	return prefs, err
+}
+
+func (s *Server) setPreferences(username string, prefs Preferences) error {
+	if s.database() == nil {
+		return fmt.Errorf("database not connected")
+	}
+	query := `INSERT INTO preferences (username, output_format) VALUES ($1, $2)
+			  ON CONFLICT (username) DO UPDATE SET output_format = EXCLUDED.output_format, updated_at = CURRENT_TIMESTAMP`
+	_, err := s.database().Exec(query, s.logUsername(username), prefs.OutputFormat)
+	return err
+}
+
+// acceptedOutput picks the output format an Accept header asks for: the
+// first listed type that is served, ignoring q-values. It returns "" when
+// the header is missing or only has wildcards, leaving the choice to the
+// user's preference; other unknown types get JSON.
+func acceptedOutput(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return ""
+	}
+	onlyWildcards := true
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if format, ok := outputMediaTypes[mediaType]; ok {
+			return format
+		}
+		if mediaType != "*/*" && mediaType != "text/*" && mediaType != "application/*" {
+			onlyWildcards = false
+		}
+	}
+	if onlyWildcards {
+		return ""
+	}
+	return outputJSON
+}
+
+// outputFormat is the format a successful /api/run-model answer takes.
+// ?format= wins, then the Accept header; a preference that can't be loaded
+// falls back to JSON. MessagePack is never a stored preference, since the
+// frontend can't read it.
+func (s *Server) outputFormat(r *http.Request, username string) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case outputJSON, outputCSV, outputMsgpack:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Unsupported format %q (use json, csv or msgpack)", format)
+	}
+	if format := acceptedOutput(r.Header.Get("Accept")); format != "" {
+		return format, nil
+	}
+	prefs, err := s.getPreferences(username)
+	if err != nil && s.database() != nil {
+		s.errorLog.Printf("Failed to load preferences, answering JSON: %v", err)
+	}
+	return prefs.OutputFormat, nil
+}
+
+// handlePreferences is GET and PUT /api/preferences. PUT replaces the
+// caller's preferences; omitted fields go back to their defaults.
+func (s *Server) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("X-Username")
+
+	switch r.Method {
+	case "GET":
+		prefs, err := s.getPreferences(username)
+		if err != nil {
+			s.sendError(w, r, "Failed to load preferences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Data: prefs})
+	case "PUT":
+		prefs := defaultPreferences
+		if err := s.decodeJSON(r, &prefs); err != nil {
+			s.sendDecodeError(w, r, err)
+			return
+		}
+		if prefs.OutputFormat != outputJSON && prefs.OutputFormat != outputCSV {
+			s.sendError(w, r, fmt.Sprintf("Unsupported outputFormat %q (use json or csv)", prefs.OutputFormat), http.StatusBadRequest)
+			return
+		}
+		if err := s.setPreferences(username, prefs); err != nil {
+			s.sendError(w, r, "Failed to save preferences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[%s] Preferences updated: outputFormat=%s", username, prefs.OutputFormat)
+		s.writeJSON(w, r, http.StatusOK, APIResponse{Success: true, Message: "Preferences saved", Data: prefs})
+	default:
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
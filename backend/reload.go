@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// ==================== Reload ====================
+
+// reloadableFields are the Config fields a SIGHUP may change. Everything
+// else (the database, model dir, username hashing, seeded accounts and the
+// HTTP server's own timeouts) is fixed at startup.
+var reloadableFields = map[string]bool{
+	"VerboseErrors":        true,
+	"CORSOrigins":          true,
+	"ProjectHeader":        true,
+	"StaticExtensions":     true,
+	"ModelCmd":             true,
+	"ModelCmdArgs":         true,
+	"ModelArgs":            true,
+	"ModelOutputMode":      true,
+	"ModelOutputCharset":   true,
+	"ModelMaxLineBytes":    true,
+	"ModelTimeout":         true,
+	"QueueWaitTimeout":     true,
+	"SlowRunThreshold":     true,
+	"CSVHeader":            true,
+	"CSVMapping":           true,
+	"DedupeResults":        true,
+	"ModelLogPrefix":       true,
+	"RawOutputMaxBytes":    true,
+	"SecurityHeaders":      true,
+	"SessionTTL":           true,
+	"AccessTokenTTL":       true,
+	"RefreshTokenTTL":      true,
+	"AdminUsers":           true,
+	"PasswordPolicy":       true,
+	"ResultCacheTTL":       true,
+	"ResponseEnvelope":     true,
+	"MaxResponseBytes":     true,
+	"ModelFallbacks":       true,
+	"StoreRawOutput":       true,
+	"MaxBodyBytes":         true,
+	"MaxImportBodyBytes":   true,
+	"CallbackAllowedHosts": true,
+	"JobRetention":         true,
+	"DiscountRate":         true,
+	"SensitivityDelta":     true,
+	"ResultUnits":          true,
+	"StrictJSON":           true,
+	"EndpointLimits":       true,
+	"EndpointLimitDefault": true,
+	"ParamRules":           true,
+	"ScenarioRules":        true,
+	"ResultSizeBuckets":    true,
+	"ShareTTL":             true,
+	"TimelineTTL":          true,
+	"TimelineMaxEvents":    true,
+}
+
+// applyReload returns cur with the reloadable fields taken from next,
+// describing each one that changed. fixed names the other fields that
+// differ and are left alone.
+func applyReload(cur, next Config) (merged Config, changed, fixed []string) {
+	merged = cur
+	mv := reflect.ValueOf(&merged).Elem()
+	nv := reflect.ValueOf(next)
+	t := mv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if reflect.DeepEqual(mv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableFields[name] {
+			fixed = append(fixed, name)
+			continue
+		}
+		changed = append(changed, fmt.Sprintf("%s: %v -> %v", name, mv.Field(i).Interface(), nv.Field(i).Interface()))
+		mv.Field(i).Set(nv.Field(i))
+	}
+	return merged, changed, fixed
+}
+
+// reloadConfig re-reads the configuration and swaps in its reloadable
+// fields. An invalid configuration leaves the active one untouched.
+func (s *Server) reloadConfig(projectRoot string) error {
+	next, err := loadConfig(projectRoot)
+	if err != nil {
+		return err
+	}
+	cur := s.config()
+	merged, changed, fixed := applyReload(cur, next)
+	// WriteTimeout belongs to the running http.Server and can't follow.
+	if merged.WriteTimeout > 0 && merged.longestRun() >= merged.WriteTimeout {
+		return fmt.Errorf("MODEL_TIMEOUT plus any QUEUE_WAIT_TIMEOUT (%s) must stay below the HTTP_WRITE_TIMEOUT the server started with (%s)",
+			merged.longestRun(), merged.WriteTimeout)
+	}
+
+	s.cfg.Store(merged)
+	if len(changed) == 0 {
+		log.Printf("Config reloaded, nothing changed")
+	} else {
+		log.Printf("Config reloaded: %s", strings.Join(changed, "; "))
+	}
+	if len(fixed) > 0 {
+		log.Printf("Config reload ignored %s (restart to apply)", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+// reloadOnSIGHUP reloads the configuration each time the process gets
+// SIGHUP.
+func (s *Server) reloadOnSIGHUP(projectRoot string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := s.reloadConfig(projectRoot); err != nil {
+			log.Printf("Config reload failed, keeping the current config: %v", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile points CONFIG_FILE at a file holding lines.
+func writeConfigFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestReloadChangesModelTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.env")
+	writeConfigFile(t, path, "MODEL_TIMEOUT=5m", "HTTP_WRITE_TIMEOUT=30m", "DATABASE_URL=host=a")
+
+	var deadline time.Time
+	runner := &fakeRunner{run: func(ctx context.Context, req ModelRequest) (ModelOutput, error) {
+		deadline, _ = ctx.Deadline()
+		return ModelOutput{Results: fakeResults(req, 1)}, nil
+	}}
+	s := newTestServer(t, runner, nil)
+	if got := s.config().ModelTimeout; got != 5*time.Minute {
+		t.Fatalf("ModelTimeout %s before the reload, want 5m", got)
+	}
+
+	writeConfigFile(t, path, "MODEL_TIMEOUT=10m", "HTTP_WRITE_TIMEOUT=30m", "DATABASE_URL=host=b")
+	if err := s.reloadConfig(t.TempDir()); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	cfg := s.config()
+	if cfg.ModelTimeout != 10*time.Minute {
+		t.Errorf("ModelTimeout %s after the reload, want 10m", cfg.ModelTimeout)
+	}
+	if cfg.DatabaseURL != "host=a" {
+		t.Errorf("DATABASE_URL followed the reload to %q; it needs a restart", cfg.DatabaseURL)
+	}
+
+	start := time.Now()
+	if _, err := s.executeModel(context.Background(), "run", "user", ModelRequest{Scenario: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if d := deadline.Sub(start); d < 9*time.Minute || d > 11*time.Minute {
+		t.Errorf("run deadline %s away, want the reloaded 10m", d)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.env")
+	writeConfigFile(t, path, "MODEL_TIMEOUT=3m", "HTTP_WRITE_TIMEOUT=30m")
+	s := newTestServer(t, nil, nil)
+
+	// Runs would now outlast the write timeout the server started with.
+	writeConfigFile(t, path, "MODEL_TIMEOUT=40m", "HTTP_WRITE_TIMEOUT=60m")
+	if err := s.reloadConfig(t.TempDir()); err == nil {
+		t.Fatal("reloadConfig accepted MODEL_TIMEOUT past the running HTTP_WRITE_TIMEOUT")
+	}
+	writeConfigFile(t, path, "MODEL_OUTPUT_MODE=carrier-pigeon")
+	if err := s.reloadConfig(t.TempDir()); err == nil {
+		t.Fatal("reloadConfig accepted an invalid MODEL_OUTPUT_MODE")
+	}
+	// A value that doesn't parse fails the reload too, rather than
+	// quietly becoming the default.
+	writeConfigFile(t, path, "MODEL_TIMEOUT=10 minutes", "HTTP_WRITE_TIMEOUT=30m")
+	if err := s.reloadConfig(t.TempDir()); err == nil || !strings.Contains(err.Error(), "MODEL_TIMEOUT") {
+		t.Fatalf("reloadConfig error %v, want one naming MODEL_TIMEOUT", err)
+	}
+	writeConfigFile(t, path, "MODEL_TIMEOUT=3m", "HTTP_WRITE_TIMEOUT=30m", "DEDUPE_RESULTS=yes")
+	if err := s.reloadConfig(t.TempDir()); err == nil || !strings.Contains(err.Error(), "DEDUPE_RESULTS") {
+		t.Fatalf("reloadConfig error %v, want one naming DEDUPE_RESULTS", err)
+	}
+	// What it started with, not the 5m default.
+	if got := s.config().ModelTimeout; got != 3*time.Minute {
+		t.Errorf("ModelTimeout %s after failed reloads, want 3m", got)
+	}
+}
+
+func TestApplyReload(t *testing.T) {
+	cur := Config{ModelTimeout: time.Minute, DatabaseURL: "a", DedupeResults: false}
+	next := Config{ModelTimeout: 2 * time.Minute, DatabaseURL: "b", DedupeResults: true}
+	merged, changed, fixed := applyReload(cur, next)
+	if merged.ModelTimeout != 2*time.Minute || !merged.DedupeResults || merged.DatabaseURL != "a" {
+		t.Errorf("merged %+v, want the new timeout and dedupe with the old database", merged)
+	}
+	if len(changed) != 2 || len(fixed) != 1 || fixed[0] != "DatabaseURL" {
+		t.Errorf("changed %q, fixed %q", changed, fixed)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ==================== Replications ====================
+
+// maxReplications bounds ?replications= on /api/run-model.
+const maxReplications = 100
+
+// replicationParallelism is how many replications run at once when
+// MAX_CONCURRENT_RUNS doesn't set the limit.
+const replicationParallelism = 4
+
+// runParallelism is how many runs of one request run at once.
+func (s *Server) runParallelism() int {
+	if m := s.config().MaxConcurrentRuns; m > 0 {
+		return m
+	}
+	return replicationParallelism
+}
+
+// Band summarizes one metric across replications for one year.
+type Band struct {
+	Mean float64 `json:"mean"`
+	P10  float64 `json:"p10"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+}
+
+// ReplicationBand is one year of the bands. Runs counts the replications
+// that produced a row for the year.
+type ReplicationBand struct {
+	Year             float64 `json:"year"`
+	Runs             int     `json:"runs"`
+	Revenue          Band    `json:"revenue"`
+	ProductionVolume Band    `json:"productionVolume"`
+	NewWellsFund     Band    `json:"newWellsFund"`
+	OldWellsFund     Band    `json:"oldWellsFund"`
+}
+
+// Replication is one of the individual runs behind the bands.
+type Replication struct {
+	Seed    int64              `json:"seed"`
+	Results []SimulationResult `json:"results"`
+}
+
+// percentile interpolates linearly between the closest ranks of sorted,
+// which must not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	pos := p * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	if lo+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (pos-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+func bandOf(values []float64) Band {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return Band{
+		Mean: sum / float64(len(sorted)),
+		P10:  percentile(sorted, 0.1),
+		P50:  percentile(sorted, 0.5),
+		P90:  percentile(sorted, 0.9),
+	}
+}
+
+// replicationBands computes per-year bands over runs, in year order.
+func replicationBands(runs [][]SimulationResult) []ReplicationBand {
+	byYear := make(map[float64][]SimulationResult)
+	for _, results := range runs {
+		for _, r := range results {
+			byYear[r.Year] = append(byYear[r.Year], r)
+		}
+	}
+
+	bands := make([]ReplicationBand, 0, len(byYear))
+	for year, rows := range byYear {
+		metric := func(f func(SimulationResult) float64) Band {
+			values := make([]float64, len(rows))
+			for i, r := range rows {
+				values[i] = f(r)
+			}
+			return bandOf(values)
+		}
+		bands = append(bands, ReplicationBand{
+			Year:             year,
+			Runs:             len(rows),
+			Revenue:          metric(func(r SimulationResult) float64 { return r.Revenue }),
+			ProductionVolume: metric(func(r SimulationResult) float64 { return r.ProductionVolume }),
+			NewWellsFund:     metric(func(r SimulationResult) float64 { return r.NewWellsFund }),
+			OldWellsFund:     metric(func(r SimulationResult) float64 { return r.OldWellsFund }),
+		})
+	}
+	sort.Slice(bands, func(i, j int) bool { return bands[i].Year < bands[j].Year })
+	return bands
+}
+
+// parseReplications reads ?replications=; 0 means a single ordinary run.
+func parseReplications(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("replications")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxReplications {
+		return 0, fmt.Errorf("replications must be between 1 and %d", maxReplications)
+	}
+	return n, nil
+}
+
+// handleReplications runs req n times with consecutive seeds, starting at
+// req.Seed or a random one, and answers the bands and the runs.
+func (s *Server) handleReplications(w http.ResponseWriter, r *http.Request, username string, req ModelRequest, n int) {
+	// Without {seed} every replication would be the same run.
+	if !hasPlaceholder(s.config().ModelArgs, "seed") {
+		s.sendError(w, r, "replications need a {seed} placeholder in MODEL_ARGS", http.StatusBadRequest)
+		return
+	}
+	if req.Seed == nil {
+		base := rand.Int64N(math.MaxInt32)
+		req.Seed = &base
+	}
+
+	outs := make([]ModelOutput, n)
+	seeds := make([]int64, n)
+	g, ctx := errgroup.WithContext(r.Context())
+	g.SetLimit(s.runParallelism())
+	for i := range n {
+		seeds[i] = *req.Seed + int64(i)
+		rep := req
+		rep.Seed = &seeds[i]
+		g.Go(func() error {
+			id := fmt.Sprintf("%s/rep%d", requestID(r), i+1)
+			out, err := s.runModelShared(ctx, id, username, rep)
+			if err != nil {
+				return fmt.Errorf("replication %d (seed %d): %w", i+1, seeds[i], err)
+			}
+			outs[i] = out
+			return nil
+		})
+	}
+	err := g.Wait()
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		status, code := modelErrorStatus(err)
+		s.sendErrorCode(w, r, err.Error(), code, status)
+		return
+	}
+
+	runs := make([]Replication, n)
+	results := make([][]SimulationResult, n)
+	partial := false
+	for i, out := range outs {
+		runs[i] = Replication{Seed: seeds[i], Results: out.Results}
+		results[i] = out.Results
+		partial = partial || out.Partial
+	}
+
+	data := map[string]interface{}{
+		"parameters":   req,
+		"replications": n,
+		"bands":        replicationBands(results),
+		"runs":         runs,
+		"timestamp":    time.Now().Unix(),
+	}
+	status := http.StatusOK
+	message := "Replications completed"
+	if partial {
+		data["partial"] = true
+		status = http.StatusPartialContent
+		message = "Replications cut short, returning partial results"
+	}
+
+	s.writeJSON(w, r, status, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
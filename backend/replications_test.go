@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40, 50}
+	tests := []struct{ p, want float64 }{
+		{0, 10},
+		{0.1, 14},
+		{0.5, 30},
+		{0.9, 46},
+		{1, 50},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile([]float64{7}, 0.9); got != 7 {
+		t.Errorf("percentile of one value = %v, want 7", got)
+	}
+}
+
+func TestBandOf(t *testing.T) {
+	values := []float64{3, 1, 2}
+	band := bandOf(values)
+	want := Band{Mean: 2, P10: 1.2, P50: 2, P90: 2.8}
+	for _, d := range []float64{band.Mean - want.Mean, band.P10 - want.P10, band.P50 - want.P50, band.P90 - want.P90} {
+		if math.Abs(d) > 1e-9 {
+			t.Errorf("bandOf = %+v, want %+v", band, want)
+			break
+		}
+	}
+	if values[0] != 3 {
+		t.Error("bandOf sorted its input")
+	}
+}
+
+func TestReplicationBands(t *testing.T) {
+	runs := [][]SimulationResult{
+		{{Year: 2026, Revenue: 10}, {Year: 2025, Revenue: 100, OldWellsFund: 5}},
+		{{Year: 2025, Revenue: 200, OldWellsFund: 5}},
+		{{Year: 2025, Revenue: 300, OldWellsFund: 5}, {Year: 2026, Revenue: 30}},
+	}
+	bands := replicationBands(runs)
+	if len(bands) != 2 || bands[0].Year != 2025 || bands[1].Year != 2026 {
+		t.Fatalf("bands %+v, want 2025 then 2026", bands)
+	}
+	y25, y26 := bands[0], bands[1]
+	if y25.Runs != 3 || y25.Revenue.Mean != 200 || y25.Revenue.P50 != 200 || y25.Revenue.P10 != 120 || y25.Revenue.P90 != 280 {
+		t.Errorf("2025 revenue band %+v (runs %d)", y25.Revenue, y25.Runs)
+	}
+	if y25.OldWellsFund != (Band{5, 5, 5, 5}) {
+		t.Errorf("constant metric band %+v, want all 5", y25.OldWellsFund)
+	}
+	// Only two replications reached 2026.
+	if y26.Runs != 2 || y26.Revenue.Mean != 20 {
+		t.Errorf("2026 band %+v", y26)
+	}
+	if got := replicationBands(nil); len(got) != 0 {
+		t.Errorf("replicationBands(nil) = %+v", got)
+	}
+}
+
+func TestParseReplications(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"?replications=1", 1, false},
+		{"?replications=100", 100, false},
+		{"?replications=0", 0, true},
+		{"?replications=101", 0, true},
+		{"?replications=many", 0, true},
+	}
+	for _, tt := range tests {
+		n, err := parseReplications(httptest.NewRequest("POST", "/api/run-model"+tt.query, nil))
+		if n != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseReplications(%q) = %d, %v; want %d, error %v", tt.query, n, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRunModelReplicationsUseConsecutiveSeeds(t *testing.T) {
+	runner := &fakeRunner{run: func(_ context.Context, req ModelRequest) (ModelOutput, error) {
+		r := fakeResults(req, 2)
+		for i := range r {
+			r[i].Revenue += float64(*req.Seed)
+		}
+		return ModelOutput{Results: r, Seed: req.Seed}, nil
+	}}
+	s := newTestServer(t, runner, func(cfg *Config) { cfg.ResultCacheTTL = 0 })
+	seed := int64(40)
+	rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model?replications=3", s.login("user"),
+		ModelRequest{Seed: &seed})
+	var data struct {
+		Bands []ReplicationBand `json:"bands"`
+		Runs  []Replication     `json:"runs"`
+	}
+	decodeResponse(t, rec, &data)
+	if rec.Code != http.StatusOK || len(data.Runs) != 3 || len(data.Bands) != 2 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var seeds []int
+	for _, call := range runner.calls {
+		seeds = append(seeds, int(*call.Seed))
+	}
+	sort.Ints(seeds)
+	if len(seeds) != 3 || seeds[0] != 40 || seeds[2] != 42 {
+		t.Errorf("runner seeds %v, want 40, 41 and 42", seeds)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ==================== Reports ====================
+
+// maxReportRuns bounds how many runs one report may combine.
+const maxReportRuns = 50
+
+// ReportRequest asks for several of the caller's stored runs in one file.
+type ReportRequest struct {
+	IDs    []int  `json:"ids"`
+	Format string `json:"format"`
+}
+
+// RunSummary condenses a run's results into the figures a briefing
+// leads with. NPV uses DISCOUNT_RATE.
+type RunSummary struct {
+	Rows                  int     `json:"rows"`
+	FirstYear             float64 `json:"firstYear"`
+	LastYear              float64 `json:"lastYear"`
+	TotalRevenue          float64 `json:"totalRevenue"`
+	PeakRevenue           float64 `json:"peakRevenue"`
+	PeakRevenueYear       float64 `json:"peakRevenueYear"`
+	TotalProductionVolume float64 `json:"totalProductionVolume"`
+	NPV                   float64 `json:"npv"`
+	DiscountRate          float64 `json:"discountRate"`
+}
+
+// ReportRun is one section of a report.
+type ReportRun struct {
+	ID         int                `json:"id"`
+	Timestamp  time.Time          `json:"timestamp"`
+	Parameters ModelRequest       `json:"parameters"`
+	Summary    RunSummary         `json:"summary"`
+	Results    []SimulationResult `json:"results"`
+}
+
+func summarizeRun(results []SimulationResult, rate float64) RunSummary {
+	sum := RunSummary{Rows: len(results), DiscountRate: rate, NPV: computeNPV(results, rate)}
+	if len(results) == 0 {
+		return sum
+	}
+	sum.FirstYear, sum.LastYear = math.Inf(1), math.Inf(-1)
+	sum.PeakRevenue = math.Inf(-1)
+	for _, r := range results {
+		sum.FirstYear = math.Min(sum.FirstYear, r.Year)
+		sum.LastYear = math.Max(sum.LastYear, r.Year)
+		sum.TotalRevenue += r.Revenue
+		sum.TotalProductionVolume += r.ProductionVolume
+		if r.Revenue > sum.PeakRevenue {
+			sum.PeakRevenue, sum.PeakRevenueYear = r.Revenue, r.Year
+		}
+	}
+	return sum
+}
+
+// reportFormat writes a whole report as one file.
+type reportFormat struct {
+	contentType string
+	ext         string
+	write       func(w io.Writer, runs []ReportRun) error
+}
+
+// reportFormats shares the export content types for csv and xlsx.
+var reportFormats = map[string]reportFormat{
+	"csv":  {exportFormats["csv"].contentType, exportFormats["csv"].ext, writeReportCSV},
+	"xlsx": {exportFormats["xlsx"].contentType, exportFormats["xlsx"].ext, writeReportXLSX},
+	"json": {"application/json", "json", writeReportJSON},
+}
+
+// reportFields are the parameter and summary rows each section opens with.
+func reportFields(run ReportRun) [][]interface{} {
+	p, sum := run.Parameters, run.Summary
+	fields := [][]interface{}{
+		{"Run", run.ID},
+		{"Timestamp", run.Timestamp.UTC().Format(time.RFC3339)},
+		{"Scenario", p.Scenario},
+		{"DrillingRate", p.DrillingRate},
+		{"OilPrice", p.OilPrice},
+		{"ExchangeRate", p.ExchangeRate},
+	}
+	if p.Seed != nil {
+		fields = append(fields, []interface{}{"Seed", *p.Seed})
+	}
+	return append(fields,
+		[]interface{}{"Rows", sum.Rows},
+		[]interface{}{"FirstYear", sum.FirstYear},
+		[]interface{}{"LastYear", sum.LastYear},
+		[]interface{}{"TotalRevenue", sum.TotalRevenue},
+		[]interface{}{"PeakRevenue", sum.PeakRevenue},
+		[]interface{}{"PeakRevenueYear", sum.PeakRevenueYear},
+		[]interface{}{"TotalProductionVolume", sum.TotalProductionVolume},
+		[]interface{}{"NPV", sum.NPV},
+		[]interface{}{"DiscountRate", sum.DiscountRate},
+	)
+}
+
+func formatReportValue(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return formatFloat(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeReportCSV puts the runs one after another, each as its field rows,
+// a blank line and then its results under the usual export header.
+func writeReportCSV(w io.Writer, runs []ReportRun) error {
+	for i, run := range runs {
+		if i > 0 {
+			io.WriteString(w, "\n")
+		}
+		cw := csv.NewWriter(w)
+		for _, f := range reportFields(run) {
+			cw.Write([]string{f[0].(string), formatReportValue(f[1])})
+		}
+		cw.Write(nil)
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		if err := writeResultsCSV(w, run.Results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportSummarySheet lists every run on one row, ahead of the per-run
+// sheets.
+const reportSummarySheet = "Summary"
+
+var reportSummaryColumns = []string{"Run", "Timestamp", "Scenario", "DrillingRate", "OilPrice", "ExchangeRate",
+	"Rows", "TotalRevenue", "PeakRevenue", "TotalProductionVolume", "NPV"}
+
+// writeReportXLSX opens with a summary sheet and gives each run its own
+// sheet, laid out like /api/export with the parameters and summary below
+// the chart.
+func writeReportXLSX(w io.Writer, runs []ReportRun) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := f.SetSheetName("Sheet1", reportSummarySheet); err != nil {
+		return err
+	}
+	header := make([]interface{}, len(reportSummaryColumns))
+	for i, c := range reportSummaryColumns {
+		header[i] = c
+	}
+	if err := f.SetSheetRow(reportSummarySheet, "A1", &header); err != nil {
+		return err
+	}
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	lastCol, _ := excelize.ColumnNumberToName(len(reportSummaryColumns))
+	if err := f.SetCellStyle(reportSummarySheet, "A1", lastCol+"1", bold); err != nil {
+		return err
+	}
+	if err := f.SetColWidth(reportSummarySheet, "A", lastCol, 18); err != nil {
+		return err
+	}
+
+	for i, run := range runs {
+		p, sum := run.Parameters, run.Summary
+		row := []interface{}{run.ID, run.Timestamp.UTC().Format(time.RFC3339), p.Scenario, p.DrillingRate, p.OilPrice, p.ExchangeRate,
+			sum.Rows, sum.TotalRevenue, sum.PeakRevenue, sum.TotalProductionVolume, sum.NPV}
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		if err := f.SetSheetRow(reportSummarySheet, cell, &row); err != nil {
+			return err
+		}
+
+		sheet := fmt.Sprintf("Run %d", run.ID)
+		if _, err := f.NewSheet(sheet); err != nil {
+			return err
+		}
+		if err := fillResultsSheet(f, sheet, run.Results); err != nil {
+			return err
+		}
+		// The chart covers roughly H2:O16.
+		for j, field := range reportFields(run) {
+			cell, _ := excelize.CoordinatesToCellName(8, 19+j)
+			if err := f.SetSheetRow(sheet, cell, &field); err != nil {
+				return err
+			}
+		}
+		if err := f.SetCellStyle(sheet, "H19", fmt.Sprintf("H%d", 18+len(reportFields(run))), bold); err != nil {
+			return err
+		}
+		if err := f.SetColWidth(sheet, "H", "I", 22); err != nil {
+			return err
+		}
+	}
+
+	_, err = f.WriteTo(w)
+	return err
+}
+
+func writeReportJSON(w io.Writer, runs []ReportRun) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"generatedAt": time.Now().UTC(),
+		"runs":        runs,
+	})
+}
+
+// loadReportRun loads one of owner's stored runs with its parameters.
+func (s *Server) loadReportRun(owner string, id int) (ReportRun, error) {
+	if s.database() == nil {
+		return ReportRun{}, fmt.Errorf("database not connected")
+	}
+
+	query := `SELECT ` + storedRunColumns + ` FROM request_logs WHERE id = $1 AND username = $2`
+	run, err := scanStoredRun(s.database().QueryRow(query, id, owner).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return run, errRunNotFound
+	}
+	return run, err
+}
+
+// storedRunColumns are the request_logs columns scanStoredRun reads.
+const storedRunColumns = `id, timestamp, scenario, drilling_rate, oil_price, exchange_rate, seed, results`
+
+// scanStoredRun reads one storedRunColumns row through scan, which is a
+// *sql.Row's or *sql.Rows' Scan.
+func scanStoredRun(scan func(dest ...interface{}) error) (ReportRun, error) {
+	var run ReportRun
+	var raw sql.NullString
+	err := scan(&run.ID, &run.Timestamp, &run.Parameters.Scenario, &run.Parameters.DrillingRate,
+		&run.Parameters.OilPrice, &run.Parameters.ExchangeRate, &run.Parameters.Seed, &raw)
+	if err != nil {
+		return run, err
+	}
+	if raw.Valid {
+		if err := json.Unmarshal([]byte(raw.String), &run.Results); err != nil {
+			return run, fmt.Errorf("stored results are corrupt: %v", err)
+		}
+	}
+	return run, nil
+}
+
+// handleReport combines several of the caller's runs into one download.
+// Runs appear in the order given; repeated ids are included once.
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReportRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	format, ok := reportFormats[req.Format]
+	if !ok {
+		s.sendError(w, r, fmt.Sprintf("Unsupported format %q (use csv, xlsx or json)", req.Format), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		s.sendError(w, r, "ids must list at least one run", http.StatusBadRequest)
+		return
+	}
+
+	var ids []int
+	seen := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxReportRuns {
+		s.sendError(w, r, fmt.Sprintf("A report covers at most %d runs", maxReportRuns), http.StatusBadRequest)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	owner := s.logUsername(username)
+	rate := s.config().DiscountRate
+	runs := make([]ReportRun, 0, len(ids))
+	for _, id := range ids {
+		run, err := s.loadReportRun(owner, id)
+		if errors.Is(err, errRunNotFound) {
+			s.sendError(w, r, fmt.Sprintf("Run %d not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.sendError(w, r, fmt.Sprintf("Failed to load run %d: %v", id, err), http.StatusInternalServerError)
+			return
+		}
+		run.Summary = summarizeRun(run.Results, rate)
+		runs = append(runs, run)
+	}
+
+	name := fmt.Sprintf("report-%s.%s", time.Now().UTC().Format("20060102-150405"), format.ext)
+	s.serveDownload(w, r, name, format.contentType, "report", func(w io.Writer) error {
+		return format.write(w, runs)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ==================== Scenarios ====================
+
+// Scenario is an investment strategy the model can run, with the
+// parameters used when a request leaves them out.
+type Scenario struct {
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	DrillingRate int     `json:"drillingRate"`
+	OilPrice     float64 `json:"oilPrice"`
+	ExchangeRate float64 `json:"exchangeRate"`
+	// Rules are the parameter ranges runs of the scenario must keep to,
+	// filled in by /api/scenarios from PARAM_RULES.
+	Rules ParamRules `json:"rules,omitempty"`
+}
+
+// ParamRules bound run parameters by name (drillingRate, oilPrice,
+// exchangeRate).
+type ParamRules map[string]paramRange
+
+// ruleParams are the parameters PARAM_RULES may bound, in the order
+// validateModelRequest checks them.
+var ruleParams = []string{"drillingRate", "oilPrice", "exchangeRate"}
+
+// parseParamRules reads PARAM_RULES entries: [scenario:]param=min..max,
+// either bound optional, e.g. "drillingRate=1..500" for every scenario or
+// "3:drillingRate=80.." for scenario 3 only.
+func parseParamRules(entries []string) (ParamRules, map[int]ParamRules, error) {
+	global := ParamRules{}
+	byScenario := map[int]ParamRules{}
+	for _, entry := range entries {
+		bad := fmt.Errorf("PARAM_RULES entries must look like [scenario:]param=min..max, got %q", entry)
+		rule, bounds, ok := strings.Cut(entry, "=")
+		lo, hi, isRange := strings.Cut(bounds, "..")
+		if !ok || !isRange {
+			return nil, nil, bad
+		}
+		rules := global
+		if id, param, scoped := strings.Cut(rule, ":"); scoped {
+			n, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return nil, nil, bad
+			}
+			if byScenario[n] == nil {
+				byScenario[n] = ParamRules{}
+			}
+			rules, rule = byScenario[n], param
+		}
+		rule = strings.TrimSpace(rule)
+		if !containsString(ruleParams, rule) {
+			return nil, nil, fmt.Errorf("PARAM_RULES: unknown parameter %q (use %s)", rule, strings.Join(ruleParams, ", "))
+		}
+
+		var pr paramRange
+		for _, end := range []struct {
+			text string
+			dst  **float64
+		}{{lo, &pr.Min}, {hi, &pr.Max}} {
+			if strings.TrimSpace(end.text) == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(end.text), 64)
+			if err != nil {
+				return nil, nil, bad
+			}
+			*end.dst = &f
+		}
+		if pr.Min != nil && pr.Max != nil && *pr.Min > *pr.Max {
+			return nil, nil, fmt.Errorf("PARAM_RULES: %q has min above max", entry)
+		}
+		rules[rule] = pr
+	}
+	return global, byScenario, nil
+}
+
+// paramRules are the rules for scenario: its own where it has one for a
+// parameter, the global ones otherwise.
+func (c Config) paramRules(scenario int) ParamRules {
+	rules := make(ParamRules, len(ruleParams))
+	for param, pr := range c.ParamRules {
+		rules[param] = pr
+	}
+	for param, pr := range c.ScenarioRules[scenario] {
+		rules[param] = pr
+	}
+	return rules
+}
+
+// checkParamRules reports the first parameter of req outside its range.
+func (c Config) checkParamRules(req ModelRequest) error {
+	rules := c.paramRules(req.Scenario)
+	values := map[string]float64{
+		"drillingRate": float64(req.DrillingRate),
+		"oilPrice":     req.OilPrice,
+		"exchangeRate": req.ExchangeRate,
+	}
+	for _, param := range ruleParams {
+		pr, ok := rules[param]
+		if !ok || pr.contains(values[param]) {
+			continue
+		}
+		var want string
+		switch {
+		case pr.Min != nil && pr.Max != nil:
+			want = fmt.Sprintf("between %s and %s", formatFloat(*pr.Min), formatFloat(*pr.Max))
+		case pr.Min != nil:
+			want = "at least " + formatFloat(*pr.Min)
+		default:
+			want = "at most " + formatFloat(*pr.Max)
+		}
+		return fmt.Errorf("%s must be %s for scenario %d, got %s", param, want, req.Scenario, formatFloat(values[param]))
+	}
+	return nil
+}
+
+// builtinScenarios are the strategies model.jar ships with, used when the
+// scenarios table is empty or the database is unavailable.
+var builtinScenarios = []Scenario{
+	{ID: 1, Name: "Baseline", DrillingRate: 50, OilPrice: 80, ExchangeRate: 75},
+	{ID: 2, Name: "Moderate Growth", DrillingRate: 50, OilPrice: 80, ExchangeRate: 75},
+	{ID: 3, Name: "Aggressive Expansion", DrillingRate: 50, OilPrice: 80, ExchangeRate: 75},
+}
+
+func (s *Server) currentScenarios() []Scenario {
+	s.scenariosMu.RLock()
+	defer s.scenariosMu.RUnlock()
+	return s.scenarios
+}
+
+func (s *Server) findScenario(id int) (Scenario, bool) {
+	for _, sc := range s.currentScenarios() {
+		if sc.ID == id {
+			return sc, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// loadScenarios replaces the built-in scenarios with the rows of the
+// scenarios table, if it has any.
+func (s *Server) loadScenarios() {
+	if s.database() == nil {
+		return
+	}
+	rows, err := s.database().Query(`SELECT id, name, drilling_rate, oil_price, exchange_rate FROM scenarios ORDER BY id`)
+	if err != nil {
+		log.Printf("Failed to load scenarios, using built-in ones: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var loaded []Scenario
+	for rows.Next() {
+		var sc Scenario
+		if err := rows.Scan(&sc.ID, &sc.Name, &sc.DrillingRate, &sc.OilPrice, &sc.ExchangeRate); err != nil {
+			log.Printf("Failed to load scenarios, using built-in ones: %v", err)
+			return
+		}
+		loaded = append(loaded, sc)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to load scenarios, using built-in ones: %v", err)
+		return
+	}
+	if len(loaded) == 0 {
+		return
+	}
+
+	s.scenariosMu.Lock()
+	s.scenarios = loaded
+	s.scenariosMu.Unlock()
+	log.Printf("Loaded %d scenarios from the database", len(loaded))
+}
+
+// unknownScenarioError names the scenarios a request may pick from.
+func (s *Server) unknownScenarioError(id int) error {
+	list := s.currentScenarios()
+	ids := make([]int, 0, len(list))
+	for _, sc := range list {
+		ids = append(ids, sc.ID)
+	}
+	return fmt.Errorf("Unknown scenario %d (available: %v)", id, ids)
+}
+
+func (s *Server) handleScenarios(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := s.config()
+	list := s.currentScenarios()
+	scenarios := make([]Scenario, len(list))
+	for i, sc := range list {
+		sc.Rules = cfg.paramRules(sc.ID)
+		scenarios[i] = sc
+	}
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    scenarios,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// withParamRules sets PARAM_RULES entries on a test config.
+func withParamRules(t *testing.T, entries ...string) func(*Config) {
+	return func(cfg *Config) {
+		var err error
+		if cfg.ParamRules, cfg.ScenarioRules, err = parseParamRules(entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseParamRulesErrors(t *testing.T) {
+	for _, entry := range []string{
+		"drillingRate",
+		"drillingRate=1-5",
+		"x:drillingRate=1..5",
+		"wellCount=1..5",
+		"oilPrice=10..1",
+		"oilPrice=a..b",
+	} {
+		if _, _, err := parseParamRules([]string{entry}); err == nil {
+			t.Errorf("parseParamRules(%q) accepted it", entry)
+		}
+	}
+}
+
+func TestScenarioParamRules(t *testing.T) {
+	s := newTestServer(t, nil, withParamRules(t, "drillingRate=1..500", "oilPrice=..200", "3:drillingRate=80.."))
+	tests := []struct {
+		name string
+		req  ModelRequest
+		err  string
+	}{
+		{"global ok", ModelRequest{Scenario: 1, DrillingRate: 60}, ""},
+		{"global max", ModelRequest{Scenario: 1, DrillingRate: 600}, "drillingRate must be between 1 and 500 for scenario 1, got 600"},
+		{"scenario min", ModelRequest{Scenario: 3, DrillingRate: 60}, "drillingRate must be at least 80 for scenario 3, got 60"},
+		{"scenario rule replaces the global one", ModelRequest{Scenario: 3, DrillingRate: 600}, ""},
+		{"other globals still apply", ModelRequest{Scenario: 3, DrillingRate: 90, OilPrice: 250}, "oilPrice must be at most 200 for scenario 3"},
+		// The default drilling rate of 50 is checked too.
+		{"defaults are checked", ModelRequest{Scenario: 3}, "drillingRate must be at least 80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			err := s.validateModelRequest(&req)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("rejected: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRunModelRejectsScenarioRule(t *testing.T) {
+	runner := &fakeRunner{}
+	s := newTestServer(t, runner, withParamRules(t, "3:drillingRate=80.."))
+	rec := serve(t, s.routes(t.TempDir()), "POST", "/api/run-model", s.login("user"), ModelRequest{Scenario: 3, DrillingRate: 60})
+	if rec.Code != http.StatusBadRequest || runner.callCount() != 0 {
+		t.Errorf("status %d after %d runs, want 400 without a run: %s", rec.Code, runner.callCount(), rec.Body)
+	}
+}
+
+func TestScenariosListRules(t *testing.T) {
+	s := newTestServer(t, nil, withParamRules(t, "drillingRate=1..500", "3:drillingRate=80.."))
+	var scenarios []Scenario
+	decodeResponse(t, serve(t, s.routes(t.TempDir()), "GET", "/api/scenarios", "", nil), &scenarios)
+	if len(scenarios) != len(builtinScenarios) {
+		t.Fatalf("got %d scenarios, want %d", len(scenarios), len(builtinScenarios))
+	}
+	for _, sc := range scenarios {
+		pr, ok := sc.Rules["drillingRate"]
+		if !ok || pr.Min == nil {
+			t.Errorf("scenario %d has no drillingRate rule: %+v", sc.ID, sc.Rules)
+			continue
+		}
+		want := 1.0
+		if sc.ID == 3 {
+			want = 80
+		}
+		if *pr.Min != want {
+			t.Errorf("scenario %d drillingRate min %v, want %v", sc.ID, *pr.Min, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticRoot is a project root whose frontend has an index.html.
+func staticRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "frontend"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "frontend", "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestSecurityHeadersOnStaticResponses(t *testing.T) {
+	s := newTestServer(t, nil, func(cfg *Config) { cfg.SecurityHeaders.Enabled = true })
+	rec := serve(t, s.routes(staticRoot(t)), "GET", "/", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /: status %d: %s", rec.Code, rec.Body)
+	}
+	want := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Content-Security-Policy": defaultCSP,
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestSecurityHeadersOffByDefault(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	rec := serve(t, s.routes(staticRoot(t)), "GET", "/", "", nil)
+	for _, name := range []string{"X-Content-Type-Options", "X-Frame-Options", "Content-Security-Policy"} {
+		if got := rec.Header().Get(name); got != "" {
+			t.Errorf("%s = %q with SECURITY_HEADERS off", name, got)
+		}
+	}
+}
+
+func TestSecurityHeadersOverrides(t *testing.T) {
+	t.Setenv("SECURITY_HEADERS", "true")
+	t.Setenv("FRAME_OPTIONS", "SAMEORIGIN")
+	t.Setenv("CONTENT_SECURITY_POLICY", "default-src 'none'")
+	s := newTestServer(t, nil, nil)
+	rec := serve(t, s.routes(staticRoot(t)), "GET", "/index.html", "", nil)
+	if got := rec.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want SAMEORIGIN", got)
+	}
+	if got := rec.Header().Get("Content-Security-Policy"); got != "default-src 'none'" {
+		t.Errorf("Content-Security-Policy = %q, want the override", got)
+	}
+}
+
+func TestSecurityHeadersNotOnAPI(t *testing.T) {
+	s := newTestServer(t, nil, func(cfg *Config) { cfg.SecurityHeaders.Enabled = true })
+	rec := serve(t, s.routes(staticRoot(t)), "GET", "/api/scenarios", "", nil)
+	if got := rec.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("API answer has Content-Security-Policy %q", got)
+	}
+}
+
+func TestStaticServesOnlyAllowedExtensions(t *testing.T) {
+	root := staticRoot(t)
+	for _, name := range []string{".env", "app.js.map", "app.js", "config.yaml"} {
+		if err := os.WriteFile(filepath.Join(root, "frontend", name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, nil, nil)
+	h := s.routes(root)
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/", http.StatusOK},
+		{"/app.js", http.StatusOK},
+		{"/.env", http.StatusNotFound},
+		{"/app.js.map", http.StatusNotFound},
+		{"/config.yaml", http.StatusNotFound},
+		{"/missing.yaml", http.StatusNotFound},
+		{"/missing.js", http.StatusNotFound},
+		{"/APP.JS.MAP", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := serve(t, h, "GET", tt.path, "", nil); rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestStaticExtensionsConfig(t *testing.T) {
+	root := staticRoot(t)
+	if err := os.WriteFile(filepath.Join(root, "frontend", "data.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STATIC_EXTENSIONS", "html, .JSON")
+	s := newTestServer(t, nil, nil)
+	if rec := serve(t, s.routes(root), "GET", "/data.json", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /data.json with json allowed: status %d", rec.Code)
+	}
+}
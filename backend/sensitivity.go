@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ==================== Sensitivity ====================
+
+// sensitivityParams are the inputs /api/sensitivity perturbs, in the order
+// their runs are started.
+var sensitivityParams = []string{"drillingRate", "oilPrice", "exchangeRate"}
+
+// Sensitivity is how total revenue moved when one parameter was raised by
+// the delta with the others held at their base values. Elasticity is the
+// relative change in revenue over the relative change in the parameter,
+// which stays comparable when drillingRate's step is rounded.
+type Sensitivity struct {
+	Parameter      string   `json:"parameter"`
+	BaseValue      float64  `json:"baseValue"`
+	PerturbedValue float64  `json:"perturbedValue"`
+	TotalRevenue   float64  `json:"totalRevenue"`
+	Change         float64  `json:"change"`
+	ChangePercent  *float64 `json:"changePercent"`
+	Elasticity     *float64 `json:"elasticity"`
+}
+
+// perturb returns req with param raised by the fraction delta. drillingRate
+// is a whole number of wells, so it moves by at least one.
+func perturb(req ModelRequest, param string, delta float64) (ModelRequest, float64, float64) {
+	req.Requested = nil
+	switch param {
+	case "drillingRate":
+		base := req.DrillingRate
+		req.DrillingRate = max(int(math.Round(float64(base)*(1+delta))), base+1)
+		return req, float64(base), float64(req.DrillingRate)
+	case "oilPrice":
+		base := req.OilPrice
+		req.OilPrice = base * (1 + delta)
+		return req, base, req.OilPrice
+	default:
+		base := req.ExchangeRate
+		req.ExchangeRate = base * (1 + delta)
+		return req, base, req.ExchangeRate
+	}
+}
+
+func totalRevenue(results []SimulationResult) float64 {
+	var total float64
+	for _, r := range results {
+		total += r.Revenue
+	}
+	return total
+}
+
+// sensitivityOf compares a perturbed run's revenue with the base one's.
+// The relative figures are null when the base revenue is zero.
+func sensitivityOf(param string, baseValue, value, baseRevenue, revenue float64) Sensitivity {
+	sens := Sensitivity{
+		Parameter:      param,
+		BaseValue:      baseValue,
+		PerturbedValue: value,
+		TotalRevenue:   revenue,
+		Change:         revenue - baseRevenue,
+	}
+	if baseRevenue != 0 {
+		pct := sens.Change / baseRevenue * 100
+		elasticity := (sens.Change / baseRevenue) / ((value - baseValue) / baseValue)
+		sens.ChangePercent, sens.Elasticity = &pct, &elasticity
+	}
+	return sens
+}
+
+// handleSensitivity is POST /api/sensitivity: a one-at-a-time sensitivity
+// of total revenue to each parameter. The body is a /api/run-model request
+// plus an optional delta, the fractional step (0.1 raises each parameter by
+// 10%), defaulting to SENSITIVITY_DELTA.
+func (s *Server) handleSensitivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w, r) {
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	project, err := s.requestProject(r)
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var req ModelRequest
+	var opts struct {
+		Delta json.RawMessage `json:"delta"`
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		s.sendDecodeError(w, r, errEmptyBody)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+	if s.strictJSON(r) {
+		if err := unknownField(body, &req, &opts); err != nil {
+			s.sendDecodeError(w, r, err)
+			return
+		}
+	}
+	json.Unmarshal(body, &opts)
+	delta := s.config().SensitivityDelta
+	if err := lenientFloat("delta", opts.Delta, &delta); err != nil {
+		s.sendError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if delta <= 0 || delta > 1 {
+		s.sendError(w, r, "delta must be greater than 0 and at most 1", http.StatusBadRequest)
+		return
+	}
+	req.Project = project
+	if err := s.validateModelRequest(&req); err != nil {
+		s.sendError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The base run first, then one per parameter, through the same pool,
+	// cache and coalescing as replications.
+	runs := []ModelRequest{req}
+	baseValues := make([]float64, len(sensitivityParams))
+	values := make([]float64, len(sensitivityParams))
+	for i, param := range sensitivityParams {
+		var run ModelRequest
+		run, baseValues[i], values[i] = perturb(req, param, delta)
+		if err := s.config().checkParamRules(run); err != nil {
+			s.sendError(w, r, fmt.Sprintf("Perturbed %s run: %v", param, err), http.StatusBadRequest)
+			return
+		}
+		runs = append(runs, run)
+	}
+	outs := make([]ModelOutput, len(runs))
+	g, ctx := errgroup.WithContext(r.Context())
+	g.SetLimit(s.runParallelism())
+	for i, run := range runs {
+		g.Go(func() error {
+			name := "base"
+			if i > 0 {
+				name = sensitivityParams[i-1]
+			}
+			out, err := s.runModelShared(ctx, fmt.Sprintf("%s/%s", requestID(r), name), username, run)
+			if err != nil {
+				return fmt.Errorf("%s run: %w", name, err)
+			}
+			outs[i] = out
+			return nil
+		})
+	}
+	err = g.Wait()
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		status, code := modelErrorStatus(err)
+		s.sendErrorCode(w, r, err.Error(), code, status)
+		return
+	}
+
+	baseRevenue := totalRevenue(outs[0].Results)
+	partial := outs[0].Partial
+	sensitivities := make([]Sensitivity, len(sensitivityParams))
+	for i, param := range sensitivityParams {
+		out := outs[i+1]
+		sensitivities[i] = sensitivityOf(param, baseValues[i], values[i], baseRevenue, totalRevenue(out.Results))
+		partial = partial || out.Partial
+	}
+	sort.SliceStable(sensitivities, func(i, j int) bool {
+		return math.Abs(sensitivities[i].Change) > math.Abs(sensitivities[j].Change)
+	})
+
+	data := map[string]interface{}{
+		"parameters":       req,
+		"delta":            delta,
+		"baseTotalRevenue": baseRevenue,
+		"sensitivities":    sensitivities,
+		"timestamp":        time.Now().Unix(),
+	}
+	status := http.StatusOK
+	message := "Sensitivity analysis completed"
+	if partial {
+		data["partial"] = true
+		status = http.StatusPartialContent
+		message = "Sensitivity runs cut short, returning partial results"
+	}
+
+	s.writeJSON(w, r, status, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
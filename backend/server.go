@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ==================== Server ====================
+
+// ModelRunner executes a single model run. FallbackModelRunner is the real
+// one, wrapping javaRunner's command for each backend;
+// tests can substitute a fake to exercise the handlers without a JVM.
+type ModelRunner interface {
+	Run(ctx context.Context, req ModelRequest) (ModelOutput, error)
+}
+
+// Server holds the configuration, stores and model runner the handlers
+// work against.
+type Server struct {
+	cfg *liveConfig
+	// db is swapped by the health check when it reconnects; read it
+	// through database(). nil when the database is unavailable.
+	db        atomic.Pointer[sql.DB]
+	dbReplica *sql.DB // optional; reads fall back to db
+	dbHealth  dbHealth
+	runner    ModelRunner
+	metrics   *metricsRegistry
+	runEvents *runEvents // finished runs, for /api/admin/stream/requests
+	endpoints *endpointGate
+	// errorLog is for failures that tend to repeat, such as every run
+	// failing while the model or database is down.
+	errorLog *logThrottle
+
+	mu    sync.RWMutex
+	users map[string]string // username -> bcrypt hash
+	// disabledUsers are accounts an admin has switched off.
+	disabledUsers map[string]bool
+	sessions      map[string]*Session // token -> session
+	// refreshSessions also lives under mu, so a revoked refresh token and
+	// its access tokens disappear together.
+	refreshSessions map[string]*RefreshSession // refresh token -> session
+	apiKeys         map[string]*APIKey         // key SHA-256 -> key
+	userStore       userStore
+
+	jobsMu sync.RWMutex
+	jobs   map[string]*Job // id -> job
+
+	runningMu sync.Mutex
+	running   map[string]RunningModel // id -> run
+	// runSlots holds a token per run in progress when MAX_CONCURRENT_RUNS
+	// is set; nil means no limit.
+	runSlots chan struct{}
+
+	cacheMu     sync.Mutex
+	resultCache map[string]cachedResult // param key -> result
+	// scenarioBaselines also lives under cacheMu.
+	scenarioBaselines map[string]scenarioBaseline // param key -> results
+	// diskCacheMu serializes trimming and invalidating RESULT_CACHE_DIR.
+	diskCacheMu sync.Mutex
+	// modelFlight makes concurrent identical /api/run-model requests share
+	// one model run.
+	modelFlight singleflight.Group
+
+	maintenanceMu sync.RWMutex
+	maintenance   MaintenanceState
+
+	modelJarMu sync.RWMutex
+	modelJar   ModelJarInfo
+
+	scenariosMu sync.RWMutex
+	scenarios   []Scenario
+
+	shareKey []byte // signs share links
+
+	// logQueue feeds writeRequestLogs; nil when LOG_QUEUE_SIZE is 0. Once
+	// logClosed is set (under logQueueMu) it is closed, and in either
+	// case logRequest writes inline.
+	logQueue      chan requestLogEntry
+	logWriterDone chan struct{}
+	logQueueMu    sync.RWMutex
+	logClosed     bool
+	// spoolMu serializes appends to and replays of REQUEST_LOG_SPOOL.
+	spoolMu sync.Mutex
+
+	modelChecks modelCheckCache
+}
+
+func newServer(cfg *liveConfig, db, dbReplica *sql.DB, runner ModelRunner, metrics *metricsRegistry) *Server {
+	shareKey := []byte(cfg.Load().ShareSecret)
+	if len(shareKey) == 0 {
+		shareKey = make([]byte, 32)
+		rand.Read(shareKey)
+	}
+	s := &Server{
+		cfg:               cfg,
+		dbReplica:         dbReplica,
+		runner:            runner,
+		metrics:           metrics,
+		runEvents:         newRunEvents(),
+		endpoints:         newEndpointGate(),
+		errorLog:          newLogThrottle(cfg.Load().LogThrottleWindow),
+		users:             make(map[string]string),
+		disabledUsers:     make(map[string]bool),
+		sessions:          make(map[string]*Session),
+		refreshSessions:   make(map[string]*RefreshSession),
+		apiKeys:           make(map[string]*APIKey),
+		jobs:              make(map[string]*Job),
+		running:           make(map[string]RunningModel),
+		resultCache:       make(map[string]cachedResult),
+		scenarioBaselines: make(map[string]scenarioBaseline),
+		scenarios:         builtinScenarios,
+		shareKey:          shareKey,
+	}
+	if db != nil {
+		s.db.Store(db)
+	}
+	if n := cfg.Load().MaxConcurrentRuns; n > 0 {
+		s.runSlots = make(chan struct{}, n)
+	}
+	if n := cfg.Load().LogQueueSize; n > 0 {
+		s.logQueue = make(chan requestLogEntry, n)
+		s.logWriterDone = make(chan struct{})
+		go s.writeRequestLogs(s.logQueue, cfg.Load().LogBatchSize)
+	}
+	s.userStore = dbUsers{s}
+	s.metrics.newGauge("request_log_queue_depth", "Request log rows waiting to be written.", func() float64 {
+		return float64(len(s.logQueue))
+	})
+	s.metrics.newGauge("request_stream_subscribers", "Open /api/admin/stream/requests connections.", func() float64 {
+		return float64(s.runEvents.count())
+	})
+	s.metrics.newLabeledGauge("http_requests_in_flight", "Requests in progress per endpoint.", "endpoint", s.endpoints.snapshot)
+	return s
+}
+
+// config is the active configuration; hold on to the copy rather than
+// calling it repeatedly when the values must agree with each other.
+func (s *Server) config() Config {
+	return s.cfg.Load()
+}
+
+// routes registers every endpoint on a fresh mux. Each one needs an
+// apiOperations entry too; a route without one is logged at startup.
+func (s *Server) routes(projectRoot string) http.Handler {
+	mux := http.NewServeMux()
+	var patterns []string
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, s.limitConcurrency(pattern, h))
+		patterns = append(patterns, pattern)
+	}
+	handle("/", s.securityHeadersMiddleware(s.handleStatic(projectRoot)))
+	handle("/api/login", s.requireJSON(s.handleLogin))
+	handle("/api/register", s.requireJSON(s.handleRegister))
+	handle("/api/logout", s.requireJSON(s.handleLogout))
+	handle("/api/refresh", s.requireJSON(s.handleRefresh))
+	handle("/api/token/verify", s.handleTokenVerify)
+	handle("/api/change-password", s.authMiddleware(s.requireJSON(s.handleChangePassword)))
+	handle("/api/run-model", s.authMiddleware(s.requireJSON(s.handleRunModel)))
+	handle("/api/compare", s.authMiddleware(s.requireJSON(s.handleCompare)))
+	handle("/api/estimate", s.authMiddleware(s.requireJSON(s.handleEstimate)))
+	handle("/api/sensitivity", s.authMiddleware(s.requireJSON(s.handleSensitivity)))
+	handle("/api/preferences", s.authMiddleware(s.requireJSON(s.handlePreferences)))
+	handle("/api/history", s.authMiddleware(s.handleHistory))
+	handle("/api/history/curves", s.authMiddleware(s.handleHistoryCurves))
+	handle("/api/history/timeline", s.authMiddleware(s.handleTimelineLink))
+	handle("/api/history/timeline.ics", s.handleTimeline)
+	handle("/api/history/import", s.adminMiddleware(s.requireJSONUpTo(importBodyLimit, s.handleHistoryImport)))
+	handle("/api/history/{id}/baseline", s.authMiddleware(s.handleSetBaseline))
+	handle("/api/history/{id}/reparse", s.authMiddleware(s.handleReparse))
+	handle("/api/history/{id}/share", s.authMiddleware(s.handleShareRun))
+	handle("/api/history/{id}/report.html", s.authMiddleware(s.handleRunReportHTML))
+	handle("/api/shared/{token}", s.handleShared)
+	handle("/api/export", s.authMiddleware(s.handleExport))
+	handle("/api/report", s.authMiddleware(s.requireJSON(s.handleReport)))
+	handle("/api/jobs", s.authMiddleware(s.requireJSON(s.handleJobs)))
+	handle("/api/jobs/{id}", s.authMiddleware(s.handleJob))
+	handle("/api/jobs/{id}/tail", s.authMiddleware(s.handleJobTail))
+	handle("/api/scenarios", s.handleScenarios)
+	handle("/api/status", s.handleStatus)
+	handle("/api/ready", s.handleReady)
+	handle("/api/openapi.json", s.handleOpenAPI)
+	handle("/api/stats/result-sizes", s.adminMiddleware(s.handleResultSizes))
+	handle("/api/metrics.json", s.adminMiddleware(s.handleMetricsJSON))
+	handle("/metrics", s.handleMetrics)
+	handle("/api/admin/maintenance", s.adminMiddleware(s.requireJSON(s.handleMaintenance)))
+	handle("/api/admin/running", s.adminMiddleware(s.handleRunning))
+	handle("/api/admin/cache/invalidate", s.adminMiddleware(s.requireJSON(s.handleCacheInvalidate)))
+	handle("/api/admin/warm", s.adminMiddleware(s.handleWarm))
+	handle("/api/admin/model/check", s.adminMiddleware(s.handleModelCheck))
+	handle("/api/admin/stream/requests", s.adminMiddleware(s.handleRequestStream))
+	handle("/api/admin/logs", s.adminMiddleware(s.handleLogs))
+	handle("/api/admin/config", s.adminMiddleware(s.handleAdminConfig))
+	handle("/api/admin/users/{name}/disable", s.adminMiddleware(s.handleUserActive(false)))
+	handle("/api/admin/users/{name}/enable", s.adminMiddleware(s.handleUserActive(true)))
+	handle("/api/admin/apikeys", s.adminMiddleware(s.requireJSON(s.handleAPIKeys)))
+	handle("/api/admin/apikeys/{id}", s.adminMiddleware(s.handleAPIKey))
+	handle("/api/admin/audit", s.adminMiddleware(s.handleAudit))
+	checkAPIOperations(patterns)
+	s.checkEndpointLimits(patterns)
+	return requestIDMiddleware(trimSlashMiddleware(mux))
+}
+
+// httpServer serves the routes on addr within the HTTP_*_TIMEOUT limits.
+func (s *Server) httpServer(addr, projectRoot string) *http.Server {
+	cfg := s.config()
+	return &http.Server{
+		Addr:         addr,
+		Handler:      s.routes(projectRoot),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+}
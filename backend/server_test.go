@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeRunner stands in for the JVM. With run unset it answers every
+// request with fakeResults.
+type fakeRunner struct {
+	mu    sync.Mutex
+	calls []ModelRequest
+	run   func(ctx context.Context, req ModelRequest) (ModelOutput, error)
+}
+
+func (f *fakeRunner) Run(ctx context.Context, req ModelRequest) (ModelOutput, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, req)
+	f.mu.Unlock()
+	if f.run != nil {
+		return f.run(ctx, req)
+	}
+	return ModelOutput{Backend: "fake", Results: fakeResults(req, 3)}, nil
+}
+
+func (f *fakeRunner) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// fakeResults makes years rows whose values follow from req, so runs with
+// different parameters differ.
+func fakeResults(req ModelRequest, years int) []SimulationResult {
+	results := make([]SimulationResult, years)
+	for i := range results {
+		results[i] = SimulationResult{
+			Year:             float64(i),
+			Scenario:         req.Scenario,
+			Revenue:          req.OilPrice * req.ExchangeRate * float64(i+1),
+			ProductionVolume: float64(req.DrillingRate * (i + 1)),
+			NewWellsFund:     float64(req.DrillingRate),
+			OldWellsFund:     100,
+		}
+	}
+	return results
+}
+
+// newTestServer builds a Server without a database from the defaults,
+// changed by set, with the seeded admin/admin123 and user/user123.
+func newTestServer(t *testing.T, runner ModelRunner, set func(*Config)) *Server {
+	t.Helper()
+	cfg, err := loadConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	cfg.LogQueueSize = 0
+	if set != nil {
+		set(&cfg)
+	}
+	if runner == nil {
+		runner = &fakeRunner{}
+	}
+	s := newServer(newLiveConfig(cfg), nil, nil, runner, newMetricsRegistry())
+	if err := s.seedUsers(); err != nil {
+		t.Fatalf("seedUsers: %v", err)
+	}
+	return s
+}
+
+// login returns an access token for username, as /api/login would.
+func (s *Server) login(username string) string {
+	token, _ := s.newSession(username, "", time.Hour)
+	return token
+}
+
+// serve sends a request through the full route table. body, when not nil,
+// is encoded as JSON; token, when set, is sent as a bearer token.
+func serve(t *testing.T, h http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encode body: %v", err)
+		}
+		rd = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeResponse decodes an enveloped answer, with its data into data when
+// that is not nil.
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, data interface{}) APIResponse {
+	t.Helper()
+	var resp struct {
+		APIResponse
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	if data != nil && len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, data); err != nil {
+			t.Fatalf("decode data %s: %v", resp.Data, err)
+		}
+	}
+	return resp.APIResponse
+}
+
+func TestRegisterLoginAndRun(t *testing.T) {
+	runner := &fakeRunner{}
+	s := newTestServer(t, runner, nil)
+	h := s.routes(t.TempDir())
+
+	rec := serve(t, h, "POST", "/api/register", "", User{Username: "bob", Password: "secret123"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(t, h, "POST", "/api/login", "", User{Username: "bob", Password: "wrong"})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status %d, want 401", rec.Code)
+	}
+
+	rec = serve(t, h, "POST", "/api/login", "", User{Username: "bob", Password: "secret123"})
+	var login struct {
+		Token string `json:"token"`
+	}
+	if resp := decodeResponse(t, rec, &login); rec.Code != http.StatusOK || !resp.Success || login.Token == "" {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(t, h, "POST", "/api/run-model", "", ModelRequest{})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("run-model without a token: status %d, want 401", rec.Code)
+	}
+
+	rec = serve(t, h, "POST", "/api/run-model", login.Token, map[string]interface{}{"scenario": 2, "oilPrice": 90})
+	var run struct {
+		Results []SimulationResult `json:"results"`
+	}
+	decodeResponse(t, rec, &run)
+	if rec.Code != http.StatusOK || len(run.Results) != 3 {
+		t.Fatalf("run-model: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := runner.calls[0]; got.Scenario != 2 || got.OilPrice != 90 {
+		t.Errorf("runner got %+v, want scenario 2 at oil price 90", got)
+	}
+}
+
+func TestSlowClientCutOffAtReadTimeout(t *testing.T) {
+	s := newTestServer(t, nil, func(cfg *Config) { cfg.ReadTimeout = 200 * time.Millisecond })
+	hs := s.httpServer("", t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Headers that never end, a byte at a time would do the same.
+	if _, err := io.WriteString(conn, "GET /api/status HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the connection open past HTTP_READ_TIMEOUT")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("connection closed after %s, before the read timeout", elapsed)
+	}
+}
+
+func TestTrimSlashMiddleware(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/api/history", "/api/history"},
+		{"/api/history/", "/api/history"},
+		{"/api/jobs/abc//", "/api/jobs/abc"},
+		{"/api/", "/api/"},
+		{"/metrics/", "/metrics"},
+		{"/", "/"},
+		{"/docs/", "/docs/"},
+	}
+	for _, tt := range tests {
+		var got string
+		h := trimSlashMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.URL.Path }))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.in, nil))
+		if got != tt.want {
+			t.Errorf("%s reached the mux as %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAPIRoutesWithAndWithoutSlash(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	h := s.routes(staticRoot(t))
+	for _, path := range []string{"/api/scenarios", "/api/scenarios/"} {
+		rec := serve(t, h, "GET", path, "", nil)
+		if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || ct != "application/json" {
+			t.Errorf("GET %s: status %d, Content-Type %q; want the scenarios JSON", path, rec.Code, ct)
+		}
+	}
+	for _, path := range []string{"/api/login", "/api/login/"} {
+		rec := serve(t, h, "POST", path, "", User{Username: "user", Password: "user123"})
+		if rec.Code != http.StatusOK {
+			t.Errorf("POST %s: status %d, want 200: %s", path, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, h, "GET", "/", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /: status %d, the frontend index should still be served", rec.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== Shared links ====================
+
+// sharePayload is what a share token vouches for. Owner is the username
+// as stored in request_logs, so anonymized names stay hashed in the link.
+// Kind is empty for a run link and shareTimeline for a history feed.
+type sharePayload struct {
+	Kind    string `json:"kind,omitempty"`
+	RunID   int    `json:"id"`
+	Owner   string `json:"owner"`
+	Expires int64  `json:"exp"`
+}
+
+var errBadShareToken = errors.New("invalid share link")
+
+// signShare encodes p as base64url(payload) + "." + base64url(HMAC).
+func signShare(key []byte, p sharePayload) string {
+	body, _ := json.Marshal(p)
+	enc := base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(enc))
+	return enc + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyShare checks the signature and expiry of a token from signShare.
+func verifyShare(key []byte, token string, now time.Time) (sharePayload, error) {
+	var p sharePayload
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return p, errBadShareToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return p, errBadShareToken
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(enc))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return p, errBadShareToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || json.Unmarshal(body, &p) != nil {
+		return p, errBadShareToken
+	}
+	if now.Unix() > p.Expires {
+		return p, fmt.Errorf("share link expired")
+	}
+	return p, nil
+}
+
+// requestBaseURL is the scheme and host the client reached us on.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleShareRun issues a signed link to one of the caller's runs.
+// ?ttl= shortens the link's lifetime below SHARE_TTL.
+func (s *Server) handleShareRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.sendError(w, r, "Invalid run id", http.StatusBadRequest)
+		return
+	}
+
+	ttl := s.config().ShareTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > ttl {
+			s.sendError(w, r, fmt.Sprintf("ttl must be a positive duration up to %s", ttl), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	results, err := s.getStoredResults(username, id)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(results) == 0 {
+		s.sendError(w, r, "Run has no stored results", http.StatusUnprocessableEntity)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	token := signShare(s.shareKey, sharePayload{RunID: id, Owner: s.logUsername(username), Expires: expiresAt.Unix()})
+	path := "/api/shared/" + token
+	log.Printf("[%s] Shared run %d until %s", username, id, expiresAt.Format(time.RFC3339))
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Share link created",
+		Data: map[string]interface{}{
+			"url":       requestBaseURL(r) + path,
+			"path":      path,
+			"expiresAt": expiresAt,
+		},
+	})
+}
+
+// handleShared serves a shared run's results to anyone holding a valid
+// link.
+func (s *Server) handleShared(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := verifyShare(s.shareKey, r.PathValue("token"), time.Now())
+	if err == nil && p.Kind != "" {
+		err = errBadShareToken
+	}
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	results, err := s.storedResults(p.Owner, p.RunID)
+	if errors.Is(err, errRunNotFound) {
+		s.sendError(w, r, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.sendError(w, r, "Failed to load run: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"id":        p.RunID,
+			"results":   results,
+			"expiresAt": time.Unix(p.Expires, 0).UTC(),
+		},
+	})
+}
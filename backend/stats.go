@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ==================== Stats ====================
+
+// defaultResultSizeBuckets are the upper bounds /api/stats/result-sizes
+// uses unless RESULT_SIZE_BUCKETS or ?buckets= says otherwise.
+var defaultResultSizeBuckets = []float64{0, 10, 25, 50, 100, 250, 500, 1000}
+
+// parseBuckets reads histogram upper bounds, which must be strictly
+// increasing.
+func parseBuckets(items []string) ([]float64, error) {
+	buckets := make([]float64, 0, len(items))
+	for _, item := range items {
+		b, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", item)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be strictly increasing")
+		}
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("at least one bucket is required")
+	}
+	return buckets, nil
+}
+
+// resultSizeHistogram counts the result_count of successful runs into
+// cumulative buckets, in the same shape /api/metrics.json uses.
+func (s *Server) resultSizeHistogram(buckets []float64) (HistogramSnapshot, error) {
+	h := HistogramSnapshot{
+		Name: "result_count",
+		Help: "Rows returned by successful model runs",
+	}
+	if s.database() == nil {
+		return h, fmt.Errorf("database not connected")
+	}
+
+	// Few distinct sizes exist in practice, so group in SQL and bucket here.
+	rows, err := s.queryRead(`SELECT result_count, COUNT(*) FROM request_logs WHERE success GROUP BY result_count`)
+	if err != nil {
+		return h, err
+	}
+	defer rows.Close()
+
+	counts := make([]uint64, len(buckets))
+	for rows.Next() {
+		var size int
+		var n uint64
+		if err := rows.Scan(&size, &n); err != nil {
+			return h, err
+		}
+		h.Count += n
+		h.Sum += float64(size) * float64(n)
+		// Cumulative: every bucket at or above size.
+		for i := sort.SearchFloat64s(buckets, float64(size)); i < len(buckets); i++ {
+			counts[i] += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return h, err
+	}
+
+	h.Buckets = make([]HistogramBucket, len(buckets))
+	for i, ub := range buckets {
+		h.Buckets[i] = HistogramBucket{UpperBound: ub, Count: counts[i]}
+	}
+	return h, nil
+}
+
+func (s *Server) handleResultSizes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buckets := s.config().ResultSizeBuckets
+	if v := r.URL.Query().Get("buckets"); v != "" {
+		var err error
+		if buckets, err = parseBuckets(strings.Split(v, ",")); err != nil {
+			s.sendError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h, err := s.resultSizeHistogram(buckets)
+	if err != nil {
+		s.sendError(w, r, "Failed to compute result sizes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    h,
+	})
+}
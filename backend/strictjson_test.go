@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnknownFields(t *testing.T) {
+	tests := []struct {
+		name, path, body string
+	}{
+		{"login", "/api/login", `{"username":"user","password":"user123","remember":true}`},
+		{"register", "/api/register", `{"username":"carol","password":"secret123","email":"c@x"}`},
+		// ModelRequest has its own UnmarshalJSON, which the decoder can't check.
+		{"run-model", "/api/run-model", `{"scenario":1,"oilPrise":90}`},
+		// delta isn't a ModelRequest field, so it mustn't count as unknown.
+		{"sensitivity", "/api/sensitivity", `{"scenario":1,"delta":0.1,"oilPrise":90}`},
+	}
+	modes := []struct {
+		name   string
+		strict bool
+		header string
+		status int
+	}{
+		{"strict", true, "", http.StatusBadRequest},
+		{"strict with header", true, "true", http.StatusOK},
+		{"lenient", false, "", http.StatusOK},
+	}
+	for _, mode := range modes {
+		s := newTestServer(t, nil, func(cfg *Config) { cfg.StrictJSON = mode.strict })
+		h := s.routes(t.TempDir())
+		token := s.login("user")
+		for _, tt := range tests {
+			t.Run(mode.name+"/"+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer "+token)
+				if mode.header != "" {
+					req.Header.Set("X-Allow-Unknown-Fields", mode.header)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != mode.status {
+					t.Fatalf("status %d, want %d: %s", rec.Code, mode.status, rec.Body)
+				}
+				if resp := decodeResponse(t, rec, nil); mode.status == http.StatusBadRequest && !strings.Contains(resp.Error, "unknown field") {
+					t.Errorf("error %q doesn't name the unknown field", resp.Error)
+				}
+			})
+		}
+	}
+}
+
+func TestUnknownFieldMatchesCaseInsensitively(t *testing.T) {
+	var req ModelRequest
+	if err := unknownField([]byte(`{"OILPRICE":90,"Scenario":1}`), &req); err != nil {
+		t.Errorf("known fields in another case rejected: %v", err)
+	}
+	err := unknownField([]byte(`{"zeta":1,"alpha":2}`), &req)
+	if err == nil || !strings.Contains(err.Error(), `"alpha"`) {
+		t.Errorf("got %v, want the first unknown field by name, alpha", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== Timeline feed ====================
+
+// Calendar apps fetch a subscription URL without headers, so the feed is
+// reached with a signed token in the query string: a share token of kind
+// shareTimeline, which names the owner but no run. Run share links can't
+// open the feed, nor a feed token a run.
+
+const (
+	shareTimeline = "timeline"
+	icsTimeFormat = "20060102T150405Z"
+	// icsLineOctets is the longest content line RFC 5545 allows before
+	// folding.
+	icsLineOctets = 75
+)
+
+// requestTimeline is owner's last limit runs, newest first. owner is the
+// username as request_logs stores it.
+func (s *Server) requestTimeline(owner string, limit int) ([]RequestLog, error) {
+	if s.database() == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+	query := `SELECT id, timestamp, scenario, drilling_rate, oil_price, exchange_rate, success, result_count, COALESCE(error_msg, ''), seed, COALESCE(project, '')
+			  FROM request_logs WHERE username = $1 ORDER BY timestamp DESC LIMIT $2`
+	rows, err := s.queryRead(query, owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []RequestLog
+	for rows.Next() {
+		var l RequestLog
+		if err := rows.Scan(&l.ID, &l.Timestamp, &l.Scenario, &l.DrillingRate, &l.OilPrice, &l.ExchangeRate, &l.Success, &l.ResultCount, &l.Error, &l.Seed, &l.Project); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// icsEscape escapes a TEXT value.
+func icsEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(v)
+}
+
+// writeICSLine writes one content line, folded at icsLineOctets without
+// splitting a UTF-8 sequence.
+func writeICSLine(b *strings.Builder, line string) {
+	limit := icsLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The leading space of a continuation counts toward its length.
+		limit = icsLineOctets - 1
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// timelineICS renders runs as an iCalendar feed, one event per run at the
+// time it was logged.
+func timelineICS(runs []RequestLog, host, name string, now time.Time) string {
+	var b strings.Builder
+	line := func(l string) { writeICSLine(&b, l) }
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//modelirovanie//Run history//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:" + icsEscape("Model runs: "+name))
+	for _, run := range runs {
+		outcome := "succeeded"
+		if !run.Success {
+			outcome = "failed"
+		}
+		desc := []string{
+			fmt.Sprintf("Scenario: %d", run.Scenario),
+			fmt.Sprintf("Drilling rate: %d", run.DrillingRate),
+			"Oil price: " + formatFloat(run.OilPrice),
+			"Exchange rate: " + formatFloat(run.ExchangeRate),
+			fmt.Sprintf("Results: %d", run.ResultCount),
+		}
+		if run.Seed != nil {
+			desc = append(desc, fmt.Sprintf("Seed: %d", *run.Seed))
+		}
+		if run.Project != "" {
+			desc = append(desc, "Project: "+run.Project)
+		}
+		if run.Error != "" {
+			desc = append(desc, "Error: "+run.Error)
+		}
+
+		line("BEGIN:VEVENT")
+		line(fmt.Sprintf("UID:run-%d@%s", run.ID, host))
+		line("DTSTAMP:" + now.UTC().Format(icsTimeFormat))
+		line("DTSTART:" + run.Timestamp.UTC().Format(icsTimeFormat))
+		line("SUMMARY:" + icsEscape(fmt.Sprintf("Run #%d %s (scenario %d)", run.ID, outcome, run.Scenario)))
+		line("DESCRIPTION:" + icsEscape(strings.Join(desc, "\n")))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return b.String()
+}
+
+// handleTimelineLink is POST /api/history/timeline: a subscribable feed
+// URL for the caller's runs, valid for TIMELINE_TTL.
+func (s *Server) handleTimelineLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.Header.Get("X-Username")
+	expiresAt := time.Now().Add(s.config().TimelineTTL)
+	token := signShare(s.shareKey, sharePayload{Kind: shareTimeline, Owner: s.logUsername(username), Expires: expiresAt.Unix()})
+	path := "/api/history/timeline.ics?token=" + token
+	log.Printf("[%s] Timeline feed link issued until %s", username, expiresAt.Format(time.RFC3339))
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Timeline link created",
+		Data: map[string]interface{}{
+			"url":       requestBaseURL(r) + path,
+			"path":      path,
+			"expiresAt": expiresAt,
+		},
+	})
+}
+
+// handleTimeline is GET /api/history/timeline.ics?token=: the owner's last
+// TIMELINE_MAX_EVENTS runs as an iCalendar feed.
+func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := verifyShare(s.shareKey, r.URL.Query().Get("token"), time.Now())
+	if err == nil && p.Kind != shareTimeline {
+		err = errBadShareToken
+	}
+	if err != nil {
+		s.sendError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	runs, err := s.requestTimeline(p.Owner, s.config().TimelineMaxEvents)
+	if err != nil {
+		s.sendError(w, r, "Failed to fetch history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// An anonymized owner is a hash; show it shortened rather than whole.
+	name := p.Owner
+	if len(name) > 12 && s.config().AnonymizeUsernames {
+		name = name[:12]
+	}
+	body := timelineICS(runs, r.Host, name, time.Now())
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="timeline.ics"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write([]byte(body))
+}
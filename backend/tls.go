@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// ==================== TLS ====================
+
+// tlsVersions are the TLS_MIN_VERSION values accepted. 1.0 and 1.1 are
+// known but refused, so the error can say why.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSSettings are the HTTPS settings. With neither CertFile nor KeyFile
+// the server speaks plain HTTP and the rest is unused.
+type TLSSettings struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is "1.2" or "1.3". CipherSuites restricts the TLS 1.2
+	// suites by name; nil keeps Go's defaults. TLS 1.3 suites are not
+	// configurable.
+	MinVersion   string
+	CipherSuites []string
+}
+
+func (t TLSSettings) enabled() bool {
+	return t.CertFile != ""
+}
+
+// config is the tls.Config the server listens with. The settings were
+// checked by loadTLSSettings, so every name resolves.
+func (t TLSSettings) config() *tls.Config {
+	c := &tls.Config{MinVersion: tlsVersions[t.MinVersion]}
+	for _, name := range t.CipherSuites {
+		for _, cs := range tls.CipherSuites() {
+			if cs.Name == name {
+				c.CipherSuites = append(c.CipherSuites, cs.ID)
+			}
+		}
+	}
+	return c
+}
+
+func checkTLSVersion(s string) error {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", s)
+	}
+	if v < tls.VersionTLS12 {
+		return fmt.Errorf("TLS_MIN_VERSION %s is insecure, use 1.2 or 1.3", s)
+	}
+	return nil
+}
+
+// parseCipherSuites checks TLS_CIPHER_SUITES names as Go spells them,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, and uppercases them. Suites
+// Go lists as insecure are refused.
+func parseCipherSuites(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	byName := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs
+	}
+	insecure := make(map[string]bool)
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecure[cs.Name] = true
+	}
+
+	suites := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if insecure[name] {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: %s is insecure", name)
+		}
+		cs, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: unknown cipher suite %q", name)
+		}
+		supports12 := false
+		for _, v := range cs.SupportedVersions {
+			supports12 = supports12 || v == tls.VersionTLS12
+		}
+		if !supports12 {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: %s is a TLS 1.3 suite, which can't be configured", name)
+		}
+		suites = append(suites, name)
+	}
+	return suites, nil
+}
+
+// loadTLSSettings reads the TLS_* variables.
+func loadTLSSettings(env *envSource) (TLSSettings, error) {
+	t := TLSSettings{
+		CertFile:   env.String("TLS_CERT_FILE", ""),
+		KeyFile:    env.String("TLS_KEY_FILE", ""),
+		MinVersion: env.String("TLS_MIN_VERSION", "1.2"),
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return t, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if err := checkTLSVersion(t.MinVersion); err != nil {
+		return t, err
+	}
+	var err error
+	if t.CipherSuites, err = parseCipherSuites(env.List("TLS_CIPHER_SUITES", nil)); err != nil {
+		return t, err
+	}
+	if t.CipherSuites != nil && t.MinVersion == "1.3" {
+		return t, fmt.Errorf("TLS_CIPHER_SUITES has no effect with TLS_MIN_VERSION 1.3")
+	}
+	return t, nil
+}
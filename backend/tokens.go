@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ==================== Refresh tokens ====================
+
+// RefreshSession is a long-lived refresh token issued by
+// /api/login?refresh=true. Access tokens minted from it carry its token
+// in Session.RefreshToken and stop working once it is revoked.
+type RefreshSession struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newSession registers an access token for username. refreshToken is the
+// refresh token it derives from, or "" for a standalone login token.
+func (s *Server) newSession(username, refreshToken string, ttl time.Duration) (string, time.Time) {
+	token := generateToken()
+	expiresAt := time.Now().Add(ttl)
+	s.mu.Lock()
+	s.sessions[token] = &Session{Username: username, ExpiresAt: expiresAt, RefreshToken: refreshToken}
+	s.mu.Unlock()
+	return token, expiresAt
+}
+
+func (s *Server) newRefreshSession(username string) (string, time.Time) {
+	token := generateToken()
+	expiresAt := time.Now().Add(s.config().RefreshTokenTTL)
+	s.mu.Lock()
+	s.refreshSessions[token] = &RefreshSession{Username: username, ExpiresAt: expiresAt}
+	s.mu.Unlock()
+	return token, expiresAt
+}
+
+// revokeRefreshToken drops a refresh token and every access token minted
+// from it, returning how many access tokens went with it.
+func (s *Server) revokeRefreshToken(refreshToken string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refreshSessions, refreshToken)
+	n := 0
+	for token, session := range s.sessions {
+		if session.RefreshToken == refreshToken {
+			delete(s.sessions, token)
+			n++
+		}
+	}
+	return n
+}
+
+// sessionRevoked reports whether session was minted from a refresh token
+// that no longer exists. Callers hold s.mu.
+func (s *Server) sessionRevoked(session *Session) bool {
+	if session.RefreshToken == "" {
+		return false
+	}
+	_, ok := s.refreshSessions[session.RefreshToken]
+	return !ok
+}
+
+// handleRefresh exchanges a valid refresh token for a new access token.
+// The refresh token itself is unchanged.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	s.setCORSHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := s.decodeJSON(r, &req); err != nil {
+		s.sendDecodeError(w, r, err)
+		return
+	}
+
+	s.mu.RLock()
+	refresh, exists := s.refreshSessions[req.RefreshToken]
+	s.mu.RUnlock()
+	if !exists || req.RefreshToken == "" {
+		s.sendError(w, r, "Invalid refresh token. Please login.", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(refresh.ExpiresAt) {
+		s.sendError(w, r, "Refresh token expired. Please login.", http.StatusUnauthorized)
+		return
+	}
+
+	token, expiresAt := s.newSession(refresh.Username, req.RefreshToken, s.config().AccessTokenTTL)
+
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Token refreshed",
+		Data: map[string]interface{}{
+			"token":     token,
+			"username":  refresh.Username,
+			"expiresAt": expiresAt,
+		},
+	})
+}
+
+// logoutRefreshToken is the refresh token /api/logout should revoke: the
+// one in the body, or else the one the bearer token derives from.
+func (s *Server) logoutRefreshToken(r *http.Request, session *Session) (string, error) {
+	var req RefreshRequest
+	if err := s.decodeJSON(r, &req); err != nil && !errors.Is(err, errEmptyBody) {
+		return "", err
+	}
+	if req.RefreshToken != "" {
+		return req.RefreshToken, nil
+	}
+	if session != nil {
+		return session.RefreshToken, nil
+	}
+	return "", nil
+}
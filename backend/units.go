@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ==================== Units ====================
+
+// defaultResultUnits are the units of the result metrics as ModelRunner
+// reports them. RESULT_UNITS overrides them per metric.
+var defaultResultUnits = map[string]string{
+	"revenue":          "mln RUB",
+	"productionVolume": "thousand t",
+	"newWellsFund":     "wells",
+	"oldWellsFund":     "wells",
+}
+
+// cumulativeMetrics maps the running totals ?cumulative=true adds to the
+// metric whose unit they share.
+var cumulativeMetrics = map[string]string{
+	"cumulativeRevenue":          "revenue",
+	"cumulativeProductionVolume": "productionVolume",
+}
+
+// parseResultUnits reads RESULT_UNITS entries, metric=unit, over the
+// defaults.
+func parseResultUnits(entries []string) (map[string]string, error) {
+	units := make(map[string]string, len(defaultResultUnits))
+	for metric, unit := range defaultResultUnits {
+		units[metric] = unit
+	}
+	for _, entry := range entries {
+		metric, unit, ok := strings.Cut(entry, "=")
+		metric, unit = strings.TrimSpace(metric), strings.TrimSpace(unit)
+		if _, known := defaultResultUnits[metric]; !ok || !known || unit == "" {
+			names := make([]string, 0, len(defaultResultUnits))
+			for name := range defaultResultUnits {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("RESULT_UNITS entries must be metric=unit with metric one of %s, got %q", strings.Join(names, ", "), entry)
+		}
+		units[metric] = unit
+	}
+	return units, nil
+}
+
+// resultUnits is units extended to the cumulative totals.
+func resultUnits(units map[string]string) map[string]string {
+	all := make(map[string]string, len(units)+len(cumulativeMetrics))
+	for metric, unit := range units {
+		all[metric] = unit
+	}
+	for total, metric := range cumulativeMetrics {
+		all[total] = units[metric]
+	}
+	return all
+}
+
+// UnitValue is a metric with its unit attached, for ?withUnits=true.
+type UnitValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// withUnits re-encodes rows, a slice of result structs, with every metric
+// units names wrapped as a UnitValue. Other fields are left as they are.
+func withUnits(rows interface{}, units map[string]string) ([]map[string]interface{}, error) {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	var out []map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	for _, row := range out {
+		for field, v := range row {
+			unit, ok := units[field]
+			if f, isNumber := v.(float64); ok && isNumber {
+				row[field] = UnitValue{Value: f, Unit: unit}
+			}
+		}
+	}
+	return out, nil
+}
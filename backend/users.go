@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// ==================== Users ====================
+
+// Users live in memory and, when the database is up, in the users table.
+// The table's unique constraint is what settles two concurrent
+// registrations of the same name; the in-memory check is only a fast path.
+
+var (
+	errUserExists   = errors.New("username already exists")
+	errUserNotFound = errors.New("user not found")
+)
+
+// pqUniqueViolation is PostgreSQL's unique_violation SQLSTATE.
+const pqUniqueViolation = "23505"
+
+// userStore persists new accounts; tests stand in for the database with
+// their own.
+type userStore interface {
+	insertUser(username, hash string) error
+}
+
+// dbUsers writes to the users table of the current database, or nowhere
+// while there is none.
+type dbUsers struct{ s *Server }
+
+func (d dbUsers) insertUser(username, hash string) error {
+	db := d.s.database()
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(`INSERT INTO users (username, password_hash) VALUES ($1, $2)`, username, hash)
+	return err
+}
+
+func (s *Server) createUser(username, hash string) error {
+	s.mu.Lock()
+	_, exists := s.users[username]
+	s.mu.Unlock()
+	if exists {
+		return errUserExists
+	}
+
+	if err := s.userStore.insertUser(username, hash); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+			return errUserExists
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[username]; exists {
+		return errUserExists
+	}
+	s.users[username] = hash
+	return nil
+}
+
+// lookupPasswordHash finds a user's hash in memory, then in the database.
+func (s *Server) lookupPasswordHash(username string) (string, bool) {
+	s.mu.RLock()
+	hash, ok := s.users[username]
+	s.mu.RUnlock()
+	if ok || s.database() == nil {
+		return hash, ok
+	}
+
+	active := true
+	err := s.database().QueryRow(`SELECT password_hash, active FROM users WHERE username = $1`, username).Scan(&hash, &active)
+	if err != nil {
+		return "", false
+	}
+	s.mu.Lock()
+	s.users[username] = hash
+	if !active {
+		s.disabledUsers[username] = true
+	}
+	s.mu.Unlock()
+	return hash, true
+}
+
+// isDisabled reports whether an admin has disabled username. It relies on
+// lookupPasswordHash having loaded the user.
+func (s *Server) isDisabled(username string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabledUsers[username]
+}
+
+// setUserActive enables or disables an account. Disabling also ends every
+// session and refresh token the user holds; their history is untouched.
+func (s *Server) setUserActive(username string, active bool) error {
+	if _, ok := s.lookupPasswordHash(username); !ok {
+		return errUserNotFound
+	}
+	if s.database() != nil {
+		// Seeded accounts only exist in memory, so no row may match.
+		if _, err := s.database().Exec(`UPDATE users SET active = $1 WHERE username = $2`, active, username); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if active {
+		delete(s.disabledUsers, username)
+		return nil
+	}
+	s.disabledUsers[username] = true
+	for token, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, token)
+		}
+	}
+	for token, refresh := range s.refreshSessions {
+		if refresh.Username == username {
+			delete(s.refreshSessions, token)
+		}
+	}
+	return nil
+}
+
+func (s *Server) updatePasswordHash(username, hash string) error {
+	if s.database() != nil {
+		if _, err := s.database().Exec(`UPDATE users SET password_hash = $1 WHERE username = $2`, hash, username); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.users[username] = hash
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		status   int
+		code     string
+	}{
+		{"wrong old password", "nope", "x", http.StatusUnauthorized, ""},
+		{"weak new password", "user123", "x", http.StatusBadRequest, "password_min_length"},
+		{"changed", "user123", "longer-pass1", http.StatusOK, ""},
+	}
+	s := newTestServer(t, nil, nil)
+	h := s.routes(t.TempDir())
+	token := s.login("user")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, h, "POST", "/api/change-password", token,
+				ChangePasswordRequest{OldPassword: tt.old, NewPassword: tt.new})
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if resp := decodeResponse(t, rec, nil); tt.code != "" && resp.Code != tt.code {
+				t.Errorf("code %q, want %q", resp.Code, tt.code)
+			}
+		})
+	}
+
+	hash, _ := s.lookupPasswordHash("user")
+	if !checkPassword(hash, "longer-pass1") {
+		t.Error("the new password doesn't log in")
+	}
+}
+
+func TestConcurrentRegistrationOfOneName(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	h := s.routes(t.TempDir())
+
+	const n = 8
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := serve(t, h, "POST", "/api/register", "", User{Username: "alice", Password: "secret123"})
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, c := range codes {
+		counts[c]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != n-1 {
+		t.Errorf("statuses %v, want one 200 and %d 409s", counts, n-1)
+	}
+}
+
+// failingUsers is a userStore whose inserts fail with err.
+type failingUsers struct{ err error }
+
+func (f failingUsers) insertUser(string, string) error { return f.err }
+
+func TestRegisterInsertErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		// Another server, or a registration that got past the in-memory
+		// check first, already inserted the row.
+		{"unique violation", &pq.Error{Code: pqUniqueViolation}, http.StatusConflict},
+		{"other database error", &pq.Error{Code: "08006"}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, nil)
+			s.userStore = failingUsers{tt.err}
+			rec := serve(t, s.routes(t.TempDir()), "POST", "/api/register", "", User{Username: "dave", Password: "secret123"})
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if _, ok := s.users["dave"]; ok {
+				t.Error("a failed insert still added the user in memory")
+			}
+		})
+	}
+}
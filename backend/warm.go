@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ==================== Warm-up ====================
+
+// javaVersionTimeout bounds the `java -version` a warm-up runs.
+const javaVersionTimeout = 30 * time.Second
+
+// WarmupReport is what a warm-up found. ModelRunner has no daemon mode, so
+// each run still starts its own process; warming checks up front what that
+// process needs and, for the JVM, reads the classpath jars so the first
+// run loads them from the page cache instead of the disk.
+type WarmupReport struct {
+	// Command is MODEL_CMD resolved; Version is `java -version`'s first
+	// line, for the java command only.
+	Command  string        `json:"command"`
+	Version  string        `json:"version,omitempty"`
+	ModelJar *ModelJarInfo `json:"modelJar,omitempty"`
+	// Jars are the classpath entries with their wildcards expanded.
+	Jars       []string  `json:"jars"`
+	BytesRead  int64     `json:"bytesRead"`
+	DurationMs float64   `json:"durationMs"`
+	WarmedAt   time.Time `json:"warmedAt"`
+	Ready      bool      `json:"ready"`
+	Problems   []string  `json:"problems,omitempty"`
+}
+
+// warmModel resolves MODEL_CMD and, when it runs model.jar, checks the
+// java version and the classpath.
+func (s *Server) warmModel() WarmupReport {
+	start := time.Now()
+	cfg := s.config()
+	rep := WarmupReport{WarmedAt: start.UTC(), Jars: []string{}}
+
+	path, err := exec.LookPath(cfg.ModelCmd)
+	if err != nil {
+		rep.Problems = append(rep.Problems, err.Error())
+	}
+	rep.Command = path
+	if err == nil && filepath.Base(path) == "java" {
+		out, err := javaVersion(path)
+		rep.Version, _, _ = strings.Cut(out, "\n")
+		if err != nil {
+			rep.Problems = append(rep.Problems, "java -version failed: "+err.Error())
+		}
+	}
+
+	if cfg.usesModelJar() {
+		s.warmClasspath(cfg, &rep)
+	}
+
+	rep.Ready = len(rep.Problems) == 0
+	rep.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return rep
+}
+
+// warmClasspath checks model.jar and ModelRunner.class and reads every jar
+// on the classpath into the page cache.
+func (s *Server) warmClasspath(cfg Config, rep *WarmupReport) {
+	jar := s.refreshModelJar()
+	rep.ModelJar = &jar
+	if !jar.Valid {
+		rep.Problems = append(rep.Problems, "model.jar: "+jar.Error)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.ModelDir, "ModelRunner.class")); err != nil {
+		rep.Problems = append(rep.Problems, err.Error())
+	}
+
+	for _, entry := range strings.Split(buildClasspath(cfg.ModelDir), ":") {
+		rep.Jars = append(rep.Jars, classpathJars(entry)...)
+	}
+	for _, jar := range rep.Jars {
+		n, err := readAll(jar)
+		rep.BytesRead += n
+		if err != nil {
+			rep.Problems = append(rep.Problems, err.Error())
+		}
+	}
+}
+
+// javaVersion is what `java -version` prints, trimmed.
+func javaVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), javaVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// classpathJars are the jars a classpath entry stands for: the entry
+// itself if it is a jar, the jars in its directory if it is a wildcard.
+// A lib directory the model doesn't ship is not an error; java skips it
+// too.
+func classpathJars(entry string) []string {
+	if !strings.HasSuffix(entry, "*") {
+		if strings.HasSuffix(entry, ".jar") {
+			return []string{entry}
+		}
+		return nil
+	}
+	matches, _ := filepath.Glob(entry + ".jar")
+	return matches
+}
+
+func readAll(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, f)
+}
+
+func logWarmup(rep WarmupReport) {
+	if rep.Ready {
+		log.Printf("Model warm-up OK in %.0fms: %s, %d jars (%d bytes)", rep.DurationMs, rep.Command, len(rep.Jars), rep.BytesRead)
+		return
+	}
+	log.Printf("WARNING: model warm-up found problems, runs will likely fail: %s", strings.Join(rep.Problems, "; "))
+}
+
+// handleWarm is POST /api/admin/warm.
+func (s *Server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.sendError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rep := s.warmModel()
+	logWarmup(rep)
+	s.writeJSON(w, r, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rep,
+	})
+}
@@ -3,9 +3,16 @@ import pr11.CustomExperiment;
 import com.anylogic.engine.Engine;
 import com.anylogic.engine.analysis.DataSet;
 
+import java.io.PrintStream;
+import java.util.ArrayList;
+import java.util.List;
+import java.util.Random;
+
 /**
  * Headless runner for the AnyLogic oil company model.
- * Outputs CSV results to stdout.
+ * Outputs CSV results to stdout, or to the file given as the fifth argument.
+ * A --seed=N argument, anywhere on the command line, seeds the model's
+ * random number generator.
  */
 public class ModelRunner {
     
@@ -14,30 +21,60 @@ public class ModelRunner {
         int drillingRate = 50;
         double oilPrice = 80.0;
         double exchangeRate = 75.0;
+        String outputPath = null;
+        Long seed = null;
         
-        if (args.length >= 4) {
+        List<String> positional = new ArrayList<>();
+        for (String arg : args) {
+            if (arg.startsWith("--seed=")) {
+                try {
+                    seed = Long.parseLong(arg.substring("--seed=".length()));
+                } catch (NumberFormatException e) {
+                    System.err.println("Error parsing seed: " + e.getMessage());
+                    System.exit(1);
+                }
+            } else {
+                positional.add(arg);
+            }
+        }
+        if (positional.size() >= 4) {
             try {
-                scenario = Integer.parseInt(args[0]);
-                drillingRate = Integer.parseInt(args[1]);
-                oilPrice = Double.parseDouble(args[2]);
-                exchangeRate = Double.parseDouble(args[3]);
+                scenario = Integer.parseInt(positional.get(0));
+                drillingRate = Integer.parseInt(positional.get(1));
+                oilPrice = Double.parseDouble(positional.get(2));
+                exchangeRate = Double.parseDouble(positional.get(3));
             } catch (NumberFormatException e) {
                 System.err.println("Error parsing arguments: " + e.getMessage());
                 System.exit(1);
             }
         }
+        if (positional.size() >= 5) {
+            outputPath = positional.get(4);
+        }
         
         System.err.println("Starting model with parameters:");
         System.err.println("  Scenario: " + scenario);
         System.err.println("  Drilling Rate: " + drillingRate);
         System.err.println("  Oil Price: " + oilPrice);
         System.err.println("  Exchange Rate: " + exchangeRate);
+        if (seed != null) {
+            // The server reads the seed back from this line.
+            System.err.println("Seed: " + seed);
+        }
         
         final int finalScenario = scenario;
         
+        PrintStream out = System.out;
         try {
+            if (outputPath != null) {
+                out = new PrintStream(outputPath, "UTF-8");
+            }
+            
             CustomExperiment experiment = new CustomExperiment(null);
             Engine engine = experiment.createEngine();
+            if (seed != null) {
+                engine.setDefaultRandomGenerator(new Random(seed));
+            }
             Main model = new Main(engine, null, null);
             
             model.setParametersToDefaultValues();
@@ -59,7 +96,7 @@ public class ModelRunner {
             }
             
             // Output CSV header
-            System.out.println("Year,Scenario,Revenue,ProductionVolume,NewWellsFund,OldWellsFund");
+            out.println("Year,Scenario,Revenue,ProductionVolume,NewWellsFund,OldWellsFund");
             
             // Get DataSets - use the time dataset as primary reference
             DataSet dsTime = model._ds_время;
@@ -95,17 +132,22 @@ public class ModelRunner {
                     revenue = production * oilPrice * exchangeRate;
                 }
                 
-                System.out.printf("%.2f,%d,%.2f,%.2f,%.2f,%.2f%n", 
+                out.printf("%.2f,%d,%.2f,%.2f,%.2f,%.2f%n", 
                     time, finalScenario, revenue, production, newWells, oldWells);
             }
             
             engine.stop();
+            out.flush();
             System.err.println("Model completed successfully");
             
         } catch (Exception e) {
             System.err.println("Error running model: " + e.getMessage());
             e.printStackTrace(System.err);
             System.exit(1);
+        } finally {
+            if (out != System.out) {
+                out.close();
+            }
         }
     }
     